@@ -7,8 +7,11 @@
 package cmd
 
 import (
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	solis "github.com/andysan/gosolis/pkg/gosolis"
@@ -17,67 +20,398 @@ import (
 	"github.com/spf13/viper"
 )
 
-func daemonSendReport(bus *hermes.Hermes, di *solis.DeviceInformation) {
-	msg := map[string]interface{}{
-		"v_in":       di.Inputs[0].Voltage,
-		"i_in":       di.Inputs[0].Current,
-		"v_grid":     di.Grid.Voltage,
-		"i_grid":     di.Grid.Current,
-		"f_grid":     di.Grid.Frequency,
-		"temp":       di.Temperature,
-		"production": di.Production.Total,
-	}
-	if err := bus.Send(msg); err != nil {
+// Get the stable identity of the device used in topics and messages.
+func deviceIdentity(di *solis.DeviceInformation) string {
+	switch config.Daemon.Identity {
+	case "serial":
+		return di.SerialNo.String()
+	default:
+		return fmt.Sprintf("%d", config.Inverter.Addr)
+	}
+}
+
+var (
+	daemonEnergy      *solis.EnergyIntegrator
+	daemonEnergySaved time.Time
+)
+
+func loadEnergyState() {
+	var err error
+
+	if config.Daemon.EnergyState == "" {
+		daemonEnergy = solis.NewEnergyIntegrator()
+		return
+	}
+
+	daemonEnergy, err = solis.LoadEnergyIntegrator(config.Daemon.EnergyState)
+	if err != nil {
+		log.Fatal("Failed to load energy state: ", err)
+	}
+}
+
+func saveEnergyState(force bool) {
+	if config.Daemon.EnergyState == "" {
+		return
+	}
+
+	if !force && time.Since(daemonEnergySaved) < config.Daemon.EnergySaveInterval {
+		return
+	}
+
+	if err := daemonEnergy.Save(config.Daemon.EnergyState); err != nil {
+		log.Println("Failed to save energy state: ", err)
+	}
+	daemonEnergySaved = time.Now()
+}
+
+// Field mapping that reproduces the payload published by older
+// versions of the daemon.
+var legacyReportFields = map[string]string{
+	"v_in":       "inputs.0.voltage",
+	"i_in":       "inputs.0.current",
+	"v_grid":     "grid.voltage",
+	"i_grid":     "grid.current",
+	"f_grid":     "grid.frequency",
+	"temp":       "temperature",
+	"production": "production.total",
+}
+
+// Build a report containing the complete device information as a
+// nested message.
+func deviceReport(id string, di *solis.DeviceInformation,
+	energy solis.EnergyEstimate) map[string]interface{} {
+
+	inputs := make([]interface{}, len(di.Inputs))
+	for idx, inp := range di.Inputs {
+		inputs[idx] = map[string]interface{}{
+			"voltage": inp.Voltage,
+			"current": inp.Current,
+			"power":   inp.Power(),
+		}
+	}
+
+	report := map[string]interface{}{
+		"device":     id,
+		"serial":     di.SerialNo.String(),
+		"product":    di.Product.String(),
+		"sw_version": di.SWVersion.String(),
+		"inputs":     inputs,
+		"grid": map[string]interface{}{
+			"voltage":        di.Grid.Voltage,
+			"current":        di.Grid.Current,
+			"frequency":      di.Grid.Frequency,
+			"power_standard": uint(di.Grid.PowerStandard),
+			"status":         uint(di.Grid.GridStatus),
+		},
+		"power": map[string]interface{}{
+			"dc":           di.DCPower(),
+			"ac":           di.ACPower(),
+			"efficiency":   di.Efficiency(),
+			"power_factor": di.EstimatePowerFactor(solis.NominalEfficiency),
+		},
+		"production": map[string]interface{}{
+			"total":      di.Production.Total,
+			"month":      di.Production.Month,
+			"last_month": di.Production.LastMonth,
+			"today":      di.Production.Today,
+			"yesterday":  di.Production.Yesterday,
+		},
+		"energy": map[string]interface{}{
+			"total_wh": energy.Total,
+			"month_wh": energy.Month,
+			"today_wh": energy.Today,
+		},
+		"temperature": di.Temperature,
+		"status":      uint(di.Status),
+		"error":       uint(di.Error),
+		"power_curve": uint(di.PowerCurve),
+	}
+
+	if m, ok := di.Model(); ok {
+		report["model"] = m.Name
+	}
+
+	return report
+}
+
+// Build a report describing the health of the bus.
+func busReport() map[string]interface{} {
+	m := solisMetrics.Metrics()
+
+	report := map[string]interface{}{
+		"frames_sent":     m.FramesSent,
+		"frames_received": m.FramesReceived,
+		"acks_received":   m.AcksReceived,
+		"checksum_errors": m.ChecksumErrors,
+		"illegal_frames":  m.IllegalFrames,
+		"timeouts":        m.Timeouts,
+		"other_errors":    m.OtherErrors,
+		"skipped_bytes":   m.SkippedBytes,
+
+		"latency_avg_seconds": m.Latency.Mean().Seconds(),
+	}
+
+	if !m.LastReceived.IsZero() {
+		report["last_received"] = m.LastReceived.Unix()
+	}
+
+	return report
+}
+
+// Get the field mapping used to select fields from the report. Nil
+// means that the full report is published.
+func reportFields() map[string]string {
+	switch config.Daemon.Payload {
+	case "legacy":
+		fields := make(map[string]string, len(legacyReportFields))
+		for k, v := range legacyReportFields {
+			fields[k] = v
+		}
+		for k, v := range config.Daemon.Fields {
+			fields[k] = v
+		}
+		return fields
+
+	default:
+		if len(config.Daemon.Fields) == 0 {
+			return nil
+		}
+		return config.Daemon.Fields
+	}
+}
+
+func daemonSendReport(bus *hermes.Hermes, when time.Time, di *solis.DeviceInformation) {
+	id := deviceIdentity(di)
+	energy := daemonEnergy.Update(when, di)
+	saveEnergyState(false)
+
+	msg := deviceReport(id, di, energy)
+	if fields := reportFields(); fields != nil {
+		msg = hermes.Select(msg, fields)
+	}
+
+	labels := map[string]string{
+		"address":    fmt.Sprintf("%d", config.Inverter.Addr),
+		"serial":     di.SerialNo.String(),
+		"sw_version": di.SWVersion.String(),
+	}
+	if model, ok := di.Model(); ok {
+		labels["model"] = model.Name
+	}
+
+	daemonDeviceID = id
+	m := hermes.Message{
+		When:    when,
+		Source:  id,
+		Labels:  labels,
+		Message: msg,
+	}
+	if err := bus.Post(&m); err != nil {
 		log.Println("Message bus send failed: ", err)
 	}
 }
 
-func waitForDevice(dev *solis.Device) {
+// Daemon health reported in status reports
+type daemonStats struct {
+	started    time.Time
+	lastPoll   time.Time
+	lastReport time.Time
+	polls      uint64
+	reports    uint64
+	timeouts   uint64
+	errors     uint64
+}
+
+var (
+	daemonStatus     daemonStats
+	daemonStatusSent time.Time
+	// Current device state, see hermes.StateOnline
+	daemonState string
+	// Identity of the device in the last report
+	daemonDeviceID string
+	daemonSignals  = make(chan os.Signal, 1)
+)
+
+// Get the identity of the device for state updates. The identity
+// isn't known before the first report if devices are identified by
+// their serial number.
+func daemonSource() string {
+	if daemonDeviceID != "" {
+		return daemonDeviceID
+	} else if config.Daemon.Identity == "address" {
+		return fmt.Sprintf("%d", config.Inverter.Addr)
+	} else {
+		return ""
+	}
+}
+
+func daemonSetState(bus *hermes.Hermes, state string) {
+	if state == daemonState {
+		return
+	}
+
+	id := daemonSource()
+	if id == "" {
+		return
+	}
+
+	daemonState = state
+	bus.SetState(id, state)
+}
+
+// Build a report describing the status of the daemon.
+func daemonStatusReport(bus *hermes.Hermes) map[string]interface{} {
+	st := &daemonStatus
+	report := map[string]interface{}{
+		"version":        Version,
+		"started":        st.started.Unix(),
+		"uptime_seconds": int64(time.Since(st.started).Seconds()),
+		"polls":          st.polls,
+		"reports":        st.reports,
+		"timeouts":       st.timeouts,
+		"errors":         st.errors,
+		"bus":            busReport(),
+		"hermes":         bus.Stats(),
+	}
+
+	if id := daemonSource(); id != "" {
+		report["device"] = id
+	}
+	if daemonState != "" {
+		report["state"] = daemonState
+	}
+	if !st.lastPoll.IsZero() {
+		report["last_poll"] = st.lastPoll.Unix()
+	}
+	if !st.lastReport.IsZero() {
+		report["last_report"] = st.lastReport.Unix()
+	}
+
+	return report
+}
+
+func daemonSendStatus(bus *hermes.Hermes) {
+	if config.Daemon.StatusInterval <= 0 ||
+		time.Since(daemonStatusSent) < config.Daemon.StatusInterval {
+
+		return
+	}
+
+	bus.SendStatus(daemonStatusReport(bus))
+	daemonStatusSent = time.Now()
+}
+
+// Sleep for a duration while handling commands. Returns early if a
+// command requests a refresh. Shuts down the daemon if it receives a
+// termination signal.
+func daemonSleep(bus *hermes.Hermes, dev *solis.Device, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			return
+		case c := <-bus.Commands():
+			if daemonCommand(dev, c) {
+				return
+			}
+		case sig := <-daemonSignals:
+			log.Printf("Received %s, shutting down...", sig)
+			daemonExit(bus, 0)
+		}
+	}
+}
+
+// Save state and disconnect from all backends before exiting.
+func daemonExit(bus *hermes.Hermes, code int) {
+	saveEnergyState(true)
+	if err := bus.Close(); err != nil {
+		log.Println("Failed to close message bus: ", err)
+	}
+	os.Exit(code)
+}
+
+func waitForDevice(bus *hermes.Hermes, dev *solis.Device) {
 	log.Println("Device not responding, waiting for device...")
+	daemonSetState(bus, hermes.StateOffline)
 	for {
-		time.Sleep(config.Daemon.ProbeInterval)
+		daemonSendStatus(bus)
+		daemonSleep(bus, dev, config.Daemon.ProbeInterval)
+
+		daemonStatus.lastPoll = time.Now()
+		daemonStatus.polls++
 		if err := dev.Ping(); err == nil {
 			log.Println("Device online...")
 			return
-		} else if err != solis.PortTimeoutError {
+		} else if err == solis.PortTimeoutError {
+			daemonStatus.timeouts++
+		} else {
 			log.Println("Unhandled device error:", err)
-			os.Exit(exitSerial)
+			daemonSetState(bus, hermes.StateCommError)
+			daemonExit(bus, exitSerial)
 		}
 	}
 }
 
 func daemonMain(cmd *cobra.Command, args []string) {
+	switch config.Daemon.Identity {
+	case "address", "serial":
+	default:
+		log.Fatalf("Illegal device identity '%s'", config.Daemon.Identity)
+	}
+
+	switch config.Daemon.Payload {
+	case "full", "legacy":
+	default:
+		log.Fatalf("Illegal payload type '%s'", config.Daemon.Payload)
+	}
+
 	h := viper.Sub("hermes")
 	if h == nil {
 		log.Fatal("Hermes not configured")
 	}
 
+	loadEnergyState()
+
 	bus := hermes.NewViper(h, cfgBase)
 	if bus == nil {
 		log.Fatal("Failed to create Hermes backend")
 	}
 
+	daemonStatus.started = time.Now()
+	signal.Notify(daemonSignals, os.Interrupt, syscall.SIGTERM)
+
 	// Try to connect to the device. Don't fail if there is a
 	// timeout since the inverter could be offline for normal
 	// reasons like lack of sunlight.
 	dev := solis.NewDevice(getBus(), config.Inverter.Addr)
 	if err := dev.Ping(); err == solis.PortTimeoutError {
-		waitForDevice(dev)
+		waitForDevice(bus, dev)
 	} else if err != nil {
 		log.Println("Unhandled device error:", err)
-		os.Exit(exitSerial)
+		daemonExit(bus, exitSerial)
 	}
 
 	for {
+		daemonStatus.lastPoll = time.Now()
+		daemonStatus.polls++
 		if di, err := dev.GetInformation(); err == nil {
-			daemonSendReport(bus, di)
+			daemonSendReport(bus, daemonStatus.lastPoll, di)
+			daemonSetState(bus, hermes.StateOnline)
+			daemonStatus.lastReport = daemonStatus.lastPoll
+			daemonStatus.reports++
 		} else if err == solis.PortTimeoutError {
-			waitForDevice(dev)
+			daemonStatus.timeouts++
+			waitForDevice(bus, dev)
 		} else {
 			log.Println("Failed to get device report: ", err)
+			daemonStatus.errors++
+			daemonSetState(bus, hermes.StateCommError)
 		}
 
-		time.Sleep(config.Daemon.Interval)
+		daemonSendStatus(bus)
+		daemonSleep(bus, dev, config.Daemon.Interval)
 	}
 }
 
@@ -0,0 +1,147 @@
+/*
+ * SPDX-FileCopyrightText: Copyright 2022 Andreas Sandberg <andreas@sandberg.uk>
+ *
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	solis "github.com/andysan/gosolis/pkg/gosolis"
+	"github.com/andysan/gosolis/pkg/hermes"
+)
+
+// Commands the daemon can execute. Refresh is handled by the poll
+// loop.
+var daemonCommands = map[string]func(dev *solis.Device, c *hermes.Command) error{
+	"grid_on": func(dev *solis.Device, c *hermes.Command) error {
+		return dev.GridOn()
+	},
+	"grid_off": func(dev *solis.Device, c *hermes.Command) error {
+		return dev.GridOff()
+	},
+	"power_standard": func(dev *solis.Device, c *hermes.Command) error {
+		v, ok := c.Args["standard"].(float64)
+		if !ok || v < 0 || v > 0xff || v != float64(uint8(v)) ||
+			!solis.PowerStandard(v).Valid() {
+
+			return fmt.Errorf("Illegal power standard")
+		}
+		return dev.SetPowerStandard(solis.PowerStandard(v))
+	},
+	"refresh": func(dev *solis.Device, c *hermes.Command) error {
+		return nil
+	},
+}
+
+type auditEntry struct {
+	Time    time.Time              `json:"time"`
+	Origin  string                 `json:"origin"`
+	ID      string                 `json:"id,omitempty"`
+	Device  string                 `json:"device,omitempty"`
+	Command string                 `json:"command"`
+	Args    map[string]interface{} `json:"args,omitempty"`
+	Result  string                 `json:"result"`
+	Error   string                 `json:"error,omitempty"`
+}
+
+// Record a command in the log and in the audit log if one has been
+// configured.
+func auditCommand(c *hermes.Command, result string, err error) {
+	e := auditEntry{
+		Time:    time.Now(),
+		Origin:  c.Origin,
+		ID:      c.ID,
+		Device:  c.Source,
+		Command: c.Name,
+		Args:    c.Args,
+		Result:  result,
+	}
+	if err != nil {
+		e.Error = err.Error()
+		log.Printf("Command '%s' from %s %s: %s", c.Name, c.Origin, result, err)
+	} else {
+		log.Printf("Command '%s' from %s %s", c.Name, c.Origin, result)
+	}
+
+	if config.Daemon.AuditLog == "" {
+		return
+	}
+
+	line, err := json.Marshal(&e)
+	if err != nil {
+		log.Println("Failed to encode audit entry: ", err)
+		return
+	}
+
+	f, err := os.OpenFile(config.Daemon.AuditLog,
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		log.Println("Failed to open audit log: ", err)
+		return
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		log.Println("Failed to write audit log: ", err)
+	}
+}
+
+func commandAllowed(name string) bool {
+	for _, c := range config.Daemon.Commands {
+		if c == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Verify and execute a command. Returns true if the device should be
+// polled immediately.
+func daemonCommand(dev *solis.Device, c *hermes.Command) bool {
+	reject := func(err error) bool {
+		auditCommand(c, "rejected", err)
+		c.Reply(nil, err)
+		return false
+	}
+
+	if c.Err != nil {
+		return reject(c.Err)
+	}
+
+	fn, ok := daemonCommands[c.Name]
+	if !ok {
+		return reject(fmt.Errorf("Unknown command"))
+	}
+
+	if !commandAllowed(c.Name) {
+		return reject(fmt.Errorf("Command not allowed"))
+	}
+
+	if id := daemonSource(); c.Source != "" && c.Source != id {
+		return reject(fmt.Errorf("Unknown device"))
+	}
+
+	// The sender may have given up while the command was queued
+	if err := c.Start(); err != nil {
+		return reject(err)
+	}
+
+	if err := fn(dev, c); err != nil {
+		auditCommand(c, "failed", err)
+		c.Reply(nil, err)
+		return false
+	}
+
+	auditCommand(c, "executed", nil)
+	c.Reply(nil, nil)
+
+	return c.Name == "refresh"
+}
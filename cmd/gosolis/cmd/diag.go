@@ -0,0 +1,236 @@
+/*
+ * SPDX-FileCopyrightText: Copyright 2022 Andreas Sandberg <andreas@sandberg.uk>
+ *
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	solis "github.com/andysan/gosolis/pkg/gosolis"
+	"github.com/spf13/cobra"
+)
+
+var (
+	diagCount      int
+	diagInterval   time.Duration
+	diagMinSuccess float64
+)
+
+type diagResult struct {
+	name      string
+	attempts  int
+	failures  int
+	latencies []time.Duration
+}
+
+func (r *diagResult) run(f func() error) {
+	start := time.Now()
+	err := f()
+	r.attempts++
+	if err == nil {
+		r.latencies = append(r.latencies, time.Since(start))
+	} else {
+		r.failures++
+	}
+}
+
+func (r *diagResult) successRate() float64 {
+	if r.attempts == 0 {
+		return 0
+	}
+
+	return 100.0 * float64(r.attempts-r.failures) / float64(r.attempts)
+}
+
+func (r *diagResult) print() {
+	fmt.Printf("%s: %d/%d ok (%.1f%%)\n",
+		r.name, r.attempts-r.failures, r.attempts, r.successRate())
+
+	if len(r.latencies) == 0 {
+		return
+	}
+
+	l := append([]time.Duration(nil), r.latencies...)
+	sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+
+	sum := time.Duration(0)
+	for _, d := range l {
+		sum += d
+	}
+	p99 := l[(len(l)*99+99)/100-1]
+
+	fmt.Printf("\tLatency: min %v / avg %v / p99 %v\n",
+		l[0].Round(time.Microsecond),
+		(sum / time.Duration(len(l))).Round(time.Microsecond),
+		p99.Round(time.Microsecond))
+}
+
+// Drain any pending data from the bus. Returns once a read times
+// out or fails.
+func diagDrain(bus solis.BusInterface) {
+	for i := 0; i < 10; i++ {
+		if _, err := bus.ReadFrame(); err != nil {
+			return
+		}
+	}
+}
+
+// Check if the RS485 adaptor echoes transmitted data back to us. A
+// device responds to a ping with a short ack frame, so receiving a
+// full frame that matches the request means that we read our own
+// transmission.
+func diagDetectEcho(bus solis.BusInterface) bool {
+	req := solis.Frame{
+		Device:  config.Inverter.Addr,
+		Command: solis.CmdPing,
+	}
+
+	if err := bus.WriteFrame(&req); err != nil {
+		return false
+	}
+
+	f, err := bus.ReadFrame()
+	echo := err == nil && f.Device == req.Device && f.Command == req.Command
+	if echo {
+		// The real ack is still pending
+		diagDrain(bus)
+	}
+
+	return echo
+}
+
+func diagSuggest(m *solis.BusMetrics, echo bool, results []*diagResult) []string {
+	var hints []string
+
+	attempts, failures := 0, 0
+	for _, r := range results {
+		attempts += r.attempts
+		failures += r.failures
+	}
+
+	if echo {
+		hints = append(hints,
+			"The adaptor echoes transmitted data. Disable local echo or "+
+				"use an adaptor with automatic direction control.")
+	}
+
+	if failures == attempts && m.Timeouts > 0 && m.SkippedBytes == 0 {
+		hints = append(hints,
+			"No response from the inverter. Check the +5V/GND wiring, "+
+				"the inverter address, that RS485 A/B are not swapped, "+
+				"and that the inverter is powered (it is off at night).")
+	}
+
+	if m.SkippedBytes > uint64(attempts) {
+		hints = append(hints,
+			"Many garbage bytes received. This usually means a wrong "+
+				"baud rate or swapped RS485 A/B lines.")
+	}
+
+	if m.ChecksumErrors > 0 {
+		hints = append(hints,
+			"Checksum errors detected. Check bus termination, cable "+
+				"length and shielding.")
+	}
+
+	if m.IllegalFrames > 0 && !echo {
+		hints = append(hints,
+			"Malformed frames received. Check for other bus masters "+
+				"(e.g., a WiFi stick) sharing the bus.")
+	}
+
+	return hints
+}
+
+func diagMain(cmd *cobra.Command, args []string) {
+	bus := getBus()
+	dev := solis.NewDevice(bus, config.Inverter.Addr)
+
+	fmt.Printf("Checking for local echo...\n")
+	echo := diagDetectEcho(bus)
+	solisMetrics.Reset()
+
+	ping := &diagResult{name: "Ping"}
+	info := &diagResult{name: "GetInformation"}
+
+	fmt.Printf("Running %d round trips...\n", diagCount)
+	for i := 0; i < diagCount; i++ {
+		ping.run(dev.Ping)
+		info.run(func() error {
+			_, err := dev.GetInformation()
+			return err
+		})
+
+		if diagInterval > 0 {
+			time.Sleep(diagInterval)
+		}
+	}
+
+	results := []*diagResult{ping, info}
+	m := solisMetrics.Metrics()
+
+	fmt.Printf("\n")
+	for _, r := range results {
+		r.print()
+	}
+
+	received := m.FramesReceived + m.AcksReceived + m.ChecksumErrors +
+		m.IllegalFrames
+	checksumRate := 0.0
+	if received > 0 {
+		checksumRate = 100.0 * float64(m.ChecksumErrors) / float64(received)
+	}
+
+	fmt.Printf("Bus:\n")
+	fmt.Printf("\tChecksum errors: %d (%.1f%%)\n", m.ChecksumErrors, checksumRate)
+	fmt.Printf("\tTimeouts: %d\n", m.Timeouts)
+	fmt.Printf("\tMalformed frames: %d\n", m.IllegalFrames)
+	fmt.Printf("\tGarbage bytes skipped: %d\n", m.SkippedBytes)
+	fmt.Printf("\tLocal echo: %v\n", echo)
+
+	pass := !echo
+	for _, r := range results {
+		if r.successRate() < diagMinSuccess {
+			pass = false
+		}
+	}
+
+	if hints := diagSuggest(&m, echo, results); len(hints) > 0 {
+		fmt.Printf("\nPossible causes:\n")
+		for _, h := range hints {
+			fmt.Printf("\t* %s\n", h)
+		}
+	}
+
+	if pass {
+		fmt.Printf("\nPASS\n")
+	} else {
+		fmt.Printf("\nFAIL\n")
+		os.Exit(exitSerial)
+	}
+}
+
+var diagCmd = &cobra.Command{
+	Use:   "diag",
+	Short: "Bus reliability and cable diagnostics",
+	Args:  cobra.NoArgs,
+	Run:   diagMain,
+}
+
+func init() {
+	RootCmd.AddCommand(diagCmd)
+
+	fs := diagCmd.Flags()
+	fs.IntVarP(&diagCount, "count", "n", 100,
+		"Number of round trips per command")
+	fs.DurationVarP(&diagInterval, "interval", "i", 0,
+		"Delay between round trips")
+	fs.Float64Var(&diagMinSuccess, "min-success", 99.0,
+		"Minimum success rate (%) required to pass")
+}
@@ -0,0 +1,314 @@
+/*
+ * SPDX-FileCopyrightText: Copyright 2022 Andreas Sandberg <andreas@sandberg.uk>
+ *
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package cmd
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/andysan/gosolis/pkg/hermes"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	historyPath        string
+	historyDevice      string
+	historyFrom        string
+	historyTo          string
+	historyResolution  string
+	historyFields      []string
+	historyStat        string
+	historyCSV         bool
+	historyTotals      string
+	historyEnergyField string
+	historyOutput      string
+)
+
+// Find the directory used by the first history backend in the
+// configuration
+func historyConfigPath() string {
+	names := []string{}
+	for name := range viper.GetStringMap("hermes") {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		sub := viper.Sub("hermes." + name)
+		if sub == nil || sub.GetString("type") != "history" {
+			continue
+		}
+
+		path := sub.GetString("path")
+		if path != "" && !filepath.IsAbs(path) {
+			path = filepath.Join(cfgBase, path)
+		}
+		return path
+	}
+
+	return ""
+}
+
+// Parse a point in time. Supports dates, dates with a time, RFC3339
+// timestamps, and durations relative to the current time (e.g.,
+// "24h" for a day ago).
+func historyParseTime(s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+
+	for _, layout := range []string{"2006-01-02", "2006-01-02 15:04", "2006-01-02T15:04"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Parse(time.RFC3339, s)
+}
+
+func historyValue(v hermes.HistoryValue) (float64, error) {
+	switch historyStat {
+	case "mean":
+		return v.Mean, nil
+	case "min":
+		return v.Min, nil
+	case "max":
+		return v.Max, nil
+	case "last":
+		return v.Last, nil
+	default:
+		return 0, fmt.Errorf("Illegal statistic '%s'", historyStat)
+	}
+}
+
+func historyFormat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// Write rows as CSV or as a table
+func historyWrite(w io.Writer, header []string, rows [][]string) error {
+	if historyCSV {
+		cw := csv.NewWriter(w)
+		cw.Write(header)
+		cw.WriteAll(rows)
+		return cw.Error()
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, strings.Join(header, "\t")+"\t")
+	for _, r := range rows {
+		fmt.Fprintln(tw, strings.Join(r, "\t")+"\t")
+	}
+
+	return tw.Flush()
+}
+
+func historyRecords(store *hermes.HistoryStore, resolution string, from, to time.Time) ([][]string, error) {
+	var records []hermes.HistoryRecord
+	var err error
+	if resolution == hermes.HistoryDaily {
+		records, err = store.Daily(historyDevice, from, to)
+	} else {
+		records, err = store.Query(historyDevice, resolution, from, to)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	layout := "2006-01-02 15:04:05"
+	if resolution == hermes.HistoryDaily {
+		layout = "2006-01-02"
+	}
+
+	rows := [][]string{}
+	for _, r := range records {
+		row := []string{r.When.Local().Format(layout)}
+		for _, f := range historyFields {
+			v, ok := r.Values[f]
+			if !ok {
+				row = append(row, "")
+				continue
+			}
+
+			x, err := historyValue(v)
+			if err != nil {
+				return nil, err
+			}
+			row = append(row, historyFormat(x))
+		}
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+// Compute production totals per day or month. The energy field is
+// expected to be a counter that resets every day, so the daily total
+// is its maximum.
+func historyProduction(store *hermes.HistoryStore, from, to time.Time) ([][]string, error) {
+	days, err := store.Daily(historyDevice, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	layout := "2006-01-02"
+	if historyTotals == "month" {
+		layout = "2006-01"
+	} else if historyTotals != "day" {
+		return nil, fmt.Errorf("Illegal totals period '%s'", historyTotals)
+	}
+
+	periods := []string{}
+	totals := map[string]float64{}
+	for _, d := range days {
+		v, ok := d.Values[historyEnergyField]
+		if !ok {
+			continue
+		}
+
+		p := d.When.Local().Format(layout)
+		if _, ok := totals[p]; !ok {
+			periods = append(periods, p)
+		}
+		totals[p] += v.Max
+	}
+
+	rows := [][]string{}
+	sum := 0.0
+	for _, p := range periods {
+		rows = append(rows, []string{p, historyFormat(totals[p])})
+		sum += totals[p]
+	}
+	if !historyCSV && len(periods) > 1 {
+		rows = append(rows, []string{"Total", historyFormat(sum)})
+	}
+
+	return rows, nil
+}
+
+func historyMain(cmd *cobra.Command, args []string) {
+	if historyPath == "" {
+		historyPath = historyConfigPath()
+	}
+	if historyPath == "" {
+		fmt.Println("No history store specified")
+		os.Exit(exitUsage)
+	}
+
+	store := hermes.OpenHistoryStore(historyPath)
+	if historyDevice == "" {
+		devices, err := store.Devices()
+		if err != nil {
+			fmt.Println("Failed to open history:", err)
+			os.Exit(exitConfig)
+		}
+		if len(devices) != 1 {
+			fmt.Printf("Select a device using --device: %s\n",
+				strings.Join(devices, ", "))
+			os.Exit(exitUsage)
+		}
+		historyDevice = devices[0]
+	}
+
+	now := time.Now()
+	from, err := historyParseTime(historyFrom, now)
+	if err != nil {
+		fmt.Printf("Illegal start time '%s'\n", historyFrom)
+		os.Exit(exitUsage)
+	}
+	to := now
+	if historyTo != "" {
+		if to, err = historyParseTime(historyTo, now); err != nil {
+			fmt.Printf("Illegal end time '%s'\n", historyTo)
+			os.Exit(exitUsage)
+		}
+	}
+
+	var header []string
+	var rows [][]string
+	if historyTotals != "" {
+		header = []string{historyTotals, historyEnergyField}
+		rows, err = historyProduction(store, from, to)
+	} else {
+		resolution := historyResolution
+		if resolution == "auto" {
+			resolution = hermes.AutoHistoryResolution(from, to, now)
+		}
+		header = append([]string{"time"}, historyFields...)
+		rows, err = historyRecords(store, resolution, from, to)
+	}
+	if err != nil {
+		fmt.Println("Failed to read history:", err)
+		os.Exit(exitUsage)
+	}
+
+	var out io.Writer = os.Stdout
+	if historyOutput != "" {
+		f, err := os.Create(historyOutput)
+		if err != nil {
+			fmt.Println("Failed to create output file:", err)
+			os.Exit(exitConfig)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	if err := historyWrite(out, header, rows); err != nil {
+		fmt.Println("Failed to write history:", err)
+		os.Exit(exitConfig)
+	}
+}
+
+var historyCmd = &cobra.Command{
+	Use:   "history",
+	Short: "Query the history recorded by the daemon",
+	Long: `Query the history recorded by a history backend in the daemon.
+
+Times are specified as dates (2006-01-02), dates with a time
+(2006-01-02 15:04), RFC3339 timestamps, or durations before the
+current time (e.g., 24h).`,
+	Args: cobra.NoArgs,
+	Run:  historyMain,
+}
+
+func init() {
+	RootCmd.AddCommand(historyCmd)
+
+	fs := historyCmd.Flags()
+	fs.StringVar(&historyPath, "path", "",
+		"History directory (default is the path of the first history backend)")
+	fs.StringVarP(&historyDevice, "device", "d", "",
+		"Device to query (default is the only device in the history)")
+	fs.StringVarP(&historyFrom, "from", "f", "24h",
+		"Start of the time range")
+	fs.StringVarP(&historyTo, "to", "T", "",
+		"End of the time range (default is now)")
+	fs.StringVarP(&historyResolution, "resolution", "r", "auto",
+		"Resolution (auto, raw, 5m or daily)")
+	fs.StringSliceVarP(&historyFields, "fields", "F",
+		[]string{"power.ac", "energy.today_wh", "production.today", "grid.voltage", "temperature"},
+		"Fields to show")
+	fs.StringVarP(&historyStat, "stat", "s", "mean",
+		"Statistic shown for summaries (mean, min, max or last)")
+	fs.BoolVar(&historyCSV, "csv", false,
+		"Write CSV instead of a table")
+	fs.StringVar(&historyTotals, "totals", "",
+		"Show production totals per day or month")
+	fs.StringVar(&historyEnergyField, "energy-field", "production.today",
+		"Daily production counter used to compute totals")
+	fs.StringVarP(&historyOutput, "output", "o", "",
+		"Write the result to a file")
+}
@@ -8,7 +8,9 @@ package cmd
 
 import (
 	"fmt"
+	"log"
 	"os"
+	"strconv"
 	"time"
 
 	"path/filepath"
@@ -19,6 +21,10 @@ import (
 	"github.com/tarm/serial"
 )
 
+// Program version, set at link time using
+// -ldflags "-X github.com/andysan/gosolis/cmd/gosolis/cmd.Version=..."
+var Version = "devel"
+
 const (
 	exitUsage  = 1
 	exitConfig = 2
@@ -31,16 +37,42 @@ type InverterConfig struct {
 	Addr    solis.DeviceId
 	Baud    uint
 	Timeout time.Duration
+
+	// Log all bus traffic
+	Trace bool
+	// Write the bus trace to a file instead of stderr
+	TraceFile string `mapstructure:"trace_file"`
+	// Minimum gap between requests sent to the inverter
+	MinGap time.Duration `mapstructure:"min_gap"`
 }
 
 type DaemonConfig struct {
 	Interval      time.Duration
 	ProbeInterval time.Duration `mapstructure:"probe_interval"`
+	// Device identity used in messages and topics ("address" or
+	// "serial")
+	Identity string
+	// File used to persist the energy integrator state
+	EnergyState string `mapstructure:"energy_state"`
+	// Minimum time between energy state updates on disk
+	EnergySaveInterval time.Duration `mapstructure:"energy_save_interval"`
+	// Payload type ("full" or "legacy")
+	Payload string
+	// Fields to publish, maps message keys to report paths
+	Fields map[string]string
+	// Interval between daemon status reports, 0 disables them
+	StatusInterval time.Duration `mapstructure:"status_interval"`
+	// Commands that may be executed when received from a backend
+	Commands []string
+	// File recording all commands received from backends
+	AuditLog string `mapstructure:"audit_log"`
 }
 
 type Config struct {
 	Inverter InverterConfig
 	Daemon   DaemonConfig
+	// Additional inverter models indexed by product code
+	Models map[string]solis.Model
 }
 
 var (
@@ -50,8 +82,9 @@ var (
 )
 
 var (
-	solisBus    solis.BusInterface
-	solisDevice *solis.Device
+	solisBus     solis.BusInterface
+	solisMetrics *solis.MetricsBus
+	solisDevice  *solis.Device
 )
 
 func errPanic(err error) {
@@ -99,20 +132,52 @@ func createBusDemo() solis.BusInterface {
 	return bus
 }
 
+func createTraceLogger() *log.Logger {
+	if config.Inverter.TraceFile == "" {
+		return log.New(os.Stderr, "trace: ", log.LstdFlags|log.Lmicroseconds)
+	}
+
+	f, err := os.OpenFile(config.Inverter.TraceFile,
+		os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		fmt.Println("Failed to open trace file:", err)
+		os.Exit(exitConfig)
+	}
+
+	return log.New(f, "", log.LstdFlags|log.Lmicroseconds)
+}
+
 func getBus() solis.BusInterface {
 	if solisBus != nil {
 		return solisBus
 	}
 
+	var bus solis.BusInterface
 	switch config.Inverter.Type {
 	case "serial":
-		solisBus = createBusSerial()
+		bus = createBusSerial()
 	case "demo":
-		solisBus = createBusDemo()
+		bus = createBusDemo()
 	default:
 		fmt.Printf("Incorrect bus type: %s\n", config.Inverter.Type)
+		os.Exit(exitConfig)
+	}
+
+	// Wrap the raw bus in middleware. The rate limiter goes
+	// closest to the wire to make sure that traced and measured
+	// timings include any delays it introduces.
+	if config.Inverter.MinGap > 0 {
+		bus = solis.NewRateLimitBus(bus, config.Inverter.MinGap)
 	}
 
+	solisMetrics = solis.NewMetricsBus(bus)
+	bus = solisMetrics
+
+	if config.Inverter.Trace {
+		bus = solis.NewTraceBus(bus, createTraceLogger())
+	}
+
+	solisBus = bus
 	return solisBus
 }
 
@@ -134,8 +199,21 @@ func getInverter() *solis.Device {
 	return solisDevice
 }
 
+func registerModels() {
+	for code, m := range config.Models {
+		p, err := strconv.ParseUint(code, 0, 8)
+		if err != nil {
+			fmt.Printf("Illegal product code '%s' in model table\n", code)
+			os.Exit(exitConfig)
+		}
+
+		solis.RegisterModel(solis.DeviceProduct(p), m)
+	}
+}
+
 func rootPersistentPreRun(cmd *cobra.Command, args []string) {
 	viper.Unmarshal(&config)
+	registerModels()
 }
 
 var RootCmd = &cobra.Command{
@@ -171,11 +249,15 @@ func init() {
 	RootCmd.PersistentFlags().IntP(
 		"timeout", "t", 100,
 		"Timeout in milliseconds")
+	RootCmd.PersistentFlags().Bool(
+		"trace", false,
+		"Log all frames sent and received on the bus")
 
 	errPanic(viper.BindPFlag("inverter.type", pfs.Lookup("bus-type")))
 	errPanic(viper.BindPFlag("inverter.port", pfs.Lookup("port")))
 	errPanic(viper.BindPFlag("inverter.addr", pfs.Lookup("addr")))
 	errPanic(viper.BindPFlag("inverter.timeout", pfs.Lookup("timeout")))
+	errPanic(viper.BindPFlag("inverter.trace", pfs.Lookup("trace")))
 }
 
 func initConfig() {
@@ -191,9 +273,17 @@ func initConfig() {
 	viper.SetDefault("inverter.addr", 1)
 	viper.SetDefault("inverter.baud", 9600)
 	viper.SetDefault("inverter.timeout", 500*time.Millisecond)
+	viper.SetDefault("inverter.trace", false)
+	viper.SetDefault("inverter.trace_file", "")
+	viper.SetDefault("inverter.min_gap", 0)
 
 	viper.SetDefault("daemon.interval", 10*time.Second)
 	viper.SetDefault("daemon.probe_interval", 1*time.Minute)
+	viper.SetDefault("daemon.identity", "address")
+	viper.SetDefault("daemon.energy_state", "")
+	viper.SetDefault("daemon.energy_save_interval", 5*time.Minute)
+	viper.SetDefault("daemon.payload", "full")
+	viper.SetDefault("daemon.status_interval", 1*time.Minute)
 
 	viper.SetEnvPrefix("gosolis")
 	viper.AutomaticEnv()
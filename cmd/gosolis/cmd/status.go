@@ -9,6 +9,7 @@ package cmd
 import (
 	"fmt"
 
+	solis "github.com/andysan/gosolis/pkg/gosolis"
 	"github.com/spf13/cobra"
 )
 
@@ -19,13 +20,20 @@ func statusMain(cmd *cobra.Command, args []string) {
 	errComm(err)
 
 	for idx, inp := range di.Inputs {
-		fmt.Printf("Input %d: %.1f V / %.1f A\n",
-			idx, inp.Voltage, inp.Current)
+		fmt.Printf("Input %d: %.1f V / %.1f A / %.1f W\n",
+			idx, inp.Voltage, inp.Current, inp.Power())
 	}
 
 	fmt.Printf("Grid: %.1f V / %.1f A @ %.2f Hz\n",
 		di.Grid.Voltage, di.Grid.Current, di.Grid.Frequency)
 
+	fmt.Printf("Power:\n")
+	fmt.Printf("\tDC: %.1f W\n", di.DCPower())
+	fmt.Printf("\tAC: %.1f W\n", di.ACPower())
+	fmt.Printf("\tEfficiency: %.1f %%\n", di.Efficiency()*100)
+	fmt.Printf("\tPower factor (estimated): %.2f\n",
+		di.EstimatePowerFactor(solis.NominalEfficiency))
+
 	p := &di.Production
 	fmt.Printf("Production:\n")
 	fmt.Printf("\tTotal: %.0f\n", p.Total)
@@ -35,9 +43,12 @@ func statusMain(cmd *cobra.Command, args []string) {
 	fmt.Printf("\tLast month: %.0f\n", p.LastMonth)
 
 	fmt.Printf("Inverter:\n")
-	fmt.Printf("\tProduct type: %#x\n", di.Product)
-	fmt.Printf("\tSoftware version: %#x\n", di.SWVersion)
-	fmt.Printf("\tSerial: %#x\n", di.SerialNo)
+	if m, ok := di.Model(); ok {
+		fmt.Printf("\tModel: %v\n", m)
+	}
+	fmt.Printf("\tProduct type: %v\n", di.Product)
+	fmt.Printf("\tSoftware version: %v\n", di.SWVersion)
+	fmt.Printf("\tSerial: %v\n", di.SerialNo)
 	fmt.Printf("\tTemperature: %.1f °C\n", di.Temperature)
 	fmt.Printf("\tStatus: %v\n", di.Status)
 	fmt.Printf("\tError code: %#.4x\n", di.Error)
@@ -0,0 +1,242 @@
+/*
+ * SPDX-FileCopyrightText: Copyright 2022 Andreas Sandberg <andreas@sandberg.uk>
+ *
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package gosolis
+
+import (
+	"sync"
+	"time"
+)
+
+// Upper bounds of the latency histogram buckets. Responses slower
+// than the last bucket are counted in an implicit +Inf bucket.
+var LatencyBuckets = []time.Duration{
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+	2500 * time.Millisecond,
+}
+
+// Histogram of request to response latencies.
+type LatencyHistogram struct {
+	// Number of samples in each bucket of LatencyBuckets. The
+	// last element counts samples exceeding the largest bucket.
+	Counts []uint64
+	Count  uint64
+	Sum    time.Duration
+	Min    time.Duration
+	Max    time.Duration
+}
+
+// Snapshot of the counters maintained by a MetricsBus.
+type BusMetrics struct {
+	FramesSent     uint64
+	FramesReceived uint64
+	AcksSent       uint64
+	AcksReceived   uint64
+
+	ChecksumErrors uint64
+	IllegalFrames  uint64
+	Timeouts       uint64
+	OtherErrors    uint64
+
+	Latency LatencyHistogram
+
+	// Garbage bytes skipped by the underlying serial bus while
+	// waiting for a start byte
+	SkippedBytes uint64
+
+	// Time of the last successfully received frame
+	LastReceived time.Time
+}
+
+// MetricsBus maintains frame and error counters as well as a latency
+// histogram for the bus interface it wraps.
+type MetricsBus struct {
+	bus BusInterface
+
+	lock        sync.Mutex
+	metrics     BusMetrics
+	pending     time.Time
+	skippedBase uint64
+}
+
+// Ensure that we satisfy the BusInterface interface
+var _ BusInterface = &MetricsBus{}
+
+// Wrap a bus interface in a metrics collector.
+func NewMetricsBus(bus BusInterface) *MetricsBus {
+	return &MetricsBus{
+		bus: bus,
+		metrics: BusMetrics{
+			Latency: LatencyHistogram{
+				Counts: make([]uint64, len(LatencyBuckets)+1),
+			},
+		},
+	}
+}
+
+// Get the bus interface wrapped by the metrics collector.
+func (b *MetricsBus) Unwrap() BusInterface {
+	return b.bus
+}
+
+// Get a consistent snapshot of the current counters.
+func (b *MetricsBus) Metrics() BusMetrics {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	m := b.metrics
+	m.Latency.Counts = append([]uint64(nil), b.metrics.Latency.Counts...)
+	if s := findSerialBus(b.bus); s != nil {
+		m.SkippedBytes = s.SkippedBytes() - b.skippedBase
+	}
+	return m
+}
+
+// Reset all counters.
+func (b *MetricsBus) Reset() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.metrics = BusMetrics{
+		Latency: LatencyHistogram{
+			Counts: make([]uint64, len(LatencyBuckets)+1),
+		},
+	}
+	b.pending = time.Time{}
+	if s := findSerialBus(b.bus); s != nil {
+		b.skippedBase = s.SkippedBytes()
+	}
+}
+
+func (h *LatencyHistogram) add(d time.Duration) {
+	idx := len(LatencyBuckets)
+	for i, limit := range LatencyBuckets {
+		if d <= limit {
+			idx = i
+			break
+		}
+	}
+
+	h.Counts[idx]++
+	if h.Count == 0 || d < h.Min {
+		h.Min = d
+	}
+	if d > h.Max {
+		h.Max = d
+	}
+	h.Count++
+	h.Sum += d
+}
+
+// Mean latency of all samples in the histogram.
+func (h *LatencyHistogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+
+	return h.Sum / time.Duration(h.Count)
+}
+
+// Estimate the q quantile (0 <= q <= 1) of the latency
+// distribution. The estimate is the upper bound of the bucket
+// containing the quantile, but never more than the largest sample.
+func (h *LatencyHistogram) Quantile(q float64) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+
+	rank := uint64(q * float64(h.Count))
+	if rank >= h.Count {
+		rank = h.Count - 1
+	}
+
+	seen := uint64(0)
+	for i, c := range h.Counts {
+		seen += c
+		if seen > rank && i < len(LatencyBuckets) {
+			if LatencyBuckets[i] < h.Max {
+				return LatencyBuckets[i]
+			}
+			break
+		}
+	}
+
+	return h.Max
+}
+
+func (b *MetricsBus) countError(err error) {
+	switch err {
+	case ChecksumError:
+		b.metrics.ChecksumErrors++
+	case IllegalFrameError:
+		b.metrics.IllegalFrames++
+	case PortTimeoutError:
+		b.metrics.Timeouts++
+	default:
+		b.metrics.OtherErrors++
+	}
+}
+
+func (b *MetricsBus) received(f *Frame, err error, frames *uint64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if err != nil {
+		b.countError(err)
+		return
+	}
+
+	now := time.Now()
+	*frames++
+	b.metrics.LastReceived = now
+	if !b.pending.IsZero() {
+		b.metrics.Latency.add(now.Sub(b.pending))
+		b.pending = time.Time{}
+	}
+}
+
+func (b *MetricsBus) sent(err error, frames *uint64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if err != nil {
+		b.countError(err)
+		return
+	}
+
+	*frames++
+	b.pending = time.Now()
+}
+
+func (b *MetricsBus) ReadFrame() (*Frame, error) {
+	f, err := b.bus.ReadFrame()
+	b.received(f, err, &b.metrics.FramesReceived)
+	return f, err
+}
+
+func (b *MetricsBus) ReadAckFrame() (*Frame, error) {
+	f, err := b.bus.ReadAckFrame()
+	b.received(f, err, &b.metrics.AcksReceived)
+	return f, err
+}
+
+func (b *MetricsBus) WriteFrame(frame *Frame) error {
+	err := b.bus.WriteFrame(frame)
+	b.sent(err, &b.metrics.FramesSent)
+	return err
+}
+
+func (b *MetricsBus) WriteAck(dev DeviceId, cmd Command) error {
+	err := b.bus.WriteAck(dev, cmd)
+	b.sent(err, &b.metrics.AcksSent)
+	return err
+}
@@ -0,0 +1,110 @@
+/*
+ * SPDX-FileCopyrightText: Copyright 2022 Andreas Sandberg <andreas@sandberg.uk>
+ *
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package gosolis
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func newEmulatedMetricsBus() *MetricsBus {
+	bus := NewLocalBus(1)
+
+	de := NewDeviceEmulator(bus.Interfaces[0], DeviceId(1))
+	go de.Run()
+
+	return NewMetricsBus(bus)
+}
+
+func TestMetricsBusCounters(t *testing.T) {
+	mb := newEmulatedMetricsBus()
+	dev := NewDevice(mb, DeviceId(1))
+
+	if err := dev.Ping(); err != nil {
+		t.Fatal("Ping failed: ", err)
+	}
+
+	if _, err := dev.GetInformation(); err != nil {
+		t.Fatal("GetInformation failed: ", err)
+	}
+
+	m := mb.Metrics()
+	if m.FramesSent != 2 || m.AcksReceived != 1 || m.FramesReceived != 1 {
+		t.Errorf("Unexpected frame counters: %+v", m)
+	}
+
+	if m.Latency.Count != 2 {
+		t.Errorf("Latency count %d; want 2", m.Latency.Count)
+	}
+
+	if m.LastReceived.IsZero() {
+		t.Error("LastReceived not updated")
+	}
+
+	mb.Reset()
+	if m := mb.Metrics(); m.FramesSent != 0 || m.Latency.Count != 0 {
+		t.Errorf("Counters not reset: %+v", m)
+	}
+}
+
+func TestMetricsBusErrors(t *testing.T) {
+	buf := bytes.Buffer{}
+	mb := NewMetricsBus(NewSerialBus(&buf))
+
+	// Ack frame with a non-zero length
+	buf.Write([]byte{0x7e, 0x01, 0x02, 0xff})
+	mb.ReadAckFrame()
+
+	// Frame with a broken checksum
+	frame := make([]byte, 55)
+	copy(frame, []byte{0x7e, 0x01, 0x03, 0x00})
+	buf.Write(frame)
+	mb.ReadFrame()
+
+	m := mb.Metrics()
+	if m.IllegalFrames != 1 || m.ChecksumErrors != 1 {
+		t.Errorf("Unexpected error counters: %+v", m)
+	}
+}
+
+func TestLatencyHistogram(t *testing.T) {
+	h := LatencyHistogram{Counts: make([]uint64, len(LatencyBuckets)+1)}
+	for i := 0; i < 99; i++ {
+		h.add(5 * time.Millisecond)
+	}
+	h.add(300 * time.Millisecond)
+
+	if h.Min != 5*time.Millisecond || h.Max != 300*time.Millisecond {
+		t.Errorf("Min/max %v/%v; want 5ms/300ms", h.Min, h.Max)
+	}
+
+	if q := h.Quantile(0.5); q != 10*time.Millisecond {
+		t.Errorf("Median %v; want 10ms", q)
+	}
+
+	if q := h.Quantile(1.0); q != 300*time.Millisecond {
+		t.Errorf("Max quantile %v; want 300ms", q)
+	}
+}
+
+func TestRateLimitBus(t *testing.T) {
+	buf := bytes.Buffer{}
+	gap := 20 * time.Millisecond
+	rb := NewRateLimitBus(NewSerialBus(&buf), gap)
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := rb.WriteFrame(&Frame{0x01, CmdPing, 0, nil}); err != nil {
+			t.Fatal("WriteFrame failed: ", err)
+		}
+	}
+
+	if d := time.Since(start); d < 2*gap {
+		t.Errorf("Three requests took %v; want at least %v", d, 2*gap)
+	}
+}
@@ -0,0 +1,64 @@
+/*
+ * SPDX-FileCopyrightText: Copyright 2022 Andreas Sandberg <andreas@sandberg.uk>
+ *
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package gosolis
+
+import (
+	"time"
+)
+
+// RateLimitBus enforces a minimum gap between consecutive requests
+// written to the bus. This gives slow inverters and RS485 adaptors
+// time to turn the bus around between commands.
+type RateLimitBus struct {
+	bus    BusInterface
+	gap    time.Duration
+	lastTx time.Time
+}
+
+// Ensure that we satisfy the BusInterface interface
+var _ BusInterface = &RateLimitBus{}
+
+// Wrap a bus interface and ensure that requests are at least gap
+// apart.
+func NewRateLimitBus(bus BusInterface, gap time.Duration) *RateLimitBus {
+	return &RateLimitBus{
+		bus: bus,
+		gap: gap,
+	}
+}
+
+// Get the bus interface wrapped by the rate limiter.
+func (b *RateLimitBus) Unwrap() BusInterface {
+	return b.bus
+}
+
+func (b *RateLimitBus) wait() {
+	if !b.lastTx.IsZero() {
+		if d := b.gap - time.Since(b.lastTx); d > 0 {
+			time.Sleep(d)
+		}
+	}
+
+	b.lastTx = time.Now()
+}
+
+func (b *RateLimitBus) ReadFrame() (*Frame, error) {
+	return b.bus.ReadFrame()
+}
+
+func (b *RateLimitBus) ReadAckFrame() (*Frame, error) {
+	return b.bus.ReadAckFrame()
+}
+
+func (b *RateLimitBus) WriteFrame(frame *Frame) error {
+	b.wait()
+	return b.bus.WriteFrame(frame)
+}
+
+func (b *RateLimitBus) WriteAck(dev DeviceId, cmd Command) error {
+	return b.bus.WriteAck(dev, cmd)
+}
@@ -8,6 +8,7 @@ package gosolis
 
 import (
 	"io"
+	"sync/atomic"
 )
 
 const startByte = byte(0x7e)
@@ -22,6 +23,11 @@ const frameLength = 54
 const ackFrameLength = 3
 
 type SerialBus struct {
+	// Number of bytes discarded while waiting for a start
+	// byte. Keep this first to guarantee 64-bit alignment for
+	// atomic accesses on 32-bit platforms.
+	skipped uint64
+
 	port io.ReadWriter
 }
 
@@ -47,13 +53,22 @@ func (b *SerialBus) waitForStart() error {
 		if buf[0] == startByte {
 			return nil
 		}
+
+		atomic.AddUint64(&b.skipped, 1)
 	}
 }
 
 // Instantiate a new bus interface using a ReadWriter interface connected to a
 // RS485 port.
 func NewSerialBus(port io.ReadWriter) *SerialBus {
-	return &SerialBus{port}
+	return &SerialBus{port: port}
+}
+
+// Get the number of garbage bytes that have been skipped while
+// looking for the start of a frame. A large number of skipped bytes
+// usually indicates a wiring or baud rate problem.
+func (b *SerialBus) SkippedBytes() uint64 {
+	return atomic.LoadUint64(&b.skipped)
 }
 
 // Read a data fram from the inverter and return a frame. This
@@ -47,6 +47,15 @@ func TestWaitForStart(t *testing.T) {
 	}
 }
 
+func TestSkippedBytes(t *testing.T) {
+	s := NewSerialBus(bytes.NewBuffer([]byte{0, 1, 2, 0x7e, 3, 0x7e}))
+	s.waitForStart()
+	s.waitForStart()
+	if n := s.SkippedBytes(); n != 4 {
+		t.Errorf("SkippedBytes() = %d; want 4", n)
+	}
+}
+
 func readFrameBytes(value []byte) (*Frame, error) {
 	buf := bytes.NewBuffer(value)
 	s := NewSerialBus(buf)
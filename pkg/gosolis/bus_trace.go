@@ -0,0 +1,100 @@
+/*
+ * SPDX-FileCopyrightText: Copyright 2022 Andreas Sandberg <andreas@sandberg.uk>
+ *
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package gosolis
+
+import (
+	"encoding/hex"
+	"log"
+	"strings"
+	"time"
+)
+
+// TraceBus logs every frame passing through a bus interface. Each
+// log entry contains the direction of the frame, the time since the
+// last frame was sent, and a hexdump of the frame contents.
+type TraceBus struct {
+	bus    BusInterface
+	log    *log.Logger
+	lastTx time.Time
+}
+
+// Ensure that we satisfy the BusInterface interface
+var _ BusInterface = &TraceBus{}
+
+// Wrap a bus interface in a tracer that logs all traffic to logger.
+func NewTraceBus(bus BusInterface, logger *log.Logger) *TraceBus {
+	return &TraceBus{
+		bus: bus,
+		log: logger,
+	}
+}
+
+// Get the bus interface wrapped by the tracer.
+func (b *TraceBus) Unwrap() BusInterface {
+	return b.bus
+}
+
+// Serialize the interesting parts of a frame (header and payload)
+// for tracing purposes.
+func traceBytes(f *Frame) []byte {
+	data := f.Data
+	if int(f.Length) < len(data) {
+		data = data[:f.Length]
+	}
+
+	return append([]byte{byte(f.Device), byte(f.Command), f.Length}, data...)
+}
+
+func (b *TraceBus) trace(dir string, f *Frame, err error) {
+	var sb strings.Builder
+
+	sb.WriteString(dir)
+	if !b.lastTx.IsZero() {
+		sb.WriteString(" +")
+		sb.WriteString(time.Since(b.lastTx).String())
+	}
+
+	if err != nil {
+		sb.WriteString(" error: ")
+		sb.WriteString(err.Error())
+	}
+
+	if f != nil {
+		sb.WriteString("\n")
+		sb.WriteString(strings.TrimRight(hex.Dump(traceBytes(f)), "\n"))
+	}
+
+	b.log.Print(sb.String())
+}
+
+func (b *TraceBus) ReadFrame() (*Frame, error) {
+	f, err := b.bus.ReadFrame()
+	b.trace("RX", f, err)
+	return f, err
+}
+
+func (b *TraceBus) ReadAckFrame() (*Frame, error) {
+	f, err := b.bus.ReadAckFrame()
+	b.trace("RX ACK", f, err)
+	return f, err
+}
+
+// Transmitted frames are timestamped relative to the previous
+// transmission, received frames relative to the request.
+func (b *TraceBus) WriteFrame(frame *Frame) error {
+	err := b.bus.WriteFrame(frame)
+	b.trace("TX", frame, err)
+	b.lastTx = time.Now()
+	return err
+}
+
+func (b *TraceBus) WriteAck(dev DeviceId, cmd Command) error {
+	err := b.bus.WriteAck(dev, cmd)
+	b.trace("TX ACK", &Frame{Device: dev, Command: cmd}, err)
+	b.lastTx = time.Now()
+	return err
+}
@@ -46,6 +46,11 @@ const (
 	PowerStandardEN50438L  = PowerStandard(0x10)
 )
 
+// Check if a power standard is one of the defined standards
+func (ps PowerStandard) Valid() bool {
+	return ps <= PowerStandardEN50438L
+}
+
 type GridStatus uint8
 
 const ()
@@ -135,6 +140,77 @@ type DeviceInformation struct {
 	PowerCurve PowerCurve
 }
 
+// Round a power value to the 0.1 W precision used for derived
+// quantities.
+func roundPower(p float64) float64 {
+	return math.Round(p*10) / 10
+}
+
+// DC power of the input (W). The result is rounded to 0.1 W, but
+// the accuracy is limited by the 0.1 V and 0.1 A resolution of the
+// measurements.
+func (is *InputStatus) Power() float64 {
+	return roundPower(is.Voltage * is.Current)
+}
+
+// Total DC power of all inputs (W), rounded to 0.1 W.
+func (di *DeviceInformation) DCPower() float64 {
+	p := 0.0
+	for _, inp := range di.Inputs {
+		p += inp.Voltage * inp.Current
+	}
+
+	return roundPower(p)
+}
+
+// Apparent AC power (VA) delivered to the grid, rounded to 0.1 VA.
+func (di *DeviceInformation) ApparentPower() float64 {
+	return roundPower(di.Grid.Voltage * di.Grid.Current)
+}
+
+// AC power (W) delivered to the grid, rounded to 0.1 W. The inverter
+// doesn't report real power, so this is the apparent power. Grid-tied
+// inverters normally run at unity power factor, which makes the two
+// equal.
+func (di *DeviceInformation) ACPower() float64 {
+	return di.ApparentPower()
+}
+
+// Conversion efficiency as a fraction of the DC input power. Returns
+// 0 if there is no DC input power. Measurement resolution makes this
+// unreliable at low power and it may exceed 1.
+func (di *DeviceInformation) Efficiency() float64 {
+	dc := di.DCPower()
+	if dc <= 0 {
+		return 0
+	}
+
+	return di.ACPower() / dc
+}
+
+// Typical conversion efficiency of a grid-tied string inverter, used
+// when estimating the power factor
+const NominalEfficiency = 0.97
+
+// Estimate the power factor assuming that the inverter converts DC
+// to AC power with the given nominal efficiency (e.g., 0.97). The
+// result is clamped to [0, 1] and is 0 if no AC power is delivered.
+func (di *DeviceInformation) EstimatePowerFactor(efficiency float64) float64 {
+	s := di.ApparentPower()
+	if s <= 0 {
+		return 0
+	}
+
+	pf := di.DCPower() * efficiency / s
+	if pf > 1 {
+		return 1
+	} else if pf < 0 {
+		return 0
+	}
+
+	return pf
+}
+
 // Instantiate a Solis device interface
 func NewDevice(bus BusInterface, dev DeviceId) *Device {
 	return &Device{bus, dev}
@@ -198,6 +274,10 @@ func (d *Device) GridOff() error {
 	return d.sendAckedCommand(CmdGridOff, nil)
 }
 
+func (d *Device) SetPowerStandard(ps PowerStandard) error {
+	return d.sendAckedCommand(CmdSetPowerStandard, []byte{uint8(ps)})
+}
+
 func (d *Device) GetInformation() (*DeviceInformation, error) {
 	f, e := d.sendCommand(CmdGetInformation, nil)
 	if e != nil {
@@ -297,5 +377,11 @@ func (rpi *rawDeviceInfo) DeviceInformation() *DeviceInformation {
 		PowerCurve:  PowerCurve(rpi.PowerCurve),
 	}
 
+	// The device always reports two inputs. Drop inputs that
+	// don't exist if this is a known model.
+	if m, ok := pi.Model(); ok && m.Inputs > 0 && m.Inputs < len(pi.Inputs) {
+		pi.Inputs = pi.Inputs[:m.Inputs]
+	}
+
 	return &pi
 }
@@ -8,6 +8,7 @@ package gosolis
 
 import (
 	"bytes"
+	"math"
 	"reflect"
 	"testing"
 )
@@ -133,3 +134,36 @@ func TestEncodeDeviceInformation(t *testing.T) {
 		t.Logf("%#v\n", rdi)
 	}
 }
+
+func testPower(t *testing.T, name string, value float64, expected float64) {
+	if math.Abs(value-expected) > 1e-9 {
+		t.Errorf("%s = %v; want %v", name, value, expected)
+	}
+}
+
+func TestDerivedQuantities(t *testing.T) {
+	di := testDeviceInfoRaw.DeviceInformation()
+
+	testPower(t, "Inputs[0].Power()", di.Inputs[0].Power(), 2317.5)
+	testPower(t, "Inputs[1].Power()", di.Inputs[1].Power(), 18501.4)
+	testPower(t, "DCPower()", di.DCPower(), 20818.9)
+	testPower(t, "ACPower()", di.ACPower(), 6243.6)
+	testPower(t, "Efficiency()", di.Efficiency(), 6243.6/20818.9)
+	testPower(t, "EstimatePowerFactor(0.97)", di.EstimatePowerFactor(0.97), 1.0)
+
+	di.Inputs = []InputStatus{InputStatus{Voltage: 300.0, Current: 2.0}}
+	testPower(t, "EstimatePowerFactor(0.97)", di.EstimatePowerFactor(0.97),
+		600*0.97/6243.6)
+
+	di.Inputs = nil
+	testPower(t, "Efficiency() without input", di.Efficiency(), 0)
+}
+
+func TestPowerStandardValid(t *testing.T) {
+	if !PowerStandardDefault.Valid() || !PowerStandardEN50438L.Valid() {
+		t.Error("Defined power standard rejected")
+	}
+	if (PowerStandardEN50438L + 1).Valid() {
+		t.Error("Undefined power standard accepted")
+	}
+}
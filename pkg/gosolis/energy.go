@@ -0,0 +1,171 @@
+/*
+ * SPDX-FileCopyrightText: Copyright 2022 Andreas Sandberg <andreas@sandberg.uk>
+ *
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package gosolis
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Default maximum gap between samples that is integrated. Longer
+// gaps (e.g., the inverter being offline at night) are bridged
+// using the device counters only.
+const DefaultEnergyMaxGap = 5 * time.Minute
+
+// High-resolution energy counter that tracks a coarse device counter.
+type energyCounter struct {
+	// Estimated energy (Wh)
+	Energy float64
+	// Last value of the device counter (Wh)
+	Counter float64
+}
+
+// Update the estimate with energy integrated since the last sample
+// and correct it using the device counter. The true value is always
+// in the range [counter, counter + resolution).
+func (ec *energyCounter) update(counter, resolution, delta float64, valid bool) {
+	switch {
+	case !valid:
+		// No usable history, start from the device counter.
+		ec.Energy = counter
+	case counter != ec.Counter:
+		// The counter either stepped, which means that the
+		// true value just crossed counter, or was reset
+		// (e.g., at midnight or at the start of a new month).
+		ec.Energy = counter
+	default:
+		ec.Energy += delta
+	}
+
+	if ec.Energy < counter {
+		ec.Energy = counter
+	} else if ec.Energy > counter+resolution {
+		ec.Energy = counter + resolution
+	}
+
+	ec.Counter = counter
+}
+
+// Energy estimates produced by an EnergyIntegrator. All values are
+// in Wh.
+type EnergyEstimate struct {
+	Total float64
+	Month float64
+	Today float64
+}
+
+// EnergyIntegrator provides high-resolution energy estimates by
+// integrating AC power between polls. The estimates are anchored to
+// the energy counters reported by the device. Whenever a counter
+// steps, the estimate is reset to the new counter value to prevent
+// drift. Counter resets (midnight for Today and the monthly rollover
+// for Month) reset the corresponding estimate.
+type EnergyIntegrator struct {
+	// Longest gap between samples that is integrated
+	MaxGap time.Duration `json:"-"`
+
+	// Time and AC power (W) of the last sample
+	Last      time.Time
+	LastPower float64
+
+	Total energyCounter
+	Month energyCounter
+	Today energyCounter
+}
+
+// Create a new integrator without any history.
+func NewEnergyIntegrator() *EnergyIntegrator {
+	return &EnergyIntegrator{
+		MaxGap: DefaultEnergyMaxGap,
+	}
+}
+
+// Load the integrator state from a file. A missing state file isn't
+// an error, the integrator will start without history in that case.
+func LoadEnergyIntegrator(path string) (*EnergyIntegrator, error) {
+	ei := NewEnergyIntegrator()
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ei, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, ei); err != nil {
+		return nil, err
+	}
+
+	return ei, nil
+}
+
+// Atomically save the integrator state to a file.
+func (ei *EnergyIntegrator) Save(path string) error {
+	data, err := json.Marshal(ei)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".energy-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// Add a sample and get the current energy estimates.
+func (ei *EnergyIntegrator) Update(when time.Time, di *DeviceInformation) EnergyEstimate {
+	power := di.ACPower()
+	dt := when.Sub(ei.Last)
+	valid := !ei.Last.IsZero() && dt >= 0 && dt <= ei.MaxGap
+
+	// Trapezoidal integration of the AC power since the last
+	// sample (Wh)
+	delta := 0.0
+	if valid {
+		delta = (ei.LastPower + power) / 2 * dt.Hours()
+	}
+
+	// Counter history remains valid across gaps, the device
+	// counters still tell us if anything has changed.
+	known := !ei.Last.IsZero()
+	ei.Total.update(di.Production.Total*1000, 1000, delta, known)
+	ei.Month.update(di.Production.Month*1000, 1000, delta, known)
+	ei.Today.update(di.Production.Today*1000, 100, delta, known)
+
+	ei.Last = when
+	ei.LastPower = power
+
+	return ei.Estimate()
+}
+
+// Get the current energy estimates.
+func (ei *EnergyIntegrator) Estimate() EnergyEstimate {
+	return EnergyEstimate{
+		Total: ei.Total.Energy,
+		Month: ei.Month.Energy,
+		Today: ei.Today.Energy,
+	}
+}
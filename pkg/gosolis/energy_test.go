@@ -0,0 +1,99 @@
+/*
+ * SPDX-FileCopyrightText: Copyright 2022 Andreas Sandberg <andreas@sandberg.uk>
+ *
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package gosolis
+
+import (
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func energySample(power, total, month, today float64) *DeviceInformation {
+	return &DeviceInformation{
+		Grid: GridInformation{Voltage: 250, Current: power / 250},
+		Production: ProductionInformation{
+			Total: total,
+			Month: month,
+			Today: today,
+		},
+	}
+}
+
+func testEstimate(t *testing.T, e EnergyEstimate, total, month, today float64) {
+	if math.Abs(e.Total-total) > 1e-6 ||
+		math.Abs(e.Month-month) > 1e-6 ||
+		math.Abs(e.Today-today) > 1e-6 {
+
+		t.Errorf("Estimate %+v; want {Total:%v Month:%v Today:%v}",
+			e, total, month, today)
+	}
+}
+
+func TestEnergyIntegrator(t *testing.T) {
+	ei := NewEnergyIntegrator()
+	now := time.Date(2022, 3, 31, 23, 50, 0, 0, time.UTC)
+
+	// The first sample starts from the device counters
+	e := ei.Update(now, energySample(1200, 100, 10, 5))
+	testEstimate(t, e, 100000, 10000, 5000)
+
+	// Constant 1200 W for one minute is 20 Wh
+	now = now.Add(time.Minute)
+	e = ei.Update(now, energySample(1200, 100, 10, 5))
+	testEstimate(t, e, 100020, 10020, 5020)
+
+	// Today steps, which resets its estimate to the new value
+	now = now.Add(time.Minute)
+	e = ei.Update(now, energySample(1200, 100, 10, 5.1))
+	testEstimate(t, e, 100040, 10040, 5100)
+
+	// Estimates never exceed the counter resolution
+	now = now.Add(5 * time.Minute)
+	e = ei.Update(now, energySample(6000, 100, 10, 5.1))
+	testEstimate(t, e, 100040+300, 10040+300, 5200)
+
+	// Gaps longer than MaxGap aren't integrated
+	now = now.Add(ei.MaxGap + time.Second)
+	e = ei.Update(now, energySample(6000, 100, 10, 5.1))
+	testEstimate(t, e, 100340, 10340, 5200)
+
+	// Midnight and monthly rollover reset Today and Month
+	now = now.Add(time.Minute)
+	e = ei.Update(now, energySample(6000, 101, 0, 0))
+	testEstimate(t, e, 101000, 0, 0)
+}
+
+func TestEnergyIntegratorState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "energy.json")
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	ei, err := LoadEnergyIntegrator(path)
+	if err != nil {
+		t.Fatal("Loading missing state failed: ", err)
+	}
+
+	ei.Update(now, energySample(600, 100, 10, 5))
+	ei.Update(now.Add(time.Minute), energySample(600, 100, 10, 5))
+	if err := ei.Save(path); err != nil {
+		t.Fatal("Save failed: ", err)
+	}
+
+	restored, err := LoadEnergyIntegrator(path)
+	if err != nil {
+		t.Fatal("Load failed: ", err)
+	}
+
+	if restored.Estimate() != ei.Estimate() {
+		t.Errorf("Restored estimate %+v; want %+v",
+			restored.Estimate(), ei.Estimate())
+	}
+
+	// Integration continues from the restored state
+	e := restored.Update(now.Add(2*time.Minute), energySample(600, 100, 10, 5))
+	testEstimate(t, e, 100020, 10020, 5020)
+}
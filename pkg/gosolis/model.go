@@ -0,0 +1,72 @@
+/*
+ * SPDX-FileCopyrightText: Copyright 2022 Andreas Sandberg <andreas@sandberg.uk>
+ *
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package gosolis
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Static information about an inverter model
+type Model struct {
+	// Marketing name of the model
+	Name string
+	// Rated AC output power (W)
+	RatedPower float64 `mapstructure:"rated_power"`
+	// Number of DC inputs (MPPT trackers)
+	Inputs int
+	// Number of AC phases
+	Phases int
+}
+
+var (
+	modelLock sync.RWMutex
+
+	// Known product codes. The protocol documentation doesn't
+	// list product codes, so entries are only added once a code
+	// has been confirmed on real hardware. Use RegisterModel (or
+	// the models section in the configuration file) to add
+	// devices that aren't listed here.
+	models = map[DeviceProduct]Model{}
+)
+
+// Add a new model or override an existing model in the model table.
+func RegisterModel(p DeviceProduct, m Model) {
+	modelLock.Lock()
+	defer modelLock.Unlock()
+
+	models[p] = m
+}
+
+// Lookup a model in the model table.
+func LookupModel(p DeviceProduct) (Model, bool) {
+	modelLock.RLock()
+	defer modelLock.RUnlock()
+
+	m, ok := models[p]
+	return m, ok
+}
+
+func (m Model) String() string {
+	return fmt.Sprintf("%s (%.0f W, %d inputs, %d phase)",
+		m.Name, m.RatedPower, m.Inputs, m.Phases)
+}
+
+func (p DeviceProduct) String() string {
+	return fmt.Sprintf("0x%02x", uint8(p))
+}
+
+// Format the software version the way the inverter display shows it
+// (upper-case hexadecimal).
+func (v DeviceVersion) String() string {
+	return fmt.Sprintf("%02X", uint8(v))
+}
+
+// Lookup the model of the device in the model table.
+func (di *DeviceInformation) Model() (Model, bool) {
+	return LookupModel(di.Product)
+}
@@ -0,0 +1,89 @@
+/*
+ * SPDX-FileCopyrightText: Copyright 2022 Andreas Sandberg <andreas@sandberg.uk>
+ *
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package gosolis
+
+import (
+	"testing"
+)
+
+// Save a model table entry. Returns a function restoring the entry.
+func restoreModel(p DeviceProduct) func() {
+	modelLock.RLock()
+	m, ok := models[p]
+	modelLock.RUnlock()
+
+	return func() {
+		modelLock.Lock()
+		defer modelLock.Unlock()
+
+		if ok {
+			models[p] = m
+		} else {
+			delete(models, p)
+		}
+	}
+}
+
+func TestModelTrimInputs(t *testing.T) {
+	rdi := testDeviceInfoRaw
+	rdi.Product = 0xfe
+
+	if di := rdi.DeviceInformation(); len(di.Inputs) != 2 {
+		t.Errorf("Unknown model has %d inputs; want 2", len(di.Inputs))
+	}
+
+	defer restoreModel(DeviceProduct(0xfe))()
+	RegisterModel(DeviceProduct(0xfe), Model{
+		Name:       "Test",
+		RatedPower: 1000,
+		Inputs:     1,
+		Phases:     1,
+	})
+
+	di := rdi.DeviceInformation()
+	if len(di.Inputs) != 1 {
+		t.Fatalf("Known model has %d inputs; want 1", len(di.Inputs))
+	}
+
+	if di.Inputs[0] != testDeviceInfo.Inputs[0] {
+		t.Errorf("Input mismatch: %v", di.Inputs[0])
+	}
+
+	if m, ok := di.Model(); !ok || m.Name != "Test" {
+		t.Errorf("Model() = %v, %v; want Test", m, ok)
+	}
+}
+
+func TestVersionString(t *testing.T) {
+	if s := DeviceVersion(0xf).String(); s != "0F" {
+		t.Errorf("DeviceVersion(0xf) = %s; want 0F", s)
+	}
+
+	if s := DeviceProduct(0x96).String(); s != "0x96" {
+		t.Errorf("DeviceProduct(0x96) = %s; want 0x96", s)
+	}
+
+	if s := DeviceProduct(0x05).String(); s != "0x05" {
+		t.Errorf("DeviceProduct(0x05) = %s; want 0x05", s)
+	}
+}
+
+func TestModelLookup(t *testing.T) {
+	// Product code used by the test fixture
+	defer restoreModel(DeviceProduct(0x96))()
+	RegisterModel(DeviceProduct(0x96), Model{
+		Name:       "Test",
+		RatedPower: 1500,
+		Inputs:     2,
+		Phases:     1,
+	})
+
+	di := testDeviceInfoRaw.DeviceInformation()
+	if m, ok := di.Model(); !ok || m.Inputs != 2 || len(di.Inputs) != 2 {
+		t.Errorf("Model() = %v, %v with %d inputs", m, ok, len(di.Inputs))
+	}
+}
@@ -0,0 +1,56 @@
+/*
+ * SPDX-FileCopyrightText: Copyright 2022 Andreas Sandberg <andreas@sandberg.uk>
+ *
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package gosolis
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Format the serial number the way it is printed on the inverter
+// label: 16 hexadecimal digits with the bytes in reverse order. The
+// order is inferred from the inverted serial number in the interface
+// status message (see PROTOCOL.md).
+func (sn DeviceSerialNumber) String() string {
+	var buf [len(sn)]byte
+	for i, b := range sn {
+		buf[len(sn)-1-i] = b
+	}
+
+	return strings.ToUpper(hex.EncodeToString(buf[:]))
+}
+
+// Parse a serial number in the format printed on the inverter label.
+func ParseSerialNumber(s string) (DeviceSerialNumber, error) {
+	var sn DeviceSerialNumber
+
+	raw, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(raw) != len(sn) {
+		return sn, fmt.Errorf("Illegal serial number '%s'", s)
+	}
+
+	for i, b := range raw {
+		sn[len(sn)-1-i] = b
+	}
+
+	return sn, nil
+}
+
+func (sn DeviceSerialNumber) MarshalText() ([]byte, error) {
+	return []byte(sn.String()), nil
+}
+
+func (sn *DeviceSerialNumber) UnmarshalText(text []byte) error {
+	v, err := ParseSerialNumber(string(text))
+	if err != nil {
+		return err
+	}
+
+	*sn = v
+	return nil
+}
@@ -0,0 +1,54 @@
+/*
+ * SPDX-FileCopyrightText: Copyright 2022 Andreas Sandberg <andreas@sandberg.uk>
+ *
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package gosolis
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+var testSerialLabel = "0807060504030201"
+
+func TestSerialNumberString(t *testing.T) {
+	if s := testDeviceInfo.SerialNo.String(); s != testSerialLabel {
+		t.Errorf("SerialNo.String() = %s; want %s", s, testSerialLabel)
+	}
+}
+
+func TestParseSerialNumber(t *testing.T) {
+	sn, err := ParseSerialNumber(testSerialLabel)
+	if err != nil {
+		t.Fatal("ParseSerialNumber failed: ", err)
+	}
+
+	if sn != testDeviceInfo.SerialNo {
+		t.Errorf("ParseSerialNumber(%s) = %v; want %v",
+			testSerialLabel, [8]byte(sn), [8]byte(testDeviceInfo.SerialNo))
+	}
+
+	for _, s := range []string{"", "0807", "080706050403020g", "080706050403020100"} {
+		if _, err := ParseSerialNumber(s); err == nil {
+			t.Errorf("ParseSerialNumber(%s) didn't fail", s)
+		}
+	}
+}
+
+func TestSerialNumberJSON(t *testing.T) {
+	b, err := json.Marshal(testDeviceInfo.SerialNo)
+	if err != nil {
+		t.Fatal("Marshal failed: ", err)
+	}
+
+	if string(b) != `"`+testSerialLabel+`"` {
+		t.Errorf("Marshalled serial number %s; want \"%s\"", b, testSerialLabel)
+	}
+
+	var sn DeviceSerialNumber
+	if err := json.Unmarshal(b, &sn); err != nil || sn != testDeviceInfo.SerialNo {
+		t.Errorf("Unmarshal(%s) = %v, %v", b, sn, err)
+	}
+}
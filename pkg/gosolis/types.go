@@ -44,3 +44,23 @@ type BusInterface interface {
 	WriteFrame(frame *Frame) error
 	WriteAck(dev DeviceId, cmd Command) error
 }
+
+// Bus interfaces that wrap another bus interface (e.g., tracing or
+// metrics) implement this interface to expose the wrapped bus.
+type BusWrapper interface {
+	Unwrap() BusInterface
+}
+
+// Find the serial bus at the bottom of a chain of bus wrappers.
+func findSerialBus(bus BusInterface) *SerialBus {
+	for {
+		switch b := bus.(type) {
+		case *SerialBus:
+			return b
+		case BusWrapper:
+			bus = b.Unwrap()
+		default:
+			return nil
+		}
+	}
+}
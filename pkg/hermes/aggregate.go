@@ -0,0 +1,344 @@
+/*
+ * SPDX-FileCopyrightText: Copyright 2022 Andreas Sandberg <andreas@sandberg.uk>
+ *
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package hermes
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"time"
+)
+
+// Aggregation functions applied to gauges
+const (
+	AggregateMin  = "min"
+	AggregateMax  = "max"
+	AggregateMean = "mean"
+	AggregateLast = "last"
+)
+
+// Time after the end of a window before it is emitted if no newer
+// messages have been received
+var AggregateDelay = 30 * time.Second
+
+// Settings for aggregating messages over fixed time windows. Windows
+// are aligned to multiples of the window length since the UNIX epoch
+// (e.g., 12:00, 12:05, ... for 5 minute windows).
+//
+// Numeric fields are either gauges, which are summarized using the
+// configured functions, or counters, which are reported as their
+// last value and the increase within the window. Other fields are
+// reported as their last value.
+type AggregateConfig struct {
+	// Length of each window
+	Window time.Duration
+	// Functions applied to gauges. Each gauge is replaced by a map
+	// from function name to value unless a single function is
+	// used, in which case the result replaces the gauge. Defaults
+	// to min, max, mean and last.
+	Functions []string
+	// Fields that are counters. Counters are reported as a map
+	// with their last value ("last") and increase ("delta"), or as
+	// their last value if a single function is used.
+	Counters []string
+	// Fields that are reported as their last value
+	Last []string
+}
+
+var (
+	defaultAggregateFunctions = []string{
+		AggregateMin, AggregateMax, AggregateMean, AggregateLast,
+	}
+
+	// Only counters that never reset. The delta of a daily or
+	// monthly counter would be negative in the window it resets.
+	defaultAggregateCounters = []string{"production.total", "energy.total_wh"}
+
+	defaultAggregateLast = []string{
+		"status", "error", "grid.status", "grid.power_standard",
+		"power_curve",
+	}
+)
+
+func (ac *AggregateConfig) validate() error {
+	if ac.Window <= 0 {
+		return fmt.Errorf("Aggregation window not specified")
+	}
+	if ac.Functions == nil {
+		ac.Functions = defaultAggregateFunctions
+	}
+	if ac.Counters == nil {
+		ac.Counters = defaultAggregateCounters
+	}
+	if ac.Last == nil {
+		ac.Last = defaultAggregateLast
+	}
+
+	if len(ac.Functions) == 0 {
+		return fmt.Errorf("No aggregation functions specified")
+	}
+	for _, f := range ac.Functions {
+		switch f {
+		case AggregateMin, AggregateMax, AggregateMean, AggregateLast:
+		default:
+			return fmt.Errorf("Illegal aggregation function '%s'", f)
+		}
+	}
+
+	for _, patterns := range [][]string{ac.Counters, ac.Last} {
+		for _, p := range patterns {
+			if _, err := path.Match(p, ""); err != nil {
+				return fmt.Errorf("Illegal field pattern '%s'", p)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Summary of a field within a window
+type aggregateField struct {
+	numeric bool
+	n       int
+	min     float64
+	max     float64
+	sum     float64
+	first   float64
+	last    float64
+	value   interface{}
+}
+
+func (f *aggregateField) add(v interface{}) {
+	f.value = v
+
+	x, ok := changeNumber(v)
+	if !ok {
+		f.numeric = false
+		return
+	}
+
+	if f.n == 0 {
+		f.numeric = true
+		f.min, f.max, f.first = x, x, x
+	}
+	if x < f.min {
+		f.min = x
+	}
+	if x > f.max {
+		f.max = x
+	}
+	f.sum += x
+	f.last = x
+	f.n++
+}
+
+// Messages from a source within a window
+type aggregateWindow struct {
+	start   time.Time
+	last    time.Time
+	labels  map[string]string
+	message map[string]interface{}
+	fields  map[string]*aggregateField
+	samples int
+}
+
+// Aggregates messages from multiple sources over time windows
+type Aggregator struct {
+	config *AggregateConfig
+
+	windows map[string]*aggregateWindow
+	// Time of the latest message from each source
+	seen map[string]time.Time
+	// Counter values at the end of the previous window
+	counters map[string]map[string]float64
+}
+
+func newAggregator(ac *AggregateConfig) *Aggregator {
+	return &Aggregator{
+		config:   ac,
+		windows:  map[string]*aggregateWindow{},
+		seen:     map[string]time.Time{},
+		counters: map[string]map[string]float64{},
+	}
+}
+
+// Add a message to its window. Returns the messages summarizing
+// windows that ended before the message. Messages older than the
+// latest message from the same source are ignored.
+func (a *Aggregator) Add(m *Message) []*Message {
+	out := a.Expire(m.When)
+
+	if last, ok := a.seen[m.Source]; ok && !m.When.After(last) {
+		Log.Printf("Dropping message from '%s' at %s, not newer than %s",
+			m.Source, m.When.Format(time.RFC3339), last.Format(time.RFC3339))
+		return out
+	}
+	a.seen[m.Source] = m.When
+
+	// Truncate aligns to the zero time rather than the UNIX epoch,
+	// which only agrees for windows dividing a day
+	ns := m.When.UnixNano()
+	start := time.Unix(0, ns-ns%int64(a.config.Window)).In(m.When.Location())
+	w, ok := a.windows[m.Source]
+	if !ok {
+		w = &aggregateWindow{
+			start:  start,
+			fields: map[string]*aggregateField{},
+		}
+		a.windows[m.Source] = w
+	}
+
+	w.last = m.When
+	w.labels = m.Labels
+	w.message = m.Message
+	w.samples++
+	changeWalk(m.Message, "", func(field string, v interface{}) {
+		f, ok := w.fields[field]
+		if !ok {
+			f = &aggregateField{}
+			w.fields[field] = f
+		}
+		f.add(v)
+	})
+
+	return out
+}
+
+// Emit all windows that ended at or before a point in time
+func (a *Aggregator) Expire(now time.Time) []*Message {
+	var out []*Message
+	for source, w := range a.windows {
+		if end := w.start.Add(a.config.Window); !end.After(now) {
+			out = append(out, a.emit(source, w, false))
+			delete(a.windows, source)
+		}
+	}
+
+	return out
+}
+
+// Emit all windows, including windows that haven't ended yet
+func (a *Aggregator) Flush() []*Message {
+	var out []*Message
+	for source, w := range a.windows {
+		out = append(out, a.emit(source, w, true))
+		delete(a.windows, source)
+	}
+
+	return out
+}
+
+func (a *Aggregator) emit(source string, w *aggregateWindow, partial bool) *Message {
+	ac := a.config
+	single := len(ac.Functions) == 1
+
+	prev, ok := a.counters[source]
+	if !ok {
+		prev = map[string]float64{}
+		a.counters[source] = prev
+	}
+
+	summarize := func(field string, v interface{}) interface{} {
+		f, ok := w.fields[field]
+		if !ok || !f.numeric {
+			return v
+		}
+
+		if matchField(ac.Counters, field) {
+			base, ok := prev[field]
+			if !ok {
+				base = f.first
+			}
+			prev[field] = f.last
+
+			delta := f.last - base
+			if delta < 0 {
+				// The counter has been reset
+				delta = f.last
+			}
+
+			if single {
+				return f.last
+			}
+			return map[string]interface{}{
+				AggregateLast: f.last,
+				"delta":       delta,
+			}
+		}
+
+		if matchField(ac.Last, field) {
+			return f.value
+		}
+
+		values := make(map[string]interface{}, len(ac.Functions))
+		for _, fn := range ac.Functions {
+			switch fn {
+			case AggregateMin:
+				values[fn] = f.min
+			case AggregateMax:
+				values[fn] = f.max
+			case AggregateMean:
+				values[fn] = f.sum / float64(f.n)
+			case AggregateLast:
+				values[fn] = f.last
+			}
+			if single {
+				return values[fn]
+			}
+		}
+
+		return values
+	}
+
+	msg := aggregateMap(w.message, "", summarize).(map[string]interface{})
+	msg["aggregate"] = map[string]interface{}{
+		"start":    w.start.Unix(),
+		"window":   ac.Window.Seconds(),
+		"samples":  w.samples,
+		"complete": !partial,
+	}
+
+	when := w.start.Add(ac.Window)
+	if partial {
+		when = w.last
+	}
+
+	return &Message{
+		When:    when,
+		Source:  source,
+		Labels:  w.labels,
+		Message: msg,
+	}
+}
+
+// Copy a message, replacing all leaves with the result of a
+// function.
+func aggregateMap(v interface{}, field string, fn func(field string, v interface{}) interface{}) interface{} {
+	join := func(k string) string {
+		if field == "" {
+			return k
+		}
+		return field + "." + k
+	}
+
+	switch c := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(c))
+		for k, e := range c {
+			out[k] = aggregateMap(e, join(k), fn)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(c))
+		for i, e := range c {
+			out[i] = aggregateMap(e, join(strconv.Itoa(i)), fn)
+		}
+		return out
+	default:
+		return fn(field, v)
+	}
+}
@@ -0,0 +1,228 @@
+/*
+ * SPDX-FileCopyrightText: Copyright 2022 Andreas Sandberg <andreas@sandberg.uk>
+ *
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package hermes
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func aggregateMessage(when time.Time, voltage, energy float64) *Message {
+	return &Message{
+		When:   when,
+		Source: "1",
+		Message: map[string]interface{}{
+			"status": 3,
+			"model":  "Test",
+			"grid": map[string]interface{}{
+				"voltage": voltage,
+			},
+			"energy": map[string]interface{}{
+				"total_wh": energy,
+			},
+		},
+	}
+}
+
+func TestAggregator(t *testing.T) {
+	ac := &AggregateConfig{Window: 5 * time.Minute}
+	if err := ac.validate(); err != nil {
+		t.Fatal("Validation failed: ", err)
+	}
+	a := newAggregator(ac)
+
+	start := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	var out []*Message
+	out = append(out, a.Add(aggregateMessage(start.Add(1*time.Minute), 230, 1000))...)
+	out = append(out, a.Add(aggregateMessage(start.Add(2*time.Minute), 234, 1010))...)
+	out = append(out, a.Add(aggregateMessage(start.Add(3*time.Minute), 232, 1030))...)
+	// Duplicates are ignored
+	out = append(out, a.Add(aggregateMessage(start.Add(3*time.Minute), 100, 0))...)
+	if len(out) != 0 {
+		t.Fatalf("Unexpected output before the end of the window: %v", out)
+	}
+
+	out = a.Add(aggregateMessage(start.Add(6*time.Minute), 240, 1100))
+	if len(out) != 1 {
+		t.Fatalf("Expected one aggregate, got %d", len(out))
+	}
+
+	m := out[0]
+	if !m.When.Equal(start.Add(5*time.Minute)) || m.Source != "1" {
+		t.Errorf("Unexpected aggregate %v@%v", m.Source, m.When)
+	}
+
+	want := map[string]interface{}{
+		"status": 3,
+		"model":  "Test",
+		"grid": map[string]interface{}{
+			"voltage": map[string]interface{}{
+				"min": 230.0, "max": 234.0, "mean": 232.0, "last": 232.0,
+			},
+		},
+		"energy": map[string]interface{}{
+			"total_wh": map[string]interface{}{
+				"last": 1030.0, "delta": 30.0,
+			},
+		},
+		"aggregate": map[string]interface{}{
+			"start":    start.Unix(),
+			"window":   300.0,
+			"samples":  3,
+			"complete": true,
+		},
+	}
+	if !reflect.DeepEqual(m.Message, want) {
+		t.Errorf("Unexpected aggregate %v; want %v", m.Message, want)
+	}
+
+	// Counters increase from the end of the previous window
+	out = a.Flush()
+	if len(out) != 1 {
+		t.Fatalf("Expected one partial aggregate, got %d", len(out))
+	}
+	m = out[0]
+	energy := m.Message["energy"].(map[string]interface{})["total_wh"]
+	if delta := energy.(map[string]interface{})["delta"]; delta != 70.0 {
+		t.Errorf("Unexpected counter delta %v", delta)
+	}
+	if !m.When.Equal(start.Add(6*time.Minute)) ||
+		m.Message["aggregate"].(map[string]interface{})["complete"] != false {
+
+		t.Errorf("Unexpected partial aggregate %v", m)
+	}
+}
+
+func TestAggregatorSingle(t *testing.T) {
+	ac := &AggregateConfig{
+		Window:    time.Hour,
+		Functions: []string{AggregateMean},
+	}
+	if err := ac.validate(); err != nil {
+		t.Fatal("Validation failed: ", err)
+	}
+	a := newAggregator(ac)
+
+	start := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	a.Add(aggregateMessage(start, 230, 1000))
+	a.Add(aggregateMessage(start.Add(time.Minute), 240, 1010))
+	out := a.Expire(start.Add(time.Hour))
+	if len(out) != 1 {
+		t.Fatalf("Expected one aggregate, got %d", len(out))
+	}
+
+	grid := out[0].Message["grid"].(map[string]interface{})
+	energy := out[0].Message["energy"].(map[string]interface{})
+	if grid["voltage"] != 235.0 || energy["total_wh"] != 1010.0 {
+		t.Errorf("Unexpected aggregate %v", out[0].Message)
+	}
+}
+
+func TestAggregatorEpoch(t *testing.T) {
+	ac := &AggregateConfig{Window: 7 * time.Minute}
+	if err := ac.validate(); err != nil {
+		t.Fatal("Validation failed: ", err)
+	}
+	a := newAggregator(ac)
+
+	// Windows are multiples of 7 minutes since the UNIX epoch
+	start := time.Unix(0, 0).Add(7 * 1000 * time.Minute)
+	a.Add(aggregateMessage(start.Add(time.Minute), 230, 1000))
+	out := a.Add(aggregateMessage(start.Add(8*time.Minute), 232, 1010))
+	if len(out) != 1 {
+		t.Fatalf("Expected one aggregate, got %d", len(out))
+	}
+
+	if when := out[0].When; !when.Equal(start.Add(7 * time.Minute)) {
+		t.Errorf("Window ends at %s; want %s", when, start.Add(7*time.Minute))
+	}
+}
+
+func TestAggregateConfig(t *testing.T) {
+	for _, ac := range []AggregateConfig{
+		{},
+		{Window: time.Minute, Functions: []string{"median"}},
+		{Window: time.Minute, Functions: []string{}},
+		{Window: time.Minute, Counters: []string{"["}},
+	} {
+		if err := ac.validate(); err == nil {
+			t.Errorf("Configuration %+v accepted", ac)
+		}
+	}
+}
+
+type collectBackend struct {
+	seen []*Message
+}
+
+func (b *collectBackend) Connect() error { return nil }
+
+func (b *collectBackend) SendMessage(m *Message) error {
+	b.seen = append(b.seen, m)
+	return nil
+}
+
+func TestHermesAggregate(t *testing.T) {
+	b := &collectBackend{}
+	h := newHermes()
+	err := h.addBackend("test", b, &QueueConfig{
+		Aggregate: &AggregateConfig{Window: 5 * time.Minute},
+	})
+	if err != nil {
+		t.Fatal("addBackend failed: ", err)
+	}
+	h.start()
+
+	start := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 7; i++ {
+		h.Post(aggregateMessage(start.Add(time.Duration(i)*time.Minute), 230, 1000))
+	}
+
+	// The partial window is delivered on shutdown
+	h.Close()
+	if len(b.seen) != 2 {
+		t.Fatalf("Expected two aggregates, got %d", len(b.seen))
+	}
+	for i, samples := range []int{5, 2} {
+		agg := b.seen[i].Message["aggregate"].(map[string]interface{})
+		if agg["samples"] != samples {
+			t.Errorf("Aggregate %d has %v samples; want %d", i, agg["samples"], samples)
+		}
+	}
+}
+
+func TestAggregatorDefaultCounters(t *testing.T) {
+	ac := &AggregateConfig{Window: 5 * time.Minute, Functions: []string{AggregateMean}}
+	if err := ac.validate(); err != nil {
+		t.Fatal("Validation failed: ", err)
+	}
+	a := newAggregator(ac)
+
+	// Daily counters reset and must not be reported as counters
+	start := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+	for i, today := range []float64{3, 0, 0} {
+		a.Add(&Message{
+			When:   start.Add(time.Duration(i) * time.Minute),
+			Source: "1",
+			Message: map[string]interface{}{
+				"production": map[string]interface{}{
+					"total": 1000 + float64(i), "today": today,
+				},
+			},
+		})
+	}
+
+	out := a.Flush()
+	if len(out) != 1 {
+		t.Fatalf("Expected one aggregate, got %d", len(out))
+	}
+	want := map[string]interface{}{"total": 1002.0, "today": 1.0}
+	if got := out[0].Message["production"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %v; want %v", got, want)
+	}
+}
@@ -0,0 +1,633 @@
+/*
+ * SPDX-FileCopyrightText: Copyright 2022 Andreas Sandberg <andreas@sandberg.uk>
+ *
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package hermes
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Token scopes
+const (
+	// Read device information and history
+	ScopeRead = "read"
+	// Read access and permission to send commands
+	ScopeControl = "control"
+)
+
+// Longest time ranges that can be queried. Longer ranges are
+// clamped to bound the number of files read by a request.
+const (
+	apiMaxHistoryRange = 366 * 24 * time.Hour
+	apiMaxDailyRange   = 10 * apiMaxHistoryRange
+)
+
+//go:embed api_openapi.json
+var apiOpenAPI []byte
+
+// Token granting access to the API
+type APIToken struct {
+	// Name used to identify the token in the audit log
+	Name      string
+	Token     string
+	TokenFile string `mapstructure:"token_file"`
+	TokenEnv  string `mapstructure:"token_env"`
+	// Scope granted by the token, read or control
+	Scope string
+}
+
+type APIConfig struct {
+	basePath string
+
+	// Address to listen on, defaults to localhost:8080
+	Listen string
+	// Server certificate and key. TLS is enabled if they are set.
+	CertFile string `mapstructure:"cert_file"`
+	KeyFile  string `mapstructure:"key_file"`
+	// Minimum TLS version ("1.0", "1.1", "1.2" or "1.3")
+	MinVersion string `mapstructure:"min_tls_version"`
+
+	Tokens []APIToken
+
+	// Directory of a history store (see the history backend)
+	// served by the history endpoint
+	History string
+	// Maximum time to wait for the daemon to execute a command
+	CommandTimeout time.Duration `mapstructure:"command_timeout"`
+}
+
+type apiToken struct {
+	name  string
+	token []byte
+	scope string
+}
+
+// Latest report from a device
+type apiDevice struct {
+	when    time.Time
+	labels  map[string]string
+	state   string
+	message map[string]interface{}
+}
+
+// Backend serving device information and history over HTTP and
+// accepting commands
+type API struct {
+	config  *APIConfig
+	tokens  []apiToken
+	tls     *tls.Config
+	history *HistoryStore
+
+	server   *http.Server
+	listener net.Listener
+
+	lock    sync.Mutex
+	devices map[string]*apiDevice
+	handler func(c *Command)
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+type apiInverter struct {
+	ID          string                 `json:"id"`
+	State       string                 `json:"state,omitempty"`
+	Time        *time.Time             `json:"time,omitempty"`
+	Labels      map[string]string      `json:"labels,omitempty"`
+	Information map[string]interface{} `json:"information,omitempty"`
+}
+
+type apiHistoryValue struct {
+	Min  float64 `json:"min"`
+	Max  float64 `json:"max"`
+	Mean float64 `json:"mean"`
+	Last float64 `json:"last"`
+}
+
+type apiHistoryRecord struct {
+	Time    time.Time                  `json:"time"`
+	Samples int                        `json:"samples"`
+	Values  map[string]apiHistoryValue `json:"values"`
+}
+
+type apiHistory struct {
+	ID         string             `json:"id"`
+	Resolution string             `json:"resolution"`
+	From       time.Time          `json:"from"`
+	To         time.Time          `json:"to"`
+	Records    []apiHistoryRecord `json:"records"`
+}
+
+type apiCommandRequest struct {
+	ID      string                 `json:"id"`
+	Command string                 `json:"command"`
+	Args    map[string]interface{} `json:"args"`
+}
+
+func apiCreateViper(subv *viper.Viper, basePath string) (Backend, error) {
+	cfg := APIConfig{
+		basePath: basePath,
+	}
+
+	if err := subv.Unmarshal(&cfg, decodeHooks(basePath)); err != nil {
+		return nil, err
+	}
+
+	return cfg.Create()
+}
+
+func init() {
+	Backends["api"] = BackendFactory{
+		CreateViper: apiCreateViper,
+	}
+}
+
+func (ac *APIConfig) Create() (*API, error) {
+	if bp, err := defaultBasePath(ac.basePath); err == nil {
+		ac.basePath = bp
+	} else {
+		return nil, err
+	}
+
+	if ac.Listen == "" {
+		ac.Listen = "localhost:8080"
+	}
+	if ac.CommandTimeout <= 0 {
+		ac.CommandTimeout = 30 * time.Second
+	}
+
+	api := &API{
+		config:  ac,
+		devices: map[string]*apiDevice{},
+	}
+
+	if len(ac.Tokens) == 0 {
+		return nil, fmt.Errorf("The API requires at least one token")
+	}
+	for i, t := range ac.Tokens {
+		token, err := readSecret(ac.basePath, t.Token, t.TokenFile, t.TokenEnv)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read API token: %s", err)
+		}
+		if token == "" {
+			return nil, fmt.Errorf("API token %d not specified", i)
+		}
+
+		switch t.Scope {
+		case "":
+			t.Scope = ScopeRead
+		case ScopeRead, ScopeControl:
+		default:
+			return nil, fmt.Errorf("Illegal token scope '%s'", t.Scope)
+		}
+
+		if t.Name == "" {
+			t.Name = strconv.Itoa(i)
+		}
+
+		api.tokens = append(api.tokens, apiToken{
+			name:  t.Name,
+			token: []byte(token),
+			scope: t.Scope,
+		})
+	}
+
+	if ac.CertFile != "" || ac.KeyFile != "" {
+		if ac.CertFile == "" || ac.KeyFile == "" {
+			return nil, fmt.Errorf("TLS requires both a certificate and key")
+		}
+
+		cert, err := tls.LoadX509KeyPair(
+			resolvePath(ac.basePath, ac.CertFile),
+			resolvePath(ac.basePath, ac.KeyFile))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load server certificate: %s", err)
+		}
+
+		api.tls = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		}
+		if ac.MinVersion != "" {
+			v, ok := tlsVersions[ac.MinVersion]
+			if !ok {
+				return nil, fmt.Errorf("Unsupported TLS version '%s'", ac.MinVersion)
+			}
+			api.tls.MinVersion = v
+		}
+	}
+
+	if ac.History != "" {
+		api.history = OpenHistoryStore(resolvePath(ac.basePath, ac.History))
+	}
+
+	return api, nil
+}
+
+func (api *API) Connect() error {
+	l, err := net.Listen("tcp", api.config.Listen)
+	if err != nil {
+		return err
+	}
+
+	if api.tls != nil {
+		l = tls.NewListener(l, api.tls)
+	}
+
+	api.listener = l
+	api.server = &http.Server{
+		Handler:           api,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		if err := api.server.Serve(l); err != http.ErrServerClosed {
+			Log.Print("API server failed: ", err)
+		}
+	}()
+
+	return nil
+}
+
+// Get the address the server listens on
+func (api *API) Addr() net.Addr {
+	return api.listener.Addr()
+}
+
+func (api *API) SendMessage(m *Message) error {
+	api.lock.Lock()
+	defer api.lock.Unlock()
+
+	d, ok := api.devices[m.Source]
+	if !ok {
+		d = &apiDevice{}
+		api.devices[m.Source] = d
+	}
+
+	d.when = m.When
+	d.labels = m.Labels
+	d.message = m.Message
+
+	return nil
+}
+
+func (api *API) SendState(source string, state string) error {
+	api.lock.Lock()
+	defer api.lock.Unlock()
+
+	d, ok := api.devices[source]
+	if !ok {
+		d = &apiDevice{}
+		api.devices[source] = d
+	}
+	d.state = state
+
+	return nil
+}
+
+func (api *API) SendStatus(status map[string]interface{}) error {
+	return nil
+}
+
+func (api *API) Subscribe(handler func(c *Command)) error {
+	api.lock.Lock()
+	defer api.lock.Unlock()
+
+	api.handler = handler
+	return nil
+}
+
+func (api *API) Close() error {
+	if api.server == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return api.server.Shutdown(ctx)
+}
+
+func apiWrite(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func apiFail(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	apiWrite(w, status, &apiError{Error: fmt.Sprintf(format, args...)})
+}
+
+// Find the token used to authenticate a request
+func (api *API) authenticate(r *http.Request) *apiToken {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return nil
+	}
+
+	token := []byte(strings.TrimPrefix(auth, "Bearer "))
+	for i := range api.tokens {
+		if subtle.ConstantTimeCompare(token, api.tokens[i].token) == 1 {
+			return &api.tokens[i]
+		}
+	}
+
+	return nil
+}
+
+// Route requests. Supported endpoints:
+//
+//	GET  /openapi.json
+//	GET  /inverters
+//	GET  /inverters/{id}
+//	GET  /inverters/{id}/history
+//	POST /inverters/{id}/commands
+func (api *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	if len(path) == 1 && path[0] == "openapi.json" {
+		if r.Method != http.MethodGet {
+			apiFail(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(apiOpenAPI)
+		return
+	}
+
+	if path[0] != "inverters" || len(path) > 3 {
+		apiFail(w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	token := api.authenticate(r)
+	if token == nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="gosolis"`)
+		apiFail(w, http.StatusUnauthorized, "Authentication required")
+		return
+	}
+
+	method := http.MethodGet
+	if len(path) == 3 && path[2] == "commands" {
+		method = http.MethodPost
+	}
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		apiFail(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	switch {
+	case len(path) == 1:
+		api.serveInverters(w)
+	case len(path) == 2:
+		api.serveInverter(w, path[1])
+	case path[2] == "history":
+		api.serveHistory(w, r, path[1])
+	case path[2] == "commands":
+		if token.scope != ScopeControl {
+			apiFail(w, http.StatusForbidden, "Token does not permit commands")
+			return
+		}
+		api.serveCommand(w, r, path[1], token)
+	default:
+		apiFail(w, http.StatusNotFound, "Not found")
+	}
+}
+
+func (d *apiDevice) inverter(id string) apiInverter {
+	inv := apiInverter{
+		ID:          id,
+		State:       d.state,
+		Labels:      d.labels,
+		Information: d.message,
+	}
+	if !d.when.IsZero() {
+		when := d.when
+		inv.Time = &when
+	}
+
+	return inv
+}
+
+func (api *API) serveInverters(w http.ResponseWriter) {
+	api.lock.Lock()
+	inverters := make([]apiInverter, 0, len(api.devices))
+	for id, d := range api.devices {
+		inverters = append(inverters, d.inverter(id))
+	}
+	api.lock.Unlock()
+
+	sort.Slice(inverters, func(i, j int) bool {
+		return inverters[i].ID < inverters[j].ID
+	})
+
+	apiWrite(w, http.StatusOK, inverters)
+}
+
+func (api *API) serveInverter(w http.ResponseWriter, id string) {
+	api.lock.Lock()
+	d, ok := api.devices[id]
+	var inv apiInverter
+	if ok {
+		inv = d.inverter(id)
+	}
+	api.lock.Unlock()
+
+	if !ok {
+		apiFail(w, http.StatusNotFound, "Unknown inverter '%s'", id)
+		return
+	}
+
+	apiWrite(w, http.StatusOK, &inv)
+}
+
+// Parse a time in a query. Supports RFC3339 timestamps and Unix
+// timestamps in seconds.
+func apiParseTime(s string) (time.Time, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(n, 0), nil
+	}
+
+	return time.Parse(time.RFC3339, s)
+}
+
+func (api *API) serveHistory(w http.ResponseWriter, r *http.Request, id string) {
+	if api.history == nil {
+		apiFail(w, http.StatusNotFound, "History not available")
+		return
+	}
+
+	q := r.URL.Query()
+	now := time.Now()
+	h := apiHistory{
+		ID:         id,
+		Resolution: q.Get("resolution"),
+		From:       now.Add(-24 * time.Hour),
+		To:         now,
+		Records:    []apiHistoryRecord{},
+	}
+
+	for name, t := range map[string]*time.Time{"from": &h.From, "to": &h.To} {
+		if s := q.Get(name); s != "" {
+			v, err := apiParseTime(s)
+			if err != nil {
+				apiFail(w, http.StatusBadRequest, "Illegal time '%s'", s)
+				return
+			}
+			*t = v
+		}
+	}
+
+	if !h.From.Before(h.To) {
+		apiFail(w, http.StatusBadRequest, "Empty time range")
+		return
+	}
+
+	if h.Resolution == "" || h.Resolution == "auto" {
+		h.Resolution = AutoHistoryResolution(h.From, h.To, now)
+	}
+
+	// There is no history in the future
+	if h.To.After(now) {
+		h.To = now
+	}
+	maxRange := apiMaxHistoryRange
+	if h.Resolution == HistoryDaily {
+		maxRange = apiMaxDailyRange
+	}
+	if h.To.Sub(h.From) > maxRange {
+		h.From = h.To.Add(-maxRange)
+	}
+	if !h.From.Before(h.To) {
+		apiFail(w, http.StatusBadRequest, "Time range in the future")
+		return
+	}
+
+	var records []HistoryRecord
+	var err error
+	switch h.Resolution {
+	case HistoryDaily:
+		records, err = api.history.Daily(id, h.From, h.To)
+	case HistoryRaw, History5Min:
+		records, err = api.history.Query(id, h.Resolution, h.From, h.To)
+	default:
+		apiFail(w, http.StatusBadRequest, "Illegal resolution '%s'", h.Resolution)
+		return
+	}
+	if err != nil {
+		apiFail(w, http.StatusInternalServerError, "Failed to read history: %s", err)
+		return
+	}
+
+	var fields []string
+	if s := q.Get("fields"); s != "" {
+		fields = strings.Split(s, ",")
+	}
+
+	for _, rec := range records {
+		values := map[string]apiHistoryValue{}
+		for k, v := range rec.Values {
+			if fields == nil || matchField(fields, k) {
+				values[k] = apiHistoryValue(v)
+			}
+		}
+
+		h.Records = append(h.Records, apiHistoryRecord{
+			Time:    rec.When,
+			Samples: rec.Samples,
+			Values:  values,
+		})
+	}
+
+	apiWrite(w, http.StatusOK, &h)
+}
+
+func (api *API) serveCommand(w http.ResponseWriter, r *http.Request, id string, token *apiToken) {
+	var req apiCommandRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil {
+		apiFail(w, http.StatusBadRequest, "Malformed command: %s", err)
+		return
+	}
+	if req.Command == "" {
+		apiFail(w, http.StatusBadRequest, "Malformed command: missing command")
+		return
+	}
+
+	api.lock.Lock()
+	handler := api.handler
+	api.lock.Unlock()
+	if handler == nil {
+		apiFail(w, http.StatusServiceUnavailable, "Commands not available")
+		return
+	}
+
+	// The reply is sent from the daemon's command loop, which
+	// may be busy polling the device
+	replies := make(chan *CommandResponse, 1)
+	now := time.Now()
+	c := &Command{
+		ID:       req.ID,
+		Source:   id,
+		Name:     req.Command,
+		Args:     req.Args,
+		When:     now,
+		Origin:   fmt.Sprintf("token '%s' from %s", token.name, r.RemoteAddr),
+		Deadline: now.Add(api.config.CommandTimeout),
+		reply: func(resp *CommandResponse) error {
+			select {
+			case replies <- resp:
+			default:
+			}
+			return nil
+		},
+	}
+	handler(c)
+
+	timer := time.NewTimer(api.config.CommandTimeout)
+	defer timer.Stop()
+
+	// Commands that haven't been started when the client stops
+	// waiting are cancelled, the client would otherwise never
+	// learn that they were executed.
+	timeout := timer.C
+	for {
+		select {
+		case resp := <-replies:
+			status := http.StatusOK
+			if !resp.Success {
+				status = http.StatusUnprocessableEntity
+			}
+			apiWrite(w, status, resp)
+			return
+		case <-timeout:
+			if c.cancel() {
+				apiFail(w, http.StatusGatewayTimeout, "Timeout waiting for command")
+				return
+			}
+			// The command is being executed, wait for the
+			// result
+			timeout = nil
+		case <-r.Context().Done():
+			c.cancel()
+			return
+		}
+	}
+}
@@ -0,0 +1,249 @@
+/*
+ * SPDX-FileCopyrightText: Copyright 2022 Andreas Sandberg <andreas@sandberg.uk>
+ *
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package hermes
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestAPI(t *testing.T, history string) *API {
+	cfg := APIConfig{
+		basePath: t.TempDir(),
+		Listen:   "127.0.0.1:0",
+		Tokens: []APIToken{
+			{Name: "reader", Token: "read-token"},
+			{Name: "admin", Token: "control-token", Scope: ScopeControl},
+		},
+		History:        history,
+		CommandTimeout: time.Second,
+	}
+
+	api, err := cfg.Create()
+	if err != nil {
+		t.Fatal("Create failed: ", err)
+	}
+
+	return api
+}
+
+func apiRequest(api *API, method, path, token, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, r)
+
+	return w
+}
+
+func TestAPIInverters(t *testing.T) {
+	api := newTestAPI(t, "")
+	if err := api.Connect(); err != nil {
+		t.Fatal("Connect failed: ", err)
+	}
+	defer api.Close()
+
+	when := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	api.SendMessage(&Message{
+		When:    when,
+		Source:  "1",
+		Labels:  map[string]string{"serial": "123"},
+		Message: map[string]interface{}{"power": map[string]interface{}{"ac": 1500}},
+	})
+	api.SendState("1", StateOnline)
+
+	url := fmt.Sprintf("http://%s/inverters", api.Addr())
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Got status %d without a token; want 401", resp.StatusCode)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	req.Header.Set("Authorization", "Bearer read-token")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var inverters []apiInverter
+	if err := json.NewDecoder(resp.Body).Decode(&inverters); err != nil {
+		t.Fatal("Malformed response: ", err)
+	}
+	if len(inverters) != 1 || inverters[0].ID != "1" || inverters[0].State != StateOnline ||
+		!inverters[0].Time.Equal(when) || inverters[0].Labels["serial"] != "123" {
+
+		t.Errorf("Unexpected inverters %+v", inverters)
+	}
+
+	if w := apiRequest(api, http.MethodGet, "/inverters/2", "read-token", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Got status %d for an unknown inverter; want 404", w.Code)
+	}
+	if w := apiRequest(api, http.MethodGet, "/openapi.json", "", ""); w.Code != http.StatusOK || !json.Valid(w.Body.Bytes()) {
+		t.Errorf("Unexpected OpenAPI response %d", w.Code)
+	}
+}
+
+func TestAPICommands(t *testing.T) {
+	api := newTestAPI(t, "")
+
+	var received *Command
+	api.Subscribe(func(c *Command) {
+		received = c
+		if c.Name == "grid_off" {
+			go c.Reply(nil, nil)
+		} else {
+			go c.Reply(nil, fmt.Errorf("Command not allowed"))
+		}
+	})
+
+	body := `{"id": "42", "command": "grid_off"}`
+	if w := apiRequest(api, http.MethodPost, "/inverters/1/commands", "read-token", body); w.Code != http.StatusForbidden {
+		t.Errorf("Got status %d for a read-only token; want 403", w.Code)
+	}
+	if received != nil {
+		t.Fatal("Command delivered without permission")
+	}
+
+	w := apiRequest(api, http.MethodPost, "/inverters/1/commands", "control-token", body)
+	var resp CommandResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal("Malformed response: ", err)
+	}
+	if w.Code != http.StatusOK || !resp.Success || resp.ID != "42" || resp.Device != "1" {
+		t.Errorf("Unexpected response %d %+v", w.Code, resp)
+	}
+	if received.Source != "1" || !strings.Contains(received.Origin, "admin") {
+		t.Errorf("Unexpected command %+v", received)
+	}
+
+	w = apiRequest(api, http.MethodPost, "/inverters/1/commands", "control-token", `{"command": "grid_on"}`)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Got status %d for a rejected command; want 422", w.Code)
+	}
+
+	if w := apiRequest(api, http.MethodGet, "/inverters/1/commands", "control-token", ""); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Got status %d for GET; want 405", w.Code)
+	}
+}
+
+func TestAPICommandTimeout(t *testing.T) {
+	api := newTestAPI(t, "")
+	api.config.CommandTimeout = 10 * time.Millisecond
+
+	queued := make(chan *Command, 1)
+	api.Subscribe(func(c *Command) {
+		if c.Name == "refresh" {
+			queued <- c
+			return
+		}
+
+		// Commands that have been started are waited for
+		go func() {
+			if err := c.Start(); err != nil {
+				t.Error("Start failed: ", err)
+			}
+			time.Sleep(50 * time.Millisecond)
+			c.Reply(nil, nil)
+		}()
+	})
+
+	w := apiRequest(api, http.MethodPost, "/inverters/1/commands", "control-token", `{"command": "refresh"}`)
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("Got status %d for a queued command; want 504", w.Code)
+	}
+
+	// The daemon gets to the command after the client gave up
+	if err := (<-queued).Start(); err != CommandExpiredError {
+		t.Errorf("Timed out command started: %v", err)
+	}
+
+	w = apiRequest(api, http.MethodPost, "/inverters/1/commands", "control-token", `{"command": "grid_off"}`)
+	if w.Code != http.StatusOK {
+		t.Errorf("Got status %d for a slow command; want 200", w.Code)
+	}
+}
+
+func TestAPIHistory(t *testing.T) {
+	dir := t.TempDir()
+	h := newTestHistory(t, dir)
+	day := time.Date(2022, 6, 1, 12, 0, 0, 0, time.Local)
+	for i := 0; i < 3; i++ {
+		h.SendMessage(historyMessage(day.Add(time.Duration(i)*time.Minute), float64(100*i), 0))
+	}
+	h.Close()
+
+	api := newTestAPI(t, filepath.Join(dir, "history"))
+	path := fmt.Sprintf("/inverters/1/history?from=%d&to=%d&resolution=raw&fields=power.*",
+		day.Unix(), day.Add(time.Hour).Unix())
+	w := apiRequest(api, http.MethodGet, path, "read-token", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d: %s", w.Code, w.Body)
+	}
+
+	var hist apiHistory
+	if err := json.Unmarshal(w.Body.Bytes(), &hist); err != nil {
+		t.Fatal("Malformed response: ", err)
+	}
+	if len(hist.Records) != 3 || hist.Records[2].Values["power.ac"].Last != 200 {
+		t.Errorf("Unexpected history %+v", hist)
+	}
+	if _, ok := hist.Records[0].Values["energy.today_wh"]; ok {
+		t.Error("Unexpected field in history")
+	}
+
+	w = apiRequest(api, http.MethodGet, "/inverters/1/history?resolution=hourly", "read-token", "")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Got status %d for an illegal resolution; want 400", w.Code)
+	}
+
+	for _, r := range []string{"from=100&to=100", "from=200&to=100", "from=4102444800"} {
+		w = apiRequest(api, http.MethodGet, "/inverters/1/history?"+r, "read-token", "")
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Got status %d for range '%s'; want 400", w.Code, r)
+		}
+	}
+
+	// Long ranges are clamped
+	w = apiRequest(api, http.MethodGet, "/inverters/1/history?resolution=daily&from=0&to=4102444800",
+		"read-token", "")
+	hist = apiHistory{}
+	if err := json.Unmarshal(w.Body.Bytes(), &hist); err != nil {
+		t.Fatal("Malformed response: ", err)
+	}
+	if w.Code != http.StatusOK || hist.To.After(time.Now()) ||
+		hist.To.Sub(hist.From) != apiMaxDailyRange {
+
+		t.Errorf("Unexpected range %d %v - %v", w.Code, hist.From, hist.To)
+	}
+}
+
+func TestAPIConfigErrors(t *testing.T) {
+	for _, cfg := range []APIConfig{
+		{},
+		{Tokens: []APIToken{{Name: "empty"}}},
+		{Tokens: []APIToken{{Token: "x", Scope: "admin"}}},
+		{Tokens: []APIToken{{Token: "x"}}, CertFile: "cert.pem"},
+	} {
+		if _, err := cfg.Create(); err == nil {
+			t.Errorf("Configuration %+v accepted", cfg)
+		}
+	}
+}
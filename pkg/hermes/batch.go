@@ -0,0 +1,198 @@
+/*
+ * SPDX-FileCopyrightText: Copyright 2022 Andreas Sandberg <andreas@sandberg.uk>
+ *
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package hermes
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Permanent request failure, retrying won't help
+type permanentError struct {
+	service string
+	status  int
+	body    string
+}
+
+func (e *permanentError) Error() string {
+	return fmt.Sprintf("%s request failed with status %d: %s",
+		e.service, e.status, e.body)
+}
+
+// Call a function until it succeeds or fails permanently. The delay
+// between attempts doubles after each attempt.
+func retryRequest(retries int, delay time.Duration, fn func() error) error {
+	var err error
+	for attempt := 0; attempt < retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+
+		err = fn()
+		if _, ok := err.(*permanentError); err == nil || ok {
+			return err
+		}
+	}
+
+	return err
+}
+
+type batchItem struct {
+	// Items are only batched with items using the same key
+	key  string
+	data []byte
+}
+
+// Buffer collecting items into batches for backends writing
+// several messages in a single request. Batches are written when
+// they are full or when the flush interval expires.
+//
+// The buffer only holds messages that have been accepted without
+// an error. Failures are reported to the sender of the message that
+// completed a batch, which lets the worker spool it. Other messages
+// in the batch stay in the buffer and are retried by the next flush,
+// which keeps the buffer smaller than a batch.
+type batcher struct {
+	name     string
+	size     int
+	interval time.Duration
+	// Write a batch of items sharing the same key
+	write func(key string, data [][]byte) error
+
+	lock    sync.Mutex
+	pending []*batchItem
+
+	flushLock sync.Mutex
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newBatcher(name string, size int, interval time.Duration,
+	write func(key string, data [][]byte) error) *batcher {
+
+	return &batcher{
+		name:     name,
+		size:     size,
+		interval: interval,
+		write:    write,
+		done:     make(chan struct{}),
+	}
+}
+
+// Start writing partial batches in the background
+func (b *batcher) start() {
+	go b.flusher(b.done)
+}
+
+func (b *batcher) flusher(done <-chan struct{}) {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := b.Flush(); err != nil {
+				Log.Printf("%s flush failed: %s", b.name, err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// Add the items of a message to the buffer and write the buffer if
+// a batch is full. The items are removed from the buffer again if
+// the write fails, the caller is responsible for retrying them.
+func (b *batcher) add(items ...*batchItem) error {
+	b.lock.Lock()
+	b.pending = append(b.pending, items...)
+	full := len(b.pending) >= b.size
+	b.lock.Unlock()
+
+	if !full {
+		return nil
+	}
+
+	err := b.Flush()
+	if err != nil {
+		b.lock.Lock()
+		b.remove(items)
+		b.lock.Unlock()
+	}
+
+	return err
+}
+
+// Get the next batch of items sharing the key of the oldest item
+func (b *batcher) next() []*batchItem {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	n := 0
+	for n < len(b.pending) && n < b.size && b.pending[n].key == b.pending[0].key {
+		n++
+	}
+
+	return append([]*batchItem(nil), b.pending[:n]...)
+}
+
+// Remove items from the buffer. Items may have been removed while a
+// batch was being written, so they are matched by identity rather
+// than by position.
+func (b *batcher) remove(items []*batchItem) {
+	drop := make(map[*batchItem]bool, len(items))
+	for _, it := range items {
+		drop[it] = true
+	}
+
+	var pending []*batchItem
+	for _, it := range b.pending {
+		if !drop[it] {
+			pending = append(pending, it)
+		}
+	}
+	b.pending = pending
+}
+
+// Write all buffered items. Items are kept in the buffer if the
+// write fails and are dropped if the server refuses them.
+func (b *batcher) Flush() error {
+	b.flushLock.Lock()
+	defer b.flushLock.Unlock()
+
+	for {
+		batch := b.next()
+		if len(batch) == 0 {
+			return nil
+		}
+
+		data := make([][]byte, len(batch))
+		for i, it := range batch {
+			data[i] = it.data
+		}
+
+		err := b.write(batch[0].key, data)
+		if _, ok := err.(*permanentError); err != nil && !ok {
+			return err
+		} else if ok {
+			Log.Printf("Dropping %d rejected messages: %s", len(batch), err)
+		}
+
+		b.lock.Lock()
+		b.remove(batch)
+		b.lock.Unlock()
+	}
+}
+
+// Stop the background flusher and write any buffered items
+func (b *batcher) Close() error {
+	b.closeOnce.Do(func() { close(b.done) })
+
+	return b.Flush()
+}
@@ -0,0 +1,271 @@
+/*
+ * SPDX-FileCopyrightText: Copyright 2022 Andreas Sandberg <andreas@sandberg.uk>
+ *
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package hermes
+
+import (
+	"fmt"
+	"math"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Change detection settings for a topic. Messages are only published
+// if a field changed by more than its deadband, if a field matching
+// Always changed, or if nothing has been published for Heartbeat.
+type ChangeFilter struct {
+	// Deadbands as "pattern=value" where value is either an
+	// absolute change (e.g., "grid.voltage=0.5") or a change
+	// relative to the last published value (e.g., "power.*=5%").
+	// Fields without a deadband are published on any change.
+	Deadband []string
+	// Maximum time between messages
+	Heartbeat time.Duration
+	// Fields published on any change regardless of deadbands.
+	// Defaults to the inverter status and error codes.
+	Always []string
+	// Fields that never trigger a message. Defaults to the bus and
+	// hermes statistics, which change on every poll.
+	Ignore []string
+	// Only publish changed fields instead of the whole message.
+	// Lists are published in full if any of their elements
+	// changed.
+	Partial bool
+
+	deadbands []deadband
+	sources   map[string]*changeState
+}
+
+type deadband struct {
+	pattern  string
+	value    float64
+	relative bool
+}
+
+// Last published state of a source
+type changeState struct {
+	values    map[string]interface{}
+	published map[string]time.Time
+	last      time.Time
+}
+
+var (
+	defaultChangeAlways = []string{"status", "error", "grid.status"}
+)
+
+func (cf *ChangeFilter) validate() error {
+	if cf.Always == nil {
+		cf.Always = defaultChangeAlways
+	}
+
+	cf.deadbands = nil
+	for _, d := range cf.Deadband {
+		idx := strings.LastIndex(d, "=")
+		if idx < 0 {
+			return fmt.Errorf("Illegal deadband '%s', expected pattern=value", d)
+		}
+
+		db := deadband{pattern: strings.TrimSpace(d[:idx])}
+		value := strings.TrimSpace(d[idx+1:])
+		if strings.HasSuffix(value, "%") {
+			db.relative = true
+			value = strings.TrimSuffix(value, "%")
+		}
+
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil || v < 0 {
+			return fmt.Errorf("Illegal deadband value in '%s'", d)
+		}
+		db.value = v
+		if db.relative {
+			db.value /= 100
+		}
+
+		cf.deadbands = append(cf.deadbands, db)
+	}
+
+	for _, patterns := range [][]string{cf.Always, cf.Ignore} {
+		for _, p := range patterns {
+			if _, err := path.Match(p, ""); err != nil {
+				return fmt.Errorf("Illegal field pattern '%s'", p)
+			}
+		}
+	}
+	for _, db := range cf.deadbands {
+		if _, err := path.Match(db.pattern, ""); err != nil {
+			return fmt.Errorf("Illegal field pattern '%s'", db.pattern)
+		}
+	}
+
+	return nil
+}
+
+func changeNumber(v interface{}) (float64, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	default:
+		return 0, false
+	}
+}
+
+// Check if a field differs significantly from its last published
+// value
+func (cf *ChangeFilter) changed(field string, old, new interface{}) bool {
+	if matchField(cf.Always, field) {
+		return !reflect.DeepEqual(old, new)
+	}
+
+	o, okOld := changeNumber(old)
+	n, okNew := changeNumber(new)
+	if !okOld || !okNew {
+		return !reflect.DeepEqual(old, new)
+	}
+
+	for _, db := range cf.deadbands {
+		if ok, _ := path.Match(db.pattern, field); !ok {
+			continue
+		}
+
+		band := db.value
+		if db.relative {
+			band *= math.Abs(o)
+		}
+		return math.Abs(n-o) > band
+	}
+
+	return n != o
+}
+
+// Walk the leaves of a message. Lists and maps are traversed, all
+// other values are leaves.
+func changeWalk(v interface{}, field string, fn func(field string, v interface{})) {
+	join := func(k string) string {
+		if field == "" {
+			return k
+		}
+		return field + "." + k
+	}
+
+	switch c := v.(type) {
+	case map[string]interface{}:
+		for k, e := range c {
+			changeWalk(e, join(k), fn)
+		}
+	case []interface{}:
+		for i, e := range c {
+			changeWalk(e, join(strconv.Itoa(i)), fn)
+		}
+	default:
+		fn(field, v)
+	}
+}
+
+// Remove fields that aren't selected from a message. Lists are kept
+// in full if any of their elements are selected.
+func changePrune(v interface{}, field string, keep func(field string) bool) (interface{}, bool) {
+	join := func(k string) string {
+		if field == "" {
+			return k
+		}
+		return field + "." + k
+	}
+
+	switch c := v.(type) {
+	case map[string]interface{}:
+		out := map[string]interface{}{}
+		for k, e := range c {
+			if pruned, ok := changePrune(e, join(k), keep); ok {
+				out[k] = pruned
+			}
+		}
+		return out, len(out) > 0
+
+	case []interface{}:
+		for i, e := range c {
+			if _, ok := changePrune(e, join(strconv.Itoa(i)), keep); ok {
+				return c, true
+			}
+		}
+		return nil, false
+
+	default:
+		return v, keep(field)
+	}
+}
+
+// Filter a message. Returns nil if nothing should be published. The
+// returned function must be called once the message has been
+// published to update the published state.
+func (cf *ChangeFilter) filter(m *Message) (*Message, func()) {
+	if cf.sources == nil {
+		cf.sources = map[string]*changeState{}
+	}
+
+	st, ok := cf.sources[m.Source]
+	if !ok {
+		st = &changeState{
+			values:    map[string]interface{}{},
+			published: map[string]time.Time{},
+		}
+	}
+
+	heartbeat := func(t time.Time) bool {
+		return cf.Heartbeat > 0 && m.When.Sub(t) >= cf.Heartbeat
+	}
+
+	// Fields that changed and whether any of them warrant a message
+	changed := map[string]bool{}
+	trigger := false
+	changeWalk(m.Message, "", func(field string, v interface{}) {
+		old, seen := st.values[field]
+		ignored := matchField(cf.Ignore, field) && !matchField(cf.Always, field)
+		switch {
+		case !seen:
+			trigger = true
+		case cf.changed(field, old, v):
+			trigger = trigger || !ignored
+		case cf.Partial && heartbeat(st.published[field]):
+			trigger = true
+		default:
+			return
+		}
+		changed[field] = true
+	})
+
+	if !trigger && (cf.Partial || !heartbeat(st.last)) {
+		return nil, nil
+	}
+
+	out := m
+	if cf.Partial {
+		msg, _ := changePrune(m.Message, "", func(field string) bool {
+			return changed[field]
+		})
+		pruned := *m
+		pruned.Message = msg.(map[string]interface{})
+		out = &pruned
+	}
+
+	commit := func() {
+		cf.sources[m.Source] = st
+		st.last = m.When
+		changeWalk(out.Message, "", func(field string, v interface{}) {
+			st.values[field] = v
+			st.published[field] = m.When
+		})
+	}
+
+	return out, commit
+}
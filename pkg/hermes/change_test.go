@@ -0,0 +1,132 @@
+/*
+ * SPDX-FileCopyrightText: Copyright 2022 Andreas Sandberg <andreas@sandberg.uk>
+ *
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package hermes
+
+import (
+	"testing"
+	"time"
+)
+
+func changeMessage(when time.Time, status uint, voltage, power float64, frames int) *Message {
+	return &Message{
+		When:   when,
+		Source: "1",
+		Message: map[string]interface{}{
+			"status": status,
+			"grid": map[string]interface{}{
+				"voltage": voltage,
+			},
+			"inputs": []interface{}{
+				map[string]interface{}{"power": power},
+			},
+			"bus": map[string]interface{}{
+				"frames": frames,
+			},
+		},
+	}
+}
+
+func TestChangeFilter(t *testing.T) {
+	cf := &ChangeFilter{
+		Deadband:  []string{"grid.voltage=0.5", "inputs.*.power=10%"},
+		Heartbeat: 10 * time.Minute,
+		Ignore:    []string{"bus.*"},
+	}
+	if err := cf.validate(); err != nil {
+		t.Fatal("Validation failed: ", err)
+	}
+
+	start := time.Unix(1600000000, 0)
+	tests := []struct {
+		name    string
+		m       *Message
+		publish bool
+	}{
+		{"first", changeMessage(start, 3, 230, 100, 1), true},
+		{"unchanged", changeMessage(start.Add(time.Minute), 3, 230, 100, 2), false},
+		{"in deadband", changeMessage(start.Add(2*time.Minute), 3, 230.4, 109, 3), false},
+		{"voltage", changeMessage(start.Add(3*time.Minute), 3, 230.6, 100, 4), true},
+		{"relative", changeMessage(start.Add(4*time.Minute), 3, 230.6, 111, 5), true},
+		{"status", changeMessage(start.Add(5*time.Minute), 4, 230.6, 111, 6), true},
+		{"quiet", changeMessage(start.Add(14*time.Minute), 4, 230.6, 111, 7), false},
+		{"heartbeat", changeMessage(start.Add(15*time.Minute), 4, 230.6, 111, 8), true},
+	}
+
+	for _, test := range tests {
+		out, commit := cf.filter(test.m)
+		if (out != nil) != test.publish {
+			t.Errorf("%s: expected publish %v", test.name, test.publish)
+		}
+		if out != nil {
+			commit()
+		}
+	}
+
+	// Unpublished messages don't update the baseline
+	cf = &ChangeFilter{}
+	cf.validate()
+	if out, _ := cf.filter(changeMessage(start, 3, 230, 100, 1)); out == nil {
+		t.Fatal("First message not published")
+	}
+	if out, _ := cf.filter(changeMessage(start, 3, 230, 100, 1)); out == nil {
+		t.Error("Message not published after failed send")
+	}
+}
+
+func TestChangeFilterPartial(t *testing.T) {
+	cf := &ChangeFilter{
+		Heartbeat: 10 * time.Minute,
+		Partial:   true,
+		Ignore:    []string{"bus.*"},
+	}
+	if err := cf.validate(); err != nil {
+		t.Fatal("Validation failed: ", err)
+	}
+
+	start := time.Unix(1600000000, 0)
+	out, commit := cf.filter(changeMessage(start, 3, 230, 100, 1))
+	if out == nil || len(out.Message) != 4 {
+		t.Fatalf("Unexpected first message %v", out)
+	}
+	commit()
+
+	out, commit = cf.filter(changeMessage(start.Add(time.Minute), 3, 231, 100, 2))
+	if out == nil {
+		t.Fatal("Changed message not published")
+	}
+	commit()
+	if len(out.Message) != 2 || out.Message["grid"] == nil || out.Message["bus"] == nil {
+		t.Errorf("Unexpected partial message %v", out.Message)
+	}
+
+	out, commit = cf.filter(changeMessage(start.Add(2*time.Minute), 3, 231, 101, 2))
+	if out == nil {
+		t.Fatal("Changed input not published")
+	}
+	commit()
+	if inputs, ok := out.Message["inputs"].([]interface{}); !ok || len(inputs) != 1 {
+		t.Errorf("Expected complete input list, got %v", out.Message)
+	}
+
+	if out, _ := cf.filter(changeMessage(start.Add(3*time.Minute), 3, 231, 101, 3)); out != nil {
+		t.Errorf("Ignored field triggered message %v", out.Message)
+	}
+
+	out, _ = cf.filter(changeMessage(start.Add(10*time.Minute+30*time.Second), 3, 231, 101, 2))
+	if out == nil || out.Message["status"] == nil || out.Message["grid"] != nil {
+		t.Errorf("Unexpected heartbeat message %v", out)
+	}
+}
+
+func TestChangeFilterConfig(t *testing.T) {
+	for _, d := range []string{"grid.voltage", "grid.voltage=x", "power=-1", "[=1"} {
+		cf := &ChangeFilter{Deadband: []string{d}}
+		if err := cf.validate(); err == nil {
+			t.Errorf("Deadband '%s' accepted", d)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+/*
+ * SPDX-FileCopyrightText: Copyright 2022 Andreas Sandberg <andreas@sandberg.uk>
+ *
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package hermes
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	CommandSignatureError = errors.New("Invalid command signature")
+	CommandExpiredError   = errors.New("Command expired")
+	CommandReplayError    = errors.New("Command replayed")
+	CommandDeviceError    = errors.New("Command device doesn't match topic")
+)
+
+// Command received from a backend
+type Command struct {
+	// Request ID chosen by the sender, copied to the response
+	ID string
+	// Identity of the device the command targets. May be empty.
+	Source string
+	Name   string
+	Args   map[string]interface{}
+	// Time the command was issued, zero if not specified
+	When time.Time
+	// Description of where the command came from
+	Origin string
+	// The command must not be started after this time (e.g.,
+	// because the sender stopped waiting for a response). Zero if
+	// the command doesn't expire.
+	Deadline time.Time
+
+	// Reason the backend rejected the command (e.g., an invalid
+	// signature). Rejected commands are still delivered to make
+	// it possible to audit them.
+	Err error
+
+	reply func(r *CommandResponse) error
+
+	lock      sync.Mutex
+	started   bool
+	cancelled bool
+}
+
+// Response to a command
+type CommandResponse struct {
+	ID      string                 `json:"id,omitempty"`
+	Device  string                 `json:"device,omitempty"`
+	Command string                 `json:"command"`
+	Success bool                   `json:"success"`
+	Error   string                 `json:"error,omitempty"`
+	Time    time.Time              `json:"time"`
+	Result  map[string]interface{} `json:"result,omitempty"`
+}
+
+// Backends that can receive commands implement this interface.
+type Receiver interface {
+	// Start delivering commands to a handler. The handler may be
+	// called from any goroutine.
+	Subscribe(handler func(c *Command)) error
+}
+
+// Mark a command as being executed. Fails if the command has
+// expired or has been cancelled by the backend that received it.
+func (c *Command) Start() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.cancelled || !c.Deadline.IsZero() && time.Now().After(c.Deadline) {
+		return CommandExpiredError
+	}
+	c.started = true
+
+	return nil
+}
+
+// Prevent a command from being started. Returns false if the command
+// has already been started.
+func (c *Command) cancel() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.started {
+		return false
+	}
+	c.cancelled = true
+
+	return true
+}
+
+// Send the result of a command to the backend that received it.
+func (c *Command) Reply(result map[string]interface{}, err error) error {
+	if c.reply == nil {
+		return nil
+	}
+
+	r := CommandResponse{
+		ID:      c.ID,
+		Device:  c.Source,
+		Command: c.Name,
+		Success: err == nil,
+		Time:    time.Now(),
+		Result:  result,
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+
+	return c.reply(&r)
+}
+
+// Command authentication settings shared by all receivers
+type CommandAuth struct {
+	// Shared secret used to sign commands with HMAC-SHA256. Signed
+	// commands are required if a key is set.
+	Key     string `mapstructure:"command_key"`
+	KeyFile string `mapstructure:"command_key_file"`
+	// Maximum age of signed commands
+	MaxAge time.Duration `mapstructure:"command_max_age"`
+}
+
+// Wire format of commands:
+//
+//	{"request": {"id": "1", "device": "1", "command": "grid_off",
+//	             "args": {}, "timestamp": 1654084800},
+//	 "hmac": "<hex encoded HMAC-SHA256 of the request>"}
+//
+// The signature covers the raw bytes of the request object to avoid
+// depending on a canonical JSON encoding.
+type commandEnvelope struct {
+	Request json.RawMessage `json:"request"`
+	HMAC    string          `json:"hmac"`
+}
+
+type commandRequest struct {
+	ID        string                 `json:"id"`
+	Device    string                 `json:"device"`
+	Command   string                 `json:"command"`
+	Args      map[string]interface{} `json:"args"`
+	Timestamp int64                  `json:"timestamp"`
+}
+
+// Command parser that verifies signatures and rejects replayed
+// commands
+type commandVerifier struct {
+	key    []byte
+	maxAge time.Duration
+
+	lock sync.Mutex
+	seen map[string]time.Time
+}
+
+func (ca *CommandAuth) verifier(basePath string) (*commandVerifier, error) {
+	cv := &commandVerifier{
+		maxAge: ca.MaxAge,
+		seen:   map[string]time.Time{},
+	}
+
+	if cv.maxAge <= 0 {
+		cv.maxAge = time.Minute
+	}
+
+	key, err := readSecret(basePath, ca.Key, ca.KeyFile, "")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read command key: %s", err)
+	}
+	if key != "" {
+		cv.key = []byte(key)
+	}
+
+	return cv, nil
+}
+
+// Parse a command. The returned command has Err set if it was
+// parsed but failed verification.
+func (cv *commandVerifier) parse(payload []byte, now time.Time) (*Command, error) {
+	var env commandEnvelope
+	if err := json.Unmarshal(payload, &env); err != nil {
+		return nil, fmt.Errorf("Malformed command: %s", err)
+	}
+
+	var req commandRequest
+	if err := json.Unmarshal(env.Request, &req); err != nil {
+		return nil, fmt.Errorf("Malformed command request: %s", err)
+	}
+
+	c := &Command{
+		ID:     req.ID,
+		Source: req.Device,
+		Name:   req.Command,
+		Args:   req.Args,
+	}
+	if req.Timestamp != 0 {
+		c.When = time.Unix(req.Timestamp, 0)
+	}
+
+	if c.Name == "" {
+		return nil, fmt.Errorf("Malformed command request: missing command")
+	}
+
+	c.Err = cv.verify(&env, c, now)
+
+	return c, nil
+}
+
+func (cv *commandVerifier) verify(env *commandEnvelope, c *Command, now time.Time) error {
+	if cv.key == nil {
+		return nil
+	}
+
+	sig, err := hex.DecodeString(env.HMAC)
+	if err != nil {
+		return CommandSignatureError
+	}
+
+	mac := hmac.New(sha256.New, cv.key)
+	mac.Write(env.Request)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return CommandSignatureError
+	}
+
+	// Signed commands must be fresh to limit replay attacks
+	if c.When.IsZero() || now.Sub(c.When) > cv.maxAge || c.When.Sub(now) > cv.maxAge {
+		return CommandExpiredError
+	}
+
+	cv.lock.Lock()
+	defer cv.lock.Unlock()
+
+	for k, t := range cv.seen {
+		if now.Sub(t) > 2*cv.maxAge {
+			delete(cv.seen, k)
+		}
+	}
+
+	// Use the normalized signature, hex decoding is case
+	// insensitive
+	key := hex.EncodeToString(sig)
+	if _, ok := cv.seen[key]; ok {
+		return CommandReplayError
+	}
+	cv.seen[key] = now
+
+	return nil
+}
+
+// Sign a command request. Returns a payload suitable for sending to
+// a receiver.
+func SignCommand(key []byte, request []byte) ([]byte, error) {
+	env := commandEnvelope{
+		Request: json.RawMessage(request),
+	}
+
+	if key != nil {
+		mac := hmac.New(sha256.New, key)
+		mac.Write(request)
+		env.HMAC = hex.EncodeToString(mac.Sum(nil))
+	}
+
+	return json.Marshal(&env)
+}
@@ -0,0 +1,80 @@
+/*
+ * SPDX-FileCopyrightText: Copyright 2022 Andreas Sandberg <andreas@sandberg.uk>
+ *
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package hermes
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestCommandParse(t *testing.T) {
+	now := time.Unix(1654084800, 0)
+	cv, err := (&CommandAuth{}).verifier("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload, _ := SignCommand(nil,
+		[]byte(`{"id":"1","device":"2","command":"refresh","args":{"x":1}}`))
+	c, err := cv.parse(payload, now)
+	if err != nil {
+		t.Fatal("Parse failed: ", err)
+	}
+
+	if c.ID != "1" || c.Source != "2" || c.Name != "refresh" ||
+		c.Args["x"] != 1.0 || c.Err != nil {
+
+		t.Errorf("Unexpected command %+v", c)
+	}
+
+	for _, p := range []string{`{`, `{"request":{}}`, `{"request":[]}`} {
+		if _, err := cv.parse([]byte(p), now); err == nil {
+			t.Errorf("Malformed command '%s' accepted", p)
+		}
+	}
+}
+
+func TestCommandSignature(t *testing.T) {
+	key := []byte("secret")
+	now := time.Unix(1654084800, 0)
+	cv, err := (&CommandAuth{Key: "secret"}).verifier("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(ts int64) []byte {
+		return []byte(fmt.Sprintf(`{"command":"grid_off","timestamp":%d}`, ts))
+	}
+
+	tests := []struct {
+		key     []byte
+		request []byte
+		err     error
+	}{
+		{key, request(now.Unix()), nil},
+		// Replayed
+		{key, request(now.Unix()), CommandReplayError},
+		{key, request(now.Unix() - 1), nil},
+		{[]byte("wrong"), request(now.Unix()), CommandSignatureError},
+		{nil, request(now.Unix()), CommandSignatureError},
+		{key, request(now.Unix() - 120), CommandExpiredError},
+		{key, []byte(`{"command":"grid_off"}`), CommandExpiredError},
+	}
+
+	for i, test := range tests {
+		payload, _ := SignCommand(test.key, test.request)
+		c, err := cv.parse(payload, now)
+		if err != nil {
+			t.Fatalf("%d: Parse failed: %s", i, err)
+		}
+
+		if c.Err != test.err {
+			t.Errorf("%d: Got error %v; want %v", i, c.Err, test.err)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+/*
+ * SPDX-FileCopyrightText: Copyright 2019, 2022 Andreas Sandberg <andreas@sandberg.uk>
+ *
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package hermes
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"crypto/tls"
+	"crypto/x509"
+
+	"path/filepath"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/viper"
+)
+
+// TLS settings shared by all backends
+type TLSConfig struct {
+	AuthCert string   `mapstructure:"auth_cert"`
+	AuthKey  string   `mapstructure:"auth_key"`
+	CaCerts  []string `mapstructure:"ca_certs"`
+	// Server name used to verify the server certificate. Defaults
+	// to the host name in the URL.
+	ServerName string `mapstructure:"server_name"`
+	// Minimum TLS version ("1.0", "1.1", "1.2" or "1.3")
+	MinVersion string `mapstructure:"min_tls_version"`
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Create a decode hook that creates message formatters either from
+// a string naming the formatter or from a map with formatter
+// settings. Files referenced by formatters are resolved relative to
+// basePath.
+func messageFormatterHook(basePath string) mapstructure.DecodeHookFuncType {
+	return func(from reflect.Type, to reflect.Type,
+		data interface{}) (interface{}, error) {
+
+		fmtType := reflect.TypeOf((*MessageFormatter)(nil)).Elem()
+		if !to.Implements(fmtType) {
+			return data, nil
+		}
+
+		switch raw := data.(type) {
+		case string:
+			return createFormatter(raw)
+		case map[string]interface{}:
+			return createFormatterMap(raw, basePath)
+		default:
+			return data, nil
+		}
+	}
+}
+
+// Decode hooks used when unmarshalling backend configurations
+func decodeHooks(basePath string) viper.DecoderConfigOption {
+	return viper.DecodeHook(
+		mapstructure.ComposeDecodeHookFunc(
+			mapstructure.StringToTimeDurationHookFunc(),
+			mapstructure.StringToSliceHookFunc(","),
+			messageFormatterHook(basePath),
+		))
+}
+
+// Resolve a path relative to the configuration directory.
+func resolvePath(basePath, name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	} else {
+		return filepath.Join(basePath, name)
+	}
+}
+
+// Get the base path used to resolve relative paths. Files are
+// resolved relative to the current working directory if the base
+// path isn't set.
+func defaultBasePath(basePath string) (string, error) {
+	if basePath != "" {
+		return basePath, nil
+	}
+
+	return os.Getwd()
+}
+
+// Read a secret from a file or an environment variable. A secret
+// specified directly in the configuration takes precedence. Trailing
+// white space is removed from secrets read from files.
+func readSecret(basePath, value, file, env string) (string, error) {
+	switch {
+	case value != "":
+		return value, nil
+
+	case file != "":
+		raw, err := os.ReadFile(resolvePath(basePath, file))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(raw), "\r\n\t "), nil
+
+	case env != "":
+		v, ok := os.LookupEnv(env)
+		if !ok {
+			return "", fmt.Errorf("Environment variable '%s' not set", env)
+		}
+		return v, nil
+
+	default:
+		return "", nil
+	}
+}
+
+// Create a TLS configuration. Relative file names are resolved
+// relative to basePath.
+func (tc *TLSConfig) Config(basePath string) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName: tc.ServerName,
+	}
+
+	if tc.MinVersion != "" {
+		v, ok := tlsVersions[tc.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("Unsupported TLS version '%s'", tc.MinVersion)
+		}
+		config.MinVersion = v
+	}
+
+	/* Setup TLS authentication using client ceritficates */
+	if tc.AuthCert != "" || tc.AuthKey != "" {
+		if tc.AuthCert == "" || tc.AuthKey == "" {
+			return nil, fmt.Errorf("Public key authentication requires both a certificate and key")
+		}
+
+		cert, err := tls.LoadX509KeyPair(
+			resolvePath(basePath, tc.AuthCert),
+			resolvePath(basePath, tc.AuthKey))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load client certificate: %s", err)
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	/* Setup user-provided CA certificates. Use the system's CA
+	 * pool if no CA certificates provided.
+	 */
+	if tc.CaCerts == nil {
+		ca_pool, err := x509.SystemCertPool()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load system CA pool: %s", err)
+		}
+		config.RootCAs = ca_pool
+	} else {
+		config.RootCAs = x509.NewCertPool()
+	}
+
+	for _, value := range tc.CaCerts {
+		pem, err := os.ReadFile(resolvePath(basePath, value))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load CA cert: %s", err)
+		}
+
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("Failed to add CA '%s' to pool", value)
+		}
+	}
+
+	return config, nil
+}
@@ -0,0 +1,448 @@
+/*
+ * SPDX-FileCopyrightText: Copyright 2022 Andreas Sandberg <andreas@sandberg.uk>
+ *
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package hermes
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// File formats supported by the file backend
+const (
+	FileFormatCSV   = "csv"
+	FileFormatJSONL = "jsonl"
+)
+
+type FileLogConfig struct {
+	basePath string
+
+	// File name template. Relative paths are resolved relative to
+	// the configuration file. Supported placeholders:
+	//   {device} - Identity of the message source
+	//   {date}   - Date of the message (2006-01-02)
+	//   {year}, {month}, {day} - Parts of the date
+	// Files rotate daily if the name contains the date.
+	Path string
+	// File format, csv or jsonl
+	Format string
+	// Fields written to CSV files. Each row starts with the time
+	// and the device.
+	Fields []string
+
+	// Rotate files when they grow beyond this size in bytes
+	MaxSize int64 `mapstructure:"max_size"`
+	// Compress rotated files using gzip
+	Compress bool
+	// Flush every record to disk. Files are always flushed when
+	// they are rotated or closed.
+	Sync bool
+}
+
+// An open log file
+type logFile struct {
+	name string
+	file *os.File
+	size int64
+}
+
+// Backend appending messages to local files
+type FileLog struct {
+	config *FileLogConfig
+	json   *JSONFormatter
+
+	// Open files indexed by name
+	files map[string]*logFile
+	// Name of the file each device writes to
+	current map[string]string
+}
+
+func fileLogCreateViper(subv *viper.Viper, basePath string) (Backend, error) {
+	cfg := FileLogConfig{
+		basePath: basePath,
+	}
+
+	if err := subv.Unmarshal(&cfg, decodeHooks(basePath)); err != nil {
+		return nil, err
+	}
+
+	return cfg.Create()
+}
+
+func init() {
+	Backends["file"] = BackendFactory{
+		CreateViper: fileLogCreateViper,
+	}
+}
+
+func (fc *FileLogConfig) Create() (*FileLog, error) {
+	if bp, err := defaultBasePath(fc.basePath); err == nil {
+		fc.basePath = bp
+	} else {
+		return nil, err
+	}
+
+	if fc.Format == "" {
+		fc.Format = FileFormatJSONL
+	}
+
+	switch fc.Format {
+	case FileFormatCSV:
+		if len(fc.Fields) == 0 {
+			return nil, fmt.Errorf("CSV files require a list of fields")
+		}
+	case FileFormatJSONL:
+	default:
+		return nil, fmt.Errorf("Illegal file format '%s'", fc.Format)
+	}
+
+	if fc.Path == "" {
+		return nil, fmt.Errorf("File path not specified")
+	}
+
+	return &FileLog{
+		config:  fc,
+		json:    &JSONFormatter{Envelope: true},
+		files:   map[string]*logFile{},
+		current: map[string]string{},
+	}, nil
+}
+
+func (fl *FileLog) Connect() error {
+	return nil
+}
+
+// Get the name of the file a message is written to
+func (fl *FileLog) fileName(m *Message) string {
+	t := m.When.Local()
+	device := m.Source
+	if device == "" {
+		device = "unknown"
+	}
+
+	name := strings.NewReplacer(
+		"{device}", strings.ReplaceAll(device, string(filepath.Separator), "_"),
+		"{date}", t.Format("2006-01-02"),
+		"{year}", t.Format("2006"),
+		"{month}", t.Format("01"),
+		"{day}", t.Format("02"),
+	).Replace(fl.config.Path)
+
+	return resolvePath(fl.config.basePath, name)
+}
+
+func (fl *FileLog) header() []byte {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(append([]string{"time", "device"}, fl.config.Fields...))
+	w.Flush()
+
+	return buf.Bytes()
+}
+
+func fileLogValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case map[string]interface{}, []interface{}:
+		raw, _ := json.Marshal(v)
+		return string(raw)
+	case float64:
+		// Never use exponents, spreadsheets don't expect them
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// Format a message as a single record
+func (fl *FileLog) record(m *Message) ([]byte, error) {
+	if fl.config.Format == FileFormatJSONL {
+		fms, err := fl.json.FormatMessage(m)
+		if err != nil {
+			return nil, err
+		}
+		return append(fms[0].Message, '\n'), nil
+	}
+
+	row := []string{m.When.Format(time.RFC3339), m.Source}
+	for _, f := range fl.config.Fields {
+		v, _ := Lookup(m.Message, f)
+		row = append(row, fileLogValue(v))
+	}
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(row)
+	w.Flush()
+
+	return buf.Bytes(), w.Error()
+}
+
+// Open a log file for appending. A record that was only partially
+// written before a crash is terminated to avoid corrupting the next
+// record.
+func openLogFile(name string) (*logFile, error) {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	lf := &logFile{
+		name: name,
+		file: f,
+		size: info.Size(),
+	}
+
+	if lf.size > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, lf.size-1); err == nil && last[0] != '\n' {
+			if err := lf.write([]byte("\n")); err != nil {
+				f.Close()
+				return nil, err
+			}
+		}
+	}
+
+	return lf, nil
+}
+
+// Open a log file and write the CSV header to new files
+func (fl *FileLog) open(name string) (*logFile, error) {
+	lf, err := openLogFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if lf.size == 0 && fl.config.Format == FileFormatCSV {
+		if err := lf.write(fl.header()); err != nil {
+			lf.file.Close()
+			return nil, err
+		}
+	}
+
+	return lf, nil
+}
+
+func (lf *logFile) write(data []byte) error {
+	n, err := lf.file.Write(data)
+	lf.size += int64(n)
+
+	return err
+}
+
+// Flush a file to disk and close it
+func (lf *logFile) close() error {
+	err := lf.file.Sync()
+	if cerr := lf.file.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// Find an unused name for a file rotated due to its size, e.g.,
+// "log.csv" becomes "log.1.csv".
+func rotatedName(name string) string {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		n := fmt.Sprintf("%s.%d%s", base, i, ext)
+		_, err := os.Stat(n)
+		_, gzErr := os.Stat(n + ".gz")
+		if os.IsNotExist(err) && os.IsNotExist(gzErr) {
+			return n
+		}
+	}
+}
+
+// Compress a file. The compressed file is written to a temporary
+// file and renamed once it is complete to make sure that a crash
+// never leaves a truncated file behind. The file is appended as a
+// new gzip member if a compressed file already exists (e.g., if
+// late messages were written to a file after it was rotated).
+func compressFile(name string) error {
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := name + ".gz.tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	if prev, err := os.Open(name + ".gz"); err == nil {
+		_, err = io.Copy(out, prev)
+		prev.Close()
+		if err != nil {
+			out.Close()
+			return err
+		}
+	}
+
+	zw := gzip.NewWriter(out)
+	zw.Name = filepath.Base(name)
+	_, err = io.Copy(zw, in)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, name+".gz"); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(name))
+
+	return os.Remove(name)
+}
+
+// Flush a directory to disk to make renames durable
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// Close a file that is no longer written to
+func (fl *FileLog) rotate(lf *logFile, rename bool) error {
+	if err := lf.close(); err != nil {
+		return err
+	}
+
+	name := lf.name
+	if rename {
+		name = rotatedName(lf.name)
+		if err := os.Rename(lf.name, name); err != nil {
+			return err
+		}
+		syncDir(filepath.Dir(name))
+	}
+
+	if fl.config.Compress {
+		if err := compressFile(name); err != nil {
+			return fmt.Errorf("Failed to compress '%s': %s", name, err)
+		}
+	}
+
+	return nil
+}
+
+// Check if any device writes to a file
+func (fl *FileLog) inUse(name string) bool {
+	for _, n := range fl.current {
+		if n == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Close and rotate an open file
+func (fl *FileLog) close(name string, rename bool) {
+	lf, ok := fl.files[name]
+	if !ok {
+		return
+	}
+
+	delete(fl.files, name)
+	if err := fl.rotate(lf, rename); err != nil {
+		Log.Printf("Failed to rotate '%s': %s", name, err)
+	}
+}
+
+func (fl *FileLog) SendMessage(m *Message) error {
+	data, err := fl.record(m)
+	if err != nil {
+		Log.Print("File backend failed to format message: ", err)
+		return nil
+	}
+
+	name := fl.fileName(m)
+	old, ok := fl.current[m.Source]
+	fl.current[m.Source] = name
+	if ok && old != name && !fl.inUse(old) {
+		// The date changed and no other device writes to the
+		// old file
+		fl.close(old, false)
+	}
+
+	lf := fl.files[name]
+	if lf != nil && fl.config.MaxSize > 0 &&
+		lf.size+int64(len(data)) > fl.config.MaxSize {
+
+		fl.close(name, true)
+		lf = nil
+	}
+
+	if lf == nil {
+		if lf, err = fl.open(name); err != nil {
+			return err
+		}
+		fl.files[name] = lf
+	}
+
+	if err := lf.write(data); err != nil {
+		return err
+	}
+
+	if fl.config.Sync {
+		return lf.file.Sync()
+	}
+
+	return nil
+}
+
+// Flush all files to disk and close them
+func (fl *FileLog) Close() error {
+	var err error
+	for name, lf := range fl.files {
+		if cerr := lf.close(); err == nil {
+			err = cerr
+		}
+		delete(fl.files, name)
+	}
+
+	return err
+}
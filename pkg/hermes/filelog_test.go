@@ -0,0 +1,179 @@
+/*
+ * SPDX-FileCopyrightText: Copyright 2022 Andreas Sandberg <andreas@sandberg.uk>
+ *
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package hermes
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func fileLogMessage(when time.Time, voltage float64) *Message {
+	return &Message{
+		When:   when,
+		Source: "1",
+		Message: map[string]interface{}{
+			"model": "Test, \"1\"",
+			"grid":  map[string]interface{}{"voltage": voltage},
+		},
+	}
+}
+
+func readGzip(t *testing.T, name string) string {
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(raw)
+}
+
+func TestFileLogCSV(t *testing.T) {
+	dir := t.TempDir()
+	cfg := FileLogConfig{
+		basePath: dir,
+		Path:     "{device}/{date}.csv",
+		Format:   FileFormatCSV,
+		Fields:   []string{"grid.voltage", "model", "missing"},
+		Compress: true,
+	}
+	fl, err := cfg.Create()
+	if err != nil {
+		t.Fatal("Create failed: ", err)
+	}
+
+	day := time.Date(2022, 6, 1, 12, 0, 0, 0, time.Local)
+	fl.SendMessage(fileLogMessage(day, 230.5))
+	fl.SendMessage(fileLogMessage(day.Add(time.Minute), 231))
+	// The file for the previous day is closed and compressed
+	if err := fl.SendMessage(fileLogMessage(day.Add(24*time.Hour), 232)); err != nil {
+		t.Fatal("SendMessage failed: ", err)
+	}
+	if err := fl.Close(); err != nil {
+		t.Fatal("Close failed: ", err)
+	}
+
+	want := "time,device,grid.voltage,model,missing\n" +
+		day.Format(time.RFC3339) + ",1,230.5,\"Test, \"\"1\"\"\",\n" +
+		day.Add(time.Minute).Format(time.RFC3339) + ",1,231,\"Test, \"\"1\"\"\",\n"
+	if got := readGzip(t, filepath.Join(dir, "1", "2022-06-01.csv.gz")); got != want {
+		t.Errorf("Unexpected file:\n%s\nwant:\n%s", got, want)
+	}
+
+	raw, err := os.ReadFile(filepath.Join(dir, "1", "2022-06-02.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(raw)), "\n"); len(lines) != 2 {
+		t.Errorf("Unexpected file:\n%s", raw)
+	}
+}
+
+func TestFileLogRotateSize(t *testing.T) {
+	dir := t.TempDir()
+	cfg := FileLogConfig{
+		basePath: dir,
+		Path:     "gosolis.jsonl",
+		MaxSize:  300,
+	}
+	fl, err := cfg.Create()
+	if err != nil {
+		t.Fatal("Create failed: ", err)
+	}
+
+	start := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 4; i++ {
+		if err := fl.SendMessage(fileLogMessage(start.Add(time.Duration(i)*time.Minute), 230)); err != nil {
+			t.Fatal("SendMessage failed: ", err)
+		}
+	}
+	fl.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "gosolis*.jsonl"))
+	if len(files) < 2 {
+		t.Fatalf("Expected rotated files, got %v", files)
+	}
+
+	records := 0
+	for _, name := range files {
+		raw, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(raw) > 300 {
+			t.Errorf("File '%s' exceeds the maximum size", name)
+		}
+
+		for _, line := range strings.Split(strings.TrimSpace(string(raw)), "\n") {
+			var env jsonEnvelope
+			if err := json.Unmarshal([]byte(line), &env); err != nil || env.Device != "1" {
+				t.Errorf("Unexpected record '%s'", line)
+			}
+			records++
+		}
+	}
+	if records != 4 {
+		t.Errorf("Got %d records; want 4", records)
+	}
+}
+
+func TestFileLogPartialRecord(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "gosolis.jsonl")
+	if err := os.WriteFile(name, []byte(`{"schema":1,"ti`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := FileLogConfig{basePath: dir, Path: "gosolis.jsonl"}
+	fl, err := cfg.Create()
+	if err != nil {
+		t.Fatal("Create failed: ", err)
+	}
+	fl.SendMessage(fileLogMessage(time.Now(), 230))
+	fl.Close()
+
+	raw, _ := os.ReadFile(name)
+	lines := strings.Split(strings.TrimSpace(string(raw)), "\n")
+	if len(lines) != 2 || !json.Valid([]byte(lines[1])) {
+		t.Errorf("Partial record not terminated:\n%s", raw)
+	}
+}
+
+func TestFileLogValue(t *testing.T) {
+	tests := []struct {
+		v    interface{}
+		want string
+	}{
+		{nil, ""},
+		{12345678.0, "12345678"},
+		{0.000001, "0.000001"},
+		{float32(230.1), "230.1"},
+		{uint64(1 << 63), "9223372036854775808"},
+		{[]interface{}{1, 2}, "[1,2]"},
+	}
+
+	for _, test := range tests {
+		if got := fileLogValue(test.v); got != test.want {
+			t.Errorf("fileLogValue(%v) = %s; want %s", test.v, got, test.want)
+		}
+	}
+}
@@ -7,12 +7,21 @@
 package hermes
 
 import (
+	"encoding"
 	"fmt"
 	"reflect"
+	"strings"
+	"time"
 
 	"encoding/json"
+
+	"github.com/mitchellh/mapstructure"
 )
 
+// Version of the envelope generated by the JSON formatter. Bump this
+// whenever the envelope changes in an incompatible way.
+const EnvelopeSchemaVersion = 1
+
 type MqttMessageType uint
 
 type FormattedMessage struct {
@@ -24,14 +33,117 @@ type MessageFormatter interface {
 	FormatMessage(m *Message) ([]FormattedMessage, error)
 }
 
-type JSONFormatter struct{}
+type JSONFormatter struct {
+	// Wrap messages in an envelope containing a timestamp,
+	// device identity and a schema version
+	Envelope bool
+	// Time stamp format used in the envelope ("rfc3339" or
+	// "epoch_ms")
+	TimeFormat string `mapstructure:"time_format"`
+	// Static tags added to the envelope
+	Tags map[string]string
+}
+
+// Message envelope generated by the JSON formatter. See
+// docs/envelope.schema.json for a JSON schema.
+type jsonEnvelope struct {
+	Schema int                    `json:"schema"`
+	Time   interface{}            `json:"time"`
+	Device string                 `json:"device,omitempty"`
+	Serial string                 `json:"serial,omitempty"`
+	Tags   map[string]string      `json:"tags,omitempty"`
+	Data   map[string]interface{} `json:"data"`
+}
 
 type ValueFormatter struct {
 	// Include UNIX time stamp in messages
-	IncludeUnixTime bool
+	IncludeUnixTime bool `mapstructure:"include_unix_time"`
+
+	// Separator used to join the keys of nested values into a
+	// single path segment. Nested values are published as
+	// separate path segments (sub-topics) if empty.
+	Separator string
+	// Index of the first element in slices and arrays
+	IndexBase int `mapstructure:"index_base"`
+	// Format used to name slice elements, e.g., "input%d".
+	// Defaults to "%d".
+	IndexFormat string `mapstructure:"index_format"`
+}
+
+// Create a formatter from a configuration map. The map must contain
+// a "type" key naming the formatter. Remaining keys are used to
+// configure the formatter. Files are resolved relative to basePath.
+func createFormatterMap(cfg map[string]interface{}, basePath string) (MessageFormatter, error) {
+	name, ok := cfg["type"].(string)
+	if !ok {
+		return nil, fmt.Errorf("Formatter type not specified")
+	}
+
+	f, err := newFormatter(name)
+	if err != nil {
+		return nil, err
+	}
+
+	settings := make(map[string]interface{}, len(cfg))
+	for k, v := range cfg {
+		if k != "type" {
+			settings[k] = v
+		}
+	}
+
+	dec, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			mapstructure.StringToTimeDurationHookFunc(),
+			mapstructure.StringToSliceHookFunc(","),
+		),
+		ErrorUnused:      true,
+		WeaklyTypedInput: true,
+		Result:           f,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := dec.Decode(settings); err != nil {
+		return nil, fmt.Errorf("Illegal '%s' formatter settings: %s", name, err)
+	}
+
+	if l, ok := f.(interface{ load(basePath string) error }); ok {
+		bp, err := defaultBasePath(basePath)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := l.load(bp); err != nil {
+			return nil, err
+		}
+	}
+
+	if v, ok := f.(interface{ validate() error }); ok {
+		if err := v.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	return f, nil
 }
 
+// Create a formatter from its name. Formatters that can't be used
+// without settings (e.g., templates) are rejected.
 func createFormatter(name string) (MessageFormatter, error) {
+	f, err := newFormatter(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := f.(interface{ load(basePath string) error }); ok {
+		return nil, fmt.Errorf("The '%s' formatter requires settings", name)
+	}
+
+	return f, nil
+}
+
+func newFormatter(name string) (MessageFormatter, error) {
 	switch name {
 	case "json":
 		return &JSONFormatter{}, nil
@@ -41,13 +153,61 @@ func createFormatter(name string) (MessageFormatter, error) {
 		return &ValueFormatter{
 			IncludeUnixTime: true,
 		}, nil
+	case "template":
+		return &TemplateFormatter{}, nil
 	default:
 		return nil, fmt.Errorf("Illegal formatter type '%s'", name)
 	}
 }
 
+func (jf *JSONFormatter) validate() error {
+	switch jf.TimeFormat {
+	case "", "rfc3339", "epoch_ms":
+		return nil
+	default:
+		return fmt.Errorf("Illegal time format '%s'", jf.TimeFormat)
+	}
+}
+
+func (jf *JSONFormatter) envelope(msg *Message) *jsonEnvelope {
+	env := jsonEnvelope{
+		Schema: EnvelopeSchemaVersion,
+		Device: msg.Source,
+		Data:   msg.Message,
+	}
+
+	switch jf.TimeFormat {
+	case "epoch_ms":
+		env.Time = msg.When.UnixNano() / int64(time.Millisecond)
+	default:
+		env.Time = msg.When.Format(time.RFC3339Nano)
+	}
+
+	if len(jf.Tags)+len(msg.Labels) > 0 {
+		env.Tags = make(map[string]string, len(jf.Tags)+len(msg.Labels))
+	}
+	for k, v := range msg.Labels {
+		if k == "serial" {
+			env.Serial = v
+		} else {
+			env.Tags[k] = v
+		}
+	}
+	// Static tags take precedence over labels from the source
+	for k, v := range jf.Tags {
+		env.Tags[k] = v
+	}
+
+	return &env
+}
+
 func (jf *JSONFormatter) FormatMessage(msg *Message) ([]FormattedMessage, error) {
-	if msg, err := json.Marshal(msg.Message); err == nil {
+	var payload interface{} = msg.Message
+	if jf.Envelope {
+		payload = jf.envelope(msg)
+	}
+
+	if msg, err := json.Marshal(payload); err == nil {
 		return []FormattedMessage{
 			FormattedMessage{
 				Path:    nil,
@@ -59,15 +219,33 @@ func (jf *JSONFormatter) FormatMessage(msg *Message) ([]FormattedMessage, error)
 	}
 }
 
-func (vf *ValueFormatter) formatValue(msg *Message, v interface{}) []byte {
-	st := reflect.TypeOf(v)
+func (vf *ValueFormatter) validate() error {
+	// Format a test index to catch missing, extra or unsuitable
+	// verbs (e.g., "input%s")
+	if vf.IndexFormat != "" && strings.Contains(fmt.Sprintf(vf.IndexFormat, 0), "%!") {
+		return fmt.Errorf("Illegal index format '%s'", vf.IndexFormat)
+	}
+
+	return nil
+}
 
+func (vf *ValueFormatter) formatValue(msg *Message, v interface{}) []byte {
 	prefix := ""
 	if vf.IncludeUnixTime {
 		prefix = fmt.Sprintf("%s%d ", prefix, msg.When.Unix())
 	}
 
-	switch st.Kind() {
+	switch v := v.(type) {
+	case encoding.TextMarshaler:
+		if text, err := v.MarshalText(); err == nil {
+			return []byte(prefix + string(text))
+		}
+		return nil
+	case fmt.Stringer:
+		return []byte(prefix + v.String())
+	}
+
+	switch reflect.TypeOf(v).Kind() {
 	case reflect.Bool,
 		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
 		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
@@ -76,9 +254,6 @@ func (vf *ValueFormatter) formatValue(msg *Message, v interface{}) []byte {
 		reflect.String:
 		return []byte(fmt.Sprintf("%s%v", prefix, v))
 
-	case reflect.Slice, reflect.Array, reflect.Map:
-		return nil
-
 	default:
 		return nil
 	}
@@ -86,16 +261,26 @@ func (vf *ValueFormatter) formatValue(msg *Message, v interface{}) []byte {
 
 func (vf *ValueFormatter) FormatMessage(msg *Message) ([]FormattedMessage, error) {
 	fms := make([]FormattedMessage, 0, len(msg.Message))
+	opts := walkOptions{
+		IndexBase:   vf.IndexBase,
+		IndexFormat: vf.IndexFormat,
+	}
 
-	for k, v := range msg.Message {
-		if v := vf.formatValue(msg, v); v != nil {
-			fm := FormattedMessage{
-				Path:    []string{k},
-				Message: v,
-			}
-			fms = append(fms, fm)
+	walkLeaves(msg.Message, &opts, func(path []string, v interface{}) {
+		value := vf.formatValue(msg, v)
+		if value == nil {
+			return
 		}
-	}
+
+		if vf.Separator != "" {
+			path = []string{strings.Join(path, vf.Separator)}
+		}
+
+		fms = append(fms, FormattedMessage{
+			Path:    path,
+			Message: value,
+		})
+	})
 
 	return fms, nil
 }
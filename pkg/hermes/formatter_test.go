@@ -0,0 +1,190 @@
+/*
+ * SPDX-FileCopyrightText: Copyright 2022 Andreas Sandberg <andreas@sandberg.uk>
+ *
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package hermes
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testMessage = Message{
+	When:   time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC),
+	Source: "1",
+	Labels: map[string]string{
+		"serial": "0807060504030201",
+		"model":  "Test",
+	},
+	Message: map[string]interface{}{
+		"temperature": 47.6,
+	},
+}
+
+func formatJSON(t *testing.T, f MessageFormatter, m *Message) map[string]interface{} {
+	fms, err := f.FormatMessage(m)
+	if err != nil {
+		t.Fatal("FormatMessage failed: ", err)
+	}
+
+	if len(fms) != 1 || fms[0].Path != nil {
+		t.Fatalf("Unexpected formatted messages: %v", fms)
+	}
+
+	var out map[string]interface{}
+	if err := json.Unmarshal(fms[0].Message, &out); err != nil {
+		t.Fatal("Invalid JSON: ", err)
+	}
+
+	return out
+}
+
+func TestJSONFormatter(t *testing.T) {
+	out := formatJSON(t, &JSONFormatter{}, &testMessage)
+	if !reflect.DeepEqual(out, testMessage.Message) {
+		t.Errorf("Unexpected message %v", out)
+	}
+}
+
+func TestJSONEnvelope(t *testing.T) {
+	f, err := createFormatterMap(map[string]interface{}{
+		"type":     "json",
+		"envelope": true,
+		"tags":     map[string]interface{}{"site": "home"},
+	}, "")
+	if err != nil {
+		t.Fatal("createFormatterMap failed: ", err)
+	}
+
+	expected := map[string]interface{}{
+		"schema": float64(EnvelopeSchemaVersion),
+		"time":   "2022-06-01T12:00:00Z",
+		"device": "1",
+		"serial": "0807060504030201",
+		"tags": map[string]interface{}{
+			"site":  "home",
+			"model": "Test",
+		},
+		"data": testMessage.Message,
+	}
+
+	if out := formatJSON(t, f, &testMessage); !reflect.DeepEqual(out, expected) {
+		t.Errorf("Unexpected envelope %v; want %v", out, expected)
+	}
+
+	f = &JSONFormatter{Envelope: true, TimeFormat: "epoch_ms"}
+	out := formatJSON(t, f, &testMessage)
+	if out["time"] != float64(testMessage.When.Unix()*1000) {
+		t.Errorf("Unexpected time stamp %v", out["time"])
+	}
+}
+
+func TestCreateFormatterMapErrors(t *testing.T) {
+	bad := []map[string]interface{}{
+		{},
+		{"type": "invalid"},
+		{"type": "json", "unknown": 1},
+		{"type": "json", "time_format": "invalid"},
+		{"type": "value", "index_format": "input"},
+		{"type": "value", "index_format": "input%s"},
+		{"type": "value", "index_format": "%d_%d"},
+	}
+
+	for _, cfg := range bad {
+		if _, err := createFormatterMap(cfg, ""); err == nil {
+			t.Errorf("createFormatterMap(%v) didn't fail", cfg)
+		}
+	}
+}
+
+func TestCreateFormatter(t *testing.T) {
+	for _, name := range []string{"json", "value", "time-value"} {
+		if _, err := createFormatter(name); err != nil {
+			t.Errorf("createFormatter(%s) failed: %s", name, err)
+		}
+	}
+
+	// Templates can't be used without a template
+	for _, name := range []string{"template", "invalid"} {
+		if _, err := createFormatter(name); err == nil {
+			t.Errorf("createFormatter(%s) didn't fail", name)
+		}
+	}
+}
+
+type testSerial [2]byte
+
+func (s testSerial) String() string {
+	return "AB"
+}
+
+func TestValueFormatter(t *testing.T) {
+	m := Message{
+		When: testMessage.When,
+		Message: map[string]interface{}{
+			"temperature": 47.6,
+			"serial":      testSerial{1, 2},
+			"inputs": []interface{}{
+				map[string]interface{}{"voltage": 45.0},
+				map[string]interface{}{"voltage": 102.9},
+			},
+			"grid": struct {
+				Voltage float64 `json:"voltage"`
+				Ignored float64 `json:"-"`
+				hidden  float64
+			}{Voltage: 242.0},
+		},
+	}
+
+	tests := []struct {
+		formatter *ValueFormatter
+		expected  map[string]string
+	}{
+		{
+			&ValueFormatter{},
+			map[string]string{
+				"grid/voltage":     "242",
+				"inputs/0/voltage": "45",
+				"inputs/1/voltage": "102.9",
+				"serial":           "AB",
+				"temperature":      "47.6",
+			},
+		},
+		{
+			&ValueFormatter{
+				IncludeUnixTime: true,
+				Separator:       "_",
+				IndexBase:       1,
+				IndexFormat:     "input%d",
+			},
+			map[string]string{
+				"grid_voltage":          "1654084800 242",
+				"inputs_input1_voltage": "1654084800 45",
+				"inputs_input2_voltage": "1654084800 102.9",
+				"serial":                "1654084800 AB",
+				"temperature":           "1654084800 47.6",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		fms, err := test.formatter.FormatMessage(&m)
+		if err != nil {
+			t.Fatal("FormatMessage failed: ", err)
+		}
+
+		out := map[string]string{}
+		for _, fm := range fms {
+			out[strings.Join(fm.Path, "/")] = string(fm.Message)
+		}
+
+		if !reflect.DeepEqual(out, test.expected) {
+			t.Errorf("Unexpected values %v; want %v", out, test.expected)
+		}
+	}
+}
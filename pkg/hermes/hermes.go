@@ -8,8 +8,13 @@ package hermes
 
 import (
 	"errors"
+	"fmt"
+	"io"
 	"log"
 	"os"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/spf13/viper"
@@ -20,7 +25,13 @@ var Log = log.New(os.Stdout, "Hermes: ", log.LstdFlags)
 var BackendBlocked = errors.New("Backend blocking")
 
 type Message struct {
-	When    time.Time
+	When time.Time
+	// Stable identity of the device that generated the message
+	// (e.g., a serial number or bus address). May be empty.
+	Source string
+	// Metadata describing the source (e.g., serial number and
+	// model). Backends may use these as tags or labels.
+	Labels  map[string]string
 	Message map[string]interface{}
 }
 
@@ -29,23 +40,68 @@ type Backend interface {
 	SendMessage(m *Message) error
 }
 
+// Device states reported using SetState
+const (
+	StateOnline    = "online"
+	StateOffline   = "offline"
+	StateCommError = "comm_error"
+)
+
+// Backends that publish the state of devices and the status of the
+// daemon implement this interface.
+type StateBackend interface {
+	// Report the state of a device (e.g., StateOnline)
+	SendState(source string, state string) error
+	// Report the status of the process using the backend
+	SendStatus(status map[string]interface{}) error
+}
+
 type BackendFactory struct {
 	CreateViper func(viper *viper.Viper, basePath string) (Backend, error)
 }
 
 type Hermes struct {
-	mailbox chan *Message
-	backend map[string]Backend
+	commands chan *Command
+	workers  map[string]*backendWorker
+
+	// Protects against messages being posted while closing
+	lock   sync.RWMutex
+	closed bool
 }
 
+var (
+	// Default maximum size of a backend spool in bytes
+	DefaultSpoolSize int64 = 16 * 1024 * 1024
+	// Interval between attempts to deliver spooled messages
+	SpoolRetryInterval = 30 * time.Second
+	// Maximum time Close waits for backends to deliver queued
+	// messages
+	CloseTimeout = 10 * time.Second
+)
+
 var Backends map[string]BackendFactory = make(map[string]BackendFactory)
 
+func newHermes() *Hermes {
+	return &Hermes{
+		commands: make(chan *Command, 16),
+		workers:  map[string]*backendWorker{},
+	}
+}
+
+// Add a backend and start delivering messages to it
+func (h *Hermes) addBackend(name string, b Backend, qc *QueueConfig) error {
+	w, err := newBackendWorker(name, b, qc)
+	if err != nil {
+		return err
+	}
+
+	h.workers[name] = w
+	return nil
+}
+
 func NewViper(v *viper.Viper, basePath string) *Hermes {
 	settings := v.AllSettings()
-	h := Hermes{
-		mailbox: make(chan *Message),
-		backend: map[string]Backend{},
-	}
+	h := newHermes()
 
 	// Look for all of the subsections in the current section.
 	for name, value := range settings {
@@ -63,54 +119,210 @@ func NewViper(v *viper.Viper, basePath string) *Hermes {
 			return nil
 		}
 
+		qc := QueueConfig{basePath: basePath}
+		if err := sub.Unmarshal(&qc, decodeHooks(basePath)); err != nil {
+			Log.Print("Illegal queue configuration: ", err)
+			return nil
+		}
+
 		Log.Printf("Creating backend '%s' of type '%s'...", name, t)
-		if b, err := bf.CreateViper(sub, basePath); err == nil {
-			h.backend[name] = b
-		} else {
+		b, err := bf.CreateViper(sub, basePath)
+		if err != nil {
 			Log.Print("Failed to create backend: ", err)
 			return nil
 		}
+
+		if err := h.addBackend(name, b, &qc); err != nil {
+			Log.Printf("Failed to create queue for backend '%s': %s", name, err)
+			return nil
+		}
 	}
 
-	for name, b := range h.backend {
+	for name, w := range h.workers {
 		Log.Printf("Connecting backend %s...", name)
-		if err := b.Connect(); err != nil {
+		if err := w.backend.Connect(); err != nil {
 			Log.Print("Connection failed: ", err)
 			return nil
 		}
 	}
 
-	go h.distributor()
+	for name, w := range h.workers {
+		r, ok := w.backend.(Receiver)
+		if !ok {
+			continue
+		}
+
+		if err := r.Subscribe(h.commandHandler(name)); err != nil {
+			Log.Printf("Backend '%s' failed to subscribe: %s", name, err)
+			return nil
+		}
+	}
+
+	h.start()
+
+	return h
+}
+
+func (h *Hermes) start() {
+	for _, w := range h.workers {
+		go w.run()
+	}
+}
+
+func (h *Hermes) commandHandler(name string) func(c *Command) {
+	return func(c *Command) {
+		c.Origin = name + ": " + c.Origin
+
+		select {
+		case h.commands <- c:
+		default:
+			Log.Printf("Dropping command '%s' from %s, queue full",
+				c.Name, c.Origin)
+			// Don't block the backend's receive path
+			go c.Reply(nil, BackendBlocked)
+		}
+	}
+}
 
-	return &h
+// Get the channel that receives commands from all backends
+// implementing Receiver.
+func (h *Hermes) Commands() <-chan *Command {
+	return h.commands
 }
 
 func (h *Hermes) Send(message map[string]interface{}) error {
-	m := Message{
-		When:    time.Now(),
+	return h.Post(&Message{
 		Message: message,
+	})
+}
+
+// Queue a message for delivery to all backends. The message
+// timestamp defaults to the current time if it hasn't been
+// set. Returns BackendBlocked if at least one backend dropped the
+// message.
+func (h *Hermes) Post(m *Message) error {
+	if m.When.IsZero() {
+		m.When = time.Now()
 	}
 
-	select {
-	case h.mailbox <- &m:
-		return nil
-	default:
+	return h.enqueue(func(w *backendWorker) *backendItem {
+		return &backendItem{message: m}
+	})
+}
+
+func (h *Hermes) enqueue(item func(w *backendWorker) *backendItem) error {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	if h.closed {
 		return BackendBlocked
 	}
+
+	var err error
+	for _, w := range h.workers {
+		if i := item(w); i != nil && !w.enqueue(i) {
+			err = BackendBlocked
+		}
+	}
+
+	return err
 }
 
-func (h *Hermes) distributor() {
-	for m := range h.mailbox {
-		h.propagate(m)
+// Report the state of a device to all backends supporting device
+// states.
+func (h *Hermes) SetState(source, state string) {
+	h.enqueue(func(w *backendWorker) *backendItem {
+		sb, ok := w.backend.(StateBackend)
+		if !ok {
+			return nil
+		}
+
+		return &backendItem{update: func() error {
+			return sb.SendState(source, state)
+		}}
+	})
+}
+
+// Report the status of the process to all backends supporting
+// status reports.
+func (h *Hermes) SendStatus(status map[string]interface{}) {
+	h.enqueue(func(w *backendWorker) *backendItem {
+		sb, ok := w.backend.(StateBackend)
+		if !ok {
+			return nil
+		}
+
+		return &backendItem{update: func() error {
+			return sb.SendStatus(status)
+		}}
+	})
+}
+
+// Get statistics for all backends
+func (h *Hermes) Stats() map[string]BackendStats {
+	stats := make(map[string]BackendStats, len(h.workers))
+	for name, w := range h.workers {
+		stats[name] = w.stats()
 	}
+
+	return stats
 }
 
-func (h *Hermes) propagate(m *Message) {
-	for i, b := range h.backend {
-		err := b.SendMessage(m)
-		if err != nil {
-			Log.Printf("Backend '%s' failed to send message: %s",
-				i, err)
+// Stop accepting messages, wait for queued messages to be delivered
+// and close all backends that implement io.Closer. Backends are
+// closed even if their queue couldn't be drained in time.
+func (h *Hermes) Close() error {
+	h.lock.Lock()
+	if h.closed {
+		h.lock.Unlock()
+		return nil
+	}
+	h.closed = true
+	h.lock.Unlock()
+
+	for _, w := range h.workers {
+		close(w.queue)
+	}
+
+	var errs []string
+	timeout := time.NewTimer(CloseTimeout)
+	defer timeout.Stop()
+	expired := false
+	for name, w := range h.workers {
+		if expired {
+			select {
+			case <-w.done:
+				continue
+			default:
+			}
+		} else {
+			select {
+			case <-w.done:
+				continue
+			case <-timeout.C:
+				expired = true
+			}
+		}
+
+		errs = append(errs, fmt.Sprintf("Timeout waiting for backend '%s'", name))
+	}
+
+	for name, w := range h.workers {
+		c, ok := w.backend.(io.Closer)
+		if !ok {
+			continue
+		}
+
+		Log.Printf("Closing backend %s...", name)
+		if err := c.Close(); err != nil {
+			errs = append(errs, fmt.Sprintf("Backend '%s' failed to close: %s", name, err))
 		}
 	}
+
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return errors.New(strings.Join(errs, "; "))
+	}
+
+	return nil
 }
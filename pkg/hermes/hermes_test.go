@@ -0,0 +1,170 @@
+/*
+ * SPDX-FileCopyrightText: Copyright 2022 Andreas Sandberg <andreas@sandberg.uk>
+ *
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package hermes
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type stateBackend struct {
+	states []string
+	status []map[string]interface{}
+	closed bool
+}
+
+func (b *stateBackend) Connect() error               { return nil }
+func (b *stateBackend) SendMessage(m *Message) error { return nil }
+
+func (b *stateBackend) SendState(source, state string) error {
+	b.states = append(b.states, source+"="+state)
+	return nil
+}
+
+func (b *stateBackend) SendStatus(status map[string]interface{}) error {
+	b.status = append(b.status, status)
+	return nil
+}
+
+func (b *stateBackend) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestHermesState(t *testing.T) {
+	b := &stateBackend{}
+	h := newHermes()
+	if err := h.addBackend("test", b, &QueueConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	h.start()
+
+	h.SetState("1", StateOnline)
+	h.SetState("1", StateOffline)
+	h.SendStatus(map[string]interface{}{"polls": 1})
+
+	h.Close()
+	if !b.closed {
+		t.Error("Backend not closed")
+	}
+
+	// State changes after closing are dropped
+	h.SetState("1", StateOnline)
+
+	if want := []string{"1=online", "1=offline"}; !reflect.DeepEqual(b.states, want) {
+		t.Errorf("Unexpected states %v; want %v", b.states, want)
+	}
+	if len(b.status) != 1 {
+		t.Errorf("Unexpected status reports %v", b.status)
+	}
+}
+
+// Backend that blocks until released
+type slowBackend struct {
+	release chan struct{}
+	seen    []float64
+}
+
+func (b *slowBackend) Connect() error { return nil }
+
+func (b *slowBackend) SendMessage(m *Message) error {
+	<-b.release
+	b.seen = append(b.seen, m.Message["seq"].(float64))
+	return nil
+}
+
+func TestHermesOverflow(t *testing.T) {
+	tests := []struct {
+		overflow string
+		posted   int
+		seen     []float64
+	}{
+		// The first message is in flight when the queue fills up
+		{OverflowDropOldest, 4, []float64{0, 3, 4}},
+		{OverflowDropNewest, 2, []float64{0, 1, 2}},
+		{OverflowBlock, 2, []float64{0, 1, 2}},
+	}
+
+	for _, test := range tests {
+		b := &slowBackend{release: make(chan struct{})}
+		h := newHermes()
+		err := h.addBackend("slow", b, &QueueConfig{
+			QueueSize:    2,
+			Overflow:     test.overflow,
+			BlockTimeout: 10 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// A second backend isn't affected by the slow backend
+		fast := &stateBackend{}
+		h.addBackend("fast", fast, &QueueConfig{})
+		h.start()
+
+		post := func(i int) error {
+			return h.Post(&Message{Message: map[string]interface{}{"seq": float64(i)}})
+		}
+
+		post(0)
+		// Wait for the slow backend to pick up the first message
+		for len(h.workers["slow"].queue) != 0 {
+			time.Sleep(time.Millisecond)
+		}
+
+		accepted := 0
+		for i := 1; i <= 4; i++ {
+			if post(i) == nil {
+				accepted++
+			}
+		}
+		if accepted != test.posted {
+			t.Errorf("%s: %d messages accepted; want %d",
+				test.overflow, accepted, test.posted)
+		}
+
+		close(b.release)
+		h.Close()
+
+		if !reflect.DeepEqual(b.seen, test.seen) {
+			t.Errorf("%s: Delivered %v; want %v", test.overflow, b.seen, test.seen)
+		}
+
+		st := h.Stats()["slow"]
+		if st.Delivered != uint64(len(test.seen)) || st.Dropped != uint64(5-len(test.seen)) {
+			t.Errorf("%s: Unexpected stats %+v", test.overflow, st)
+		}
+		if st := h.Stats()["fast"]; st.Delivered != 5 {
+			t.Errorf("%s: Unexpected stats for fast backend %+v", test.overflow, st)
+		}
+	}
+}
+
+func TestHermesCloseTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { CloseTimeout = timeout }(CloseTimeout)
+	CloseTimeout = 10 * time.Millisecond
+
+	slow := &slowBackend{release: make(chan struct{})}
+	defer close(slow.release)
+	fast := &stateBackend{}
+
+	h := newHermes()
+	h.addBackend("slow", slow, &QueueConfig{})
+	h.addBackend("fast", fast, &QueueConfig{})
+	h.start()
+	h.Post(&Message{Message: map[string]interface{}{"seq": float64(0)}})
+
+	// The slow backend doesn't drain its queue in time, the other
+	// backends are closed anyway
+	if err := h.Close(); err == nil {
+		t.Error("Close didn't report the timeout")
+	}
+	if !fast.closed {
+		t.Error("Backend not closed after timeout")
+	}
+}
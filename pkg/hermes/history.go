@@ -0,0 +1,709 @@
+/*
+ * SPDX-FileCopyrightText: Copyright 2022 Andreas Sandberg <andreas@sandberg.uk>
+ *
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package hermes
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Resolutions kept by the history store
+const (
+	// Every sample
+	HistoryRaw = "raw"
+	// Summaries of 5 minute windows
+	History5Min = "5m"
+	// Summaries of each day
+	HistoryDaily = "daily"
+)
+
+// Length of the windows in the 5 minute resolution
+const historyWindowLength = 5 * time.Minute
+
+type HistoryConfig struct {
+	basePath string
+
+	// Directory containing the history, relative to the
+	// configuration file
+	Path string
+	// Numeric fields to store. Shell patterns are supported.
+	// Defaults to all fields.
+	Fields []string
+	// Fields that aren't stored. Defaults to the bus and hermes
+	// statistics.
+	Ignore []string
+	// Time raw samples are kept
+	RawRetention time.Duration `mapstructure:"raw_retention"`
+	// Time 5 minute summaries are kept. Daily summaries are kept
+	// forever.
+	Retention time.Duration
+}
+
+var (
+	defaultHistoryFields = []string{"*"}
+	defaultHistoryIgnore = []string{"aggregate.*"}
+)
+
+// Summary of a field over a time period. All values are the same
+// for raw samples.
+type HistoryValue struct {
+	Min  float64
+	Max  float64
+	Mean float64
+	Last float64
+}
+
+// Sample or summary read from the history
+type HistoryRecord struct {
+	// Time of a sample or the start of a summarized period
+	When time.Time
+	// Number of samples summarized
+	Samples int
+	Values  map[string]HistoryValue
+}
+
+// Serialized samples
+type historyRawRecord struct {
+	T int64              `json:"t"`
+	V map[string]float64 `json:"v"`
+}
+
+// Serialized summaries. Values are stored as [min, max, mean, last].
+type historySummaryRecord struct {
+	T int64                 `json:"t"`
+	N int                   `json:"n"`
+	V map[string][4]float64 `json:"v"`
+}
+
+// On-disk time series store. Each device and resolution is stored in
+// a separate directory of JSON lines files. Raw samples and 5 minute
+// summaries use one file per day, daily summaries one file per year.
+// Expired data is removed one file at a time. Records are appended,
+// so a record for a period may be followed by an updated record for
+// the same period, in which case the later record is used.
+type HistoryStore struct {
+	dir      string
+	location *time.Location
+}
+
+// Open a history store in a directory. Dates are in the local time
+// zone.
+func OpenHistoryStore(dir string) *HistoryStore {
+	return &HistoryStore{
+		dir:      dir,
+		location: time.Local,
+	}
+}
+
+// Get the name of the directory used for a device
+func historyDeviceDir(device string) string {
+	if device == "" {
+		return "default"
+	}
+
+	return strings.NewReplacer("/", "_", `\`, "_", "..", "_").Replace(device)
+}
+
+func (s *HistoryStore) fileName(device, resolution string, t time.Time) string {
+	t = t.In(s.location)
+	name := t.Format("2006-01-02")
+	if resolution == HistoryDaily {
+		name = t.Format("2006")
+	}
+
+	return filepath.Join(s.dir, historyDeviceDir(device), resolution, name+".jsonl")
+}
+
+// Get the start of the local day containing a point in time
+func (s *HistoryStore) day(t time.Time) time.Time {
+	t = t.In(s.location)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, s.location)
+}
+
+// Get the devices in the store
+func (s *HistoryStore) Devices() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var devices []string
+	for _, e := range entries {
+		if e.IsDir() {
+			devices = append(devices, e.Name())
+		}
+	}
+
+	return devices, nil
+}
+
+// Read the records in a file
+func (s *HistoryStore) readFile(name, resolution string, records map[int64]*HistoryRecord) error {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1024*1024)
+	for sc.Scan() {
+		line := sc.Bytes()
+		if resolution == HistoryRaw {
+			var r historyRawRecord
+			if err := json.Unmarshal(line, &r); err != nil {
+				// Partially written record
+				continue
+			}
+
+			rec := &HistoryRecord{
+				When:    time.Unix(0, r.T*int64(time.Millisecond)),
+				Samples: 1,
+				Values:  make(map[string]HistoryValue, len(r.V)),
+			}
+			for k, v := range r.V {
+				rec.Values[k] = HistoryValue{v, v, v, v}
+			}
+			records[r.T] = rec
+		} else {
+			var r historySummaryRecord
+			if err := json.Unmarshal(line, &r); err != nil {
+				continue
+			}
+
+			rec := &HistoryRecord{
+				When:    time.Unix(0, r.T*int64(time.Millisecond)),
+				Samples: r.N,
+				Values:  make(map[string]HistoryValue, len(r.V)),
+			}
+			for k, v := range r.V {
+				rec.Values[k] = HistoryValue{v[0], v[1], v[2], v[3]}
+			}
+			records[r.T] = rec
+		}
+	}
+
+	return sc.Err()
+}
+
+// Get the records of a device in the time range [from, to) ordered
+// by time
+func (s *HistoryStore) Query(device, resolution string, from, to time.Time) ([]HistoryRecord, error) {
+	records := map[int64]*HistoryRecord{}
+	switch resolution {
+	case HistoryRaw, History5Min:
+		for d := s.day(from); d.Before(to); d = d.AddDate(0, 0, 1) {
+			if err := s.readFile(s.fileName(device, resolution, d), resolution, records); err != nil {
+				return nil, err
+			}
+		}
+
+	case HistoryDaily:
+		for y := from.In(s.location).Year(); y <= to.In(s.location).Year(); y++ {
+			t := time.Date(y, 1, 1, 0, 0, 0, 0, s.location)
+			if err := s.readFile(s.fileName(device, resolution, t), resolution, records); err != nil {
+				return nil, err
+			}
+		}
+
+	default:
+		return nil, fmt.Errorf("Illegal history resolution '%s'", resolution)
+	}
+
+	out := make([]HistoryRecord, 0, len(records))
+	for _, r := range records {
+		if !r.When.Before(from) && r.When.Before(to) {
+			out = append(out, *r)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].When.Before(out[j].When)
+	})
+
+	return out, nil
+}
+
+// Pick the finest resolution suitable for a time range. Raw samples
+// are only used for short ranges within the default raw retention.
+func AutoHistoryResolution(from, to, now time.Time) string {
+	switch {
+	case to.Sub(from) <= 24*time.Hour && now.Sub(from) < 7*24*time.Hour:
+		return HistoryRaw
+	case to.Sub(from) <= 31*24*time.Hour:
+		return History5Min
+	default:
+		return HistoryDaily
+	}
+}
+
+// Merge summaries of consecutive periods
+func mergeHistoryRecords(when time.Time, records []HistoryRecord) HistoryRecord {
+	out := HistoryRecord{
+		When:   when,
+		Values: map[string]HistoryValue{},
+	}
+
+	// Sample-weighted sums used to compute the means
+	sums := map[string]float64{}
+	counts := map[string]int{}
+	for _, r := range records {
+		out.Samples += r.Samples
+		for k, v := range r.Values {
+			o, ok := out.Values[k]
+			if !ok {
+				o = v
+			}
+			if v.Min < o.Min {
+				o.Min = v.Min
+			}
+			if v.Max > o.Max {
+				o.Max = v.Max
+			}
+			o.Last = v.Last
+			out.Values[k] = o
+
+			sums[k] += v.Mean * float64(r.Samples)
+			counts[k] += r.Samples
+		}
+	}
+
+	for k, v := range out.Values {
+		if counts[k] > 0 {
+			v.Mean = sums[k] / float64(counts[k])
+			out.Values[k] = v
+		}
+	}
+
+	return out
+}
+
+// Get daily summaries of a device in the time range [from, to).
+// Days without a daily summary (e.g., the current day) are
+// summarized from the 5 minute resolution.
+func (s *HistoryStore) Daily(device string, from, to time.Time) ([]HistoryRecord, error) {
+	daily, err := s.Query(device, HistoryDaily, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	windows, err := s.Query(device, History5Min, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	days := map[int64]HistoryRecord{}
+	for len(windows) > 0 {
+		day := s.day(windows[0].When)
+		n := 0
+		for n < len(windows) && s.day(windows[n].When).Equal(day) {
+			n++
+		}
+		days[day.Unix()] = mergeHistoryRecords(day, windows[:n])
+		windows = windows[n:]
+	}
+
+	// Prefer daily summaries unless they are incomplete (e.g.,
+	// written when the daemon was stopped)
+	for _, r := range daily {
+		day := s.day(r.When)
+		if o, ok := days[day.Unix()]; !ok || r.Samples >= o.Samples {
+			days[day.Unix()] = r
+		}
+	}
+
+	out := make([]HistoryRecord, 0, len(days))
+	for _, r := range days {
+		out = append(out, r)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].When.Before(out[j].When)
+	})
+
+	return out, nil
+}
+
+// Remove files of a resolution containing data older than a point
+// in time
+func (s *HistoryStore) expire(device, resolution string, before time.Time) error {
+	dir := filepath.Join(s.dir, historyDeviceDir(device), resolution)
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		name := strings.TrimSuffix(e.Name(), ".jsonl")
+		day, err := time.ParseInLocation("2006-01-02", name, s.location)
+		if err != nil {
+			continue
+		}
+
+		// The file contains data until the end of the day
+		if day.AddDate(0, 0, 1).Before(before) {
+			if err := os.Remove(filepath.Join(dir, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Append a summary to a file
+func (s *HistoryStore) appendSummary(device, resolution string, w *historyWindow) error {
+	r := HistoryRecord{
+		When:    w.start,
+		Samples: w.samples,
+		Values:  make(map[string]HistoryValue, len(w.fields)),
+	}
+	for k, f := range w.fields {
+		r.Values[k] = HistoryValue{f.min, f.max, f.sum / float64(f.n), f.last}
+	}
+
+	return s.appendRecord(device, resolution, &r)
+}
+
+// Recompute the summary of a period that has already been written
+// from the next finer resolution and append it. Used to merge late
+// samples into their period.
+func (s *HistoryStore) resummarize(device, resolution string, start time.Time) error {
+	var source string
+	var end time.Time
+	switch resolution {
+	case History5Min:
+		source, end = HistoryRaw, start.Add(historyWindowLength)
+	case HistoryDaily:
+		source, end = History5Min, s.day(start.AddDate(0, 0, 1))
+	default:
+		return fmt.Errorf("Illegal history resolution '%s'", resolution)
+	}
+
+	records, err := s.Query(device, source, start, end)
+	if err != nil || len(records) == 0 {
+		return err
+	}
+	r := mergeHistoryRecords(start, records)
+
+	// Keep the current summary if the finer resolution has
+	// already expired
+	old, err := s.Query(device, resolution, start, end)
+	if err != nil {
+		return err
+	} else if len(old) > 0 && old[len(old)-1].Samples > r.Samples {
+		return nil
+	}
+
+	return s.appendRecord(device, resolution, &r)
+}
+
+// Append a summary record to a file
+func (s *HistoryStore) appendRecord(device, resolution string, r *HistoryRecord) error {
+	sr := historySummaryRecord{
+		T: r.When.UnixNano() / int64(time.Millisecond),
+		N: r.Samples,
+		V: make(map[string][4]float64, len(r.Values)),
+	}
+	for k, v := range r.Values {
+		sr.V[k] = [4]float64{v.Min, v.Max, v.Mean, v.Last}
+	}
+
+	data, err := json.Marshal(&sr)
+	if err != nil {
+		return err
+	}
+
+	lf, err := openLogFile(s.fileName(device, resolution, r.When))
+	if err != nil {
+		return err
+	}
+
+	err = lf.write(append(data, '\n'))
+	if cerr := lf.close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// Samples within a summarized period
+type historyWindow struct {
+	start   time.Time
+	samples int
+	fields  map[string]*aggregateField
+}
+
+func (w *historyWindow) add(values map[string]float64) {
+	w.samples++
+	for k, v := range values {
+		f, ok := w.fields[k]
+		if !ok {
+			f = &aggregateField{}
+			w.fields[k] = f
+		}
+		f.add(v)
+	}
+}
+
+// State of a device written to the history
+type historyDevice struct {
+	raw    *logFile
+	window *historyWindow
+	day    *historyWindow
+}
+
+// Backend writing messages to a history store
+type History struct {
+	config  *HistoryConfig
+	store   *HistoryStore
+	devices map[string]*historyDevice
+}
+
+func historyCreateViper(subv *viper.Viper, basePath string) (Backend, error) {
+	cfg := HistoryConfig{
+		basePath: basePath,
+	}
+
+	if err := subv.Unmarshal(&cfg, decodeHooks(basePath)); err != nil {
+		return nil, err
+	}
+
+	return cfg.Create()
+}
+
+func init() {
+	Backends["history"] = BackendFactory{
+		CreateViper: historyCreateViper,
+	}
+}
+
+func (hc *HistoryConfig) Create() (*History, error) {
+	if bp, err := defaultBasePath(hc.basePath); err == nil {
+		hc.basePath = bp
+	} else {
+		return nil, err
+	}
+
+	if hc.Path == "" {
+		return nil, fmt.Errorf("History path not specified")
+	}
+	if hc.Fields == nil {
+		hc.Fields = defaultHistoryFields
+	}
+	if hc.Ignore == nil {
+		hc.Ignore = defaultHistoryIgnore
+	}
+	if hc.RawRetention <= 0 {
+		hc.RawRetention = 7 * 24 * time.Hour
+	}
+	if hc.Retention <= 0 {
+		hc.Retention = 365 * 24 * time.Hour
+	}
+
+	return &History{
+		config:  hc,
+		store:   OpenHistoryStore(resolvePath(hc.basePath, hc.Path)),
+		devices: map[string]*historyDevice{},
+	}, nil
+}
+
+// Restore the partial windows of the current day from the raw
+// samples to continue them after a restart.
+func (h *History) restore(device string, now time.Time) error {
+	records, err := h.store.Query(device, HistoryRaw, h.store.day(now), now.Add(time.Hour))
+	if err != nil || len(records) == 0 {
+		return err
+	}
+
+	last := records[len(records)-1].When
+	dev := &historyDevice{
+		day: &historyWindow{
+			start:  h.store.day(last),
+			fields: map[string]*aggregateField{},
+		},
+		window: &historyWindow{
+			start:  last.Truncate(historyWindowLength),
+			fields: map[string]*aggregateField{},
+		},
+	}
+
+	for _, r := range records {
+		values := make(map[string]float64, len(r.Values))
+		for k, v := range r.Values {
+			values[k] = v.Last
+		}
+
+		dev.day.add(values)
+		if !r.When.Before(dev.window.start) {
+			dev.window.add(values)
+		}
+	}
+
+	h.devices[device] = dev
+	return nil
+}
+
+func (h *History) Connect() error {
+	if err := os.MkdirAll(h.store.dir, 0755); err != nil {
+		return err
+	}
+
+	devices, err := h.store.Devices()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, d := range devices {
+		// Device directories use a sanitized name, which is the
+		// same as the device identity in practice
+		if err := h.restore(d, now); err != nil {
+			return err
+		}
+		h.expire(d, now)
+	}
+
+	return nil
+}
+
+func (h *History) expire(device string, now time.Time) {
+	if err := h.store.expire(device, HistoryRaw, now.Add(-h.config.RawRetention)); err != nil {
+		Log.Print("Failed to expire raw history: ", err)
+	}
+	if err := h.store.expire(device, History5Min, now.Add(-h.config.Retention)); err != nil {
+		Log.Print("Failed to expire history: ", err)
+	}
+}
+
+// Get the numeric fields of a message that are stored
+func (h *History) values(m *Message) map[string]float64 {
+	values := map[string]float64{}
+	changeWalk(m.Message, "", func(field string, v interface{}) {
+		if !matchField(h.config.Fields, field) || matchField(h.config.Ignore, field) {
+			return
+		}
+		if x, ok := changeNumber(v); ok {
+			values[field] = x
+		}
+	})
+
+	return values
+}
+
+// Add a sample to a window. The window is written and replaced if the
+// sample belongs to a later window. Late samples (e.g., from a spool)
+// are merged into their window by writing an updated summary.
+// Returns the current window.
+func (h *History) advance(device, resolution string, w *historyWindow, start time.Time,
+	values map[string]float64) *historyWindow {
+
+	if w != nil && start.After(w.start) {
+		if err := h.store.appendSummary(device, resolution, w); err != nil {
+			Log.Print("Failed to write history: ", err)
+		}
+		w = nil
+	}
+
+	if w == nil {
+		w = &historyWindow{
+			start:  start,
+			fields: map[string]*aggregateField{},
+		}
+	}
+
+	if start.Equal(w.start) {
+		w.add(values)
+	} else if err := h.store.resummarize(device, resolution, start); err != nil {
+		Log.Print("Failed to update history: ", err)
+	}
+
+	return w
+}
+
+func (h *History) SendMessage(m *Message) error {
+	values := h.values(m)
+	if len(values) == 0 {
+		return nil
+	}
+
+	device := historyDeviceDir(m.Source)
+	dev, ok := h.devices[device]
+	if !ok {
+		dev = &historyDevice{}
+		h.devices[device] = dev
+	}
+
+	data, err := json.Marshal(&historyRawRecord{
+		T: m.When.UnixNano() / int64(time.Millisecond),
+		V: values,
+	})
+	if err != nil {
+		return err
+	}
+
+	name := h.store.fileName(device, HistoryRaw, m.When)
+	if dev.raw != nil && dev.raw.name != name {
+		if err := dev.raw.close(); err != nil {
+			Log.Print("Failed to close history: ", err)
+		}
+		dev.raw = nil
+		h.expire(device, m.When)
+	}
+	if dev.raw == nil {
+		if dev.raw, err = openLogFile(name); err != nil {
+			return err
+		}
+	}
+	if err := dev.raw.write(append(data, '\n')); err != nil {
+		return err
+	}
+
+	dev.window = h.advance(device, History5Min, dev.window,
+		m.When.Truncate(historyWindowLength), values)
+	dev.day = h.advance(device, HistoryDaily, dev.day,
+		h.store.day(m.When), values)
+
+	return nil
+}
+
+// Write the partial windows and close all files
+func (h *History) Close() error {
+	var err error
+	for device, dev := range h.devices {
+		for res, w := range map[string]*historyWindow{
+			History5Min:  dev.window,
+			HistoryDaily: dev.day,
+		} {
+			if w == nil || w.samples == 0 {
+				continue
+			}
+			if werr := h.store.appendSummary(device, res, w); err == nil {
+				err = werr
+			}
+		}
+
+		if dev.raw != nil {
+			if cerr := dev.raw.close(); err == nil {
+				err = cerr
+			}
+		}
+		delete(h.devices, device)
+	}
+
+	return err
+}
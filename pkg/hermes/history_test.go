@@ -0,0 +1,198 @@
+/*
+ * SPDX-FileCopyrightText: Copyright 2022 Andreas Sandberg <andreas@sandberg.uk>
+ *
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package hermes
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func historyMessage(when time.Time, power, energy float64) *Message {
+	return &Message{
+		When:   when,
+		Source: "1",
+		Message: map[string]interface{}{
+			"model":     "Test",
+			"power":     map[string]interface{}{"ac": power},
+			"energy":    map[string]interface{}{"today_wh": energy},
+			"aggregate": map[string]interface{}{"samples": 1},
+		},
+	}
+}
+
+func newTestHistory(t *testing.T, dir string) *History {
+	cfg := HistoryConfig{basePath: dir, Path: "history"}
+	h, err := cfg.Create()
+	if err != nil {
+		t.Fatal("Create failed: ", err)
+	}
+	if err := h.Connect(); err != nil {
+		t.Fatal("Connect failed: ", err)
+	}
+
+	return h
+}
+
+func TestHistory(t *testing.T) {
+	dir := t.TempDir()
+	h := newTestHistory(t, dir)
+
+	day := time.Date(2022, 6, 1, 12, 0, 0, 0, time.Local)
+	for i := 0; i < 12; i++ {
+		when := day.Add(time.Duration(i) * time.Minute)
+		if err := h.SendMessage(historyMessage(when, float64(100*i), float64(10*i))); err != nil {
+			t.Fatal("SendMessage failed: ", err)
+		}
+	}
+	if err := h.Close(); err != nil {
+		t.Fatal("Close failed: ", err)
+	}
+
+	s := OpenHistoryStore(filepath.Join(dir, "history"))
+	raw, err := s.Query("1", HistoryRaw, day, day.Add(time.Hour))
+	if err != nil {
+		t.Fatal("Query failed: ", err)
+	}
+	if len(raw) != 12 || raw[3].Values["power.ac"].Last != 300 {
+		t.Fatalf("Unexpected raw samples %v", raw)
+	}
+	if _, ok := raw[0].Values["aggregate.samples"]; ok {
+		t.Error("Ignored field stored")
+	}
+	if _, ok := raw[0].Values["model"]; ok {
+		t.Error("Non-numeric field stored")
+	}
+
+	windows, err := s.Query("1", History5Min, day, day.Add(time.Hour))
+	if err != nil {
+		t.Fatal("Query failed: ", err)
+	}
+	if len(windows) != 3 {
+		t.Fatalf("Got %d windows; want 3", len(windows))
+	}
+	want := HistoryValue{Min: 500, Max: 900, Mean: 700, Last: 900}
+	if w := windows[1]; !w.When.Equal(day.Add(5*time.Minute)) || w.Samples != 5 ||
+		w.Values["power.ac"] != want {
+
+		t.Errorf("Unexpected window %+v", w)
+	}
+
+	daily, err := s.Daily("1", day.AddDate(0, 0, -1), day.AddDate(0, 0, 1))
+	if err != nil {
+		t.Fatal("Daily failed: ", err)
+	}
+	want = HistoryValue{Min: 0, Max: 110, Mean: 55, Last: 110}
+	if len(daily) != 1 || daily[0].Samples != 12 ||
+		daily[0].Values["energy.today_wh"] != want {
+
+		t.Errorf("Unexpected daily summaries %+v", daily)
+	}
+}
+
+func TestHistoryRestart(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now().Truncate(historyWindowLength)
+	if now.Day() != now.Add(historyWindowLength).Day() {
+		// The window would span midnight
+		now = now.Add(-historyWindowLength)
+	}
+
+	h := newTestHistory(t, dir)
+	h.SendMessage(historyMessage(now, 100, 0))
+	h.SendMessage(historyMessage(now.Add(time.Minute), 200, 0))
+	h.Close()
+
+	// The partial window continues after a restart
+	h = newTestHistory(t, dir)
+	h.SendMessage(historyMessage(now.Add(2*time.Minute), 300, 0))
+	h.Close()
+
+	s := OpenHistoryStore(filepath.Join(dir, "history"))
+	windows, err := s.Query("1", History5Min, now, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal("Query failed: ", err)
+	}
+	if len(windows) != 1 || windows[0].Samples != 3 ||
+		windows[0].Values["power.ac"].Mean != 200 {
+
+		t.Errorf("Unexpected windows %+v", windows)
+	}
+}
+
+func TestHistoryLate(t *testing.T) {
+	dir := t.TempDir()
+	h := newTestHistory(t, dir)
+
+	day := time.Date(2022, 6, 1, 23, 50, 0, 0, time.Local)
+	for i := 0; i < 7; i++ {
+		h.SendMessage(historyMessage(day.Add(time.Duration(i)*time.Minute), 100, 0))
+	}
+	// The next day has started, both summaries have been written
+	h.SendMessage(historyMessage(day.Add(10*time.Minute), 100, 0))
+
+	// Late samples are merged into their windows
+	h.SendMessage(historyMessage(day.Add(90*time.Second), 1000, 0))
+	h.SendMessage(historyMessage(day.Add(9*time.Minute), 10, 0))
+	h.Close()
+
+	s := OpenHistoryStore(filepath.Join(dir, "history"))
+	windows, err := s.Query("1", History5Min, day, day.Add(10*time.Minute))
+	if err != nil {
+		t.Fatal("Query failed: ", err)
+	}
+	if len(windows) != 2 ||
+		windows[0].Samples != 6 || windows[0].Values["power.ac"].Max != 1000 ||
+		windows[1].Samples != 3 || windows[1].Values["power.ac"].Last != 10 {
+
+		t.Errorf("Unexpected windows %+v", windows)
+	}
+
+	daily, err := s.Query("1", HistoryDaily, day.AddDate(0, 0, -1), day)
+	if err != nil {
+		t.Fatal("Query failed: ", err)
+	}
+	want := HistoryValue{Min: 10, Max: 1000, Mean: 190, Last: 10}
+	if len(daily) != 1 || daily[0].Samples != 9 || daily[0].Values["power.ac"] != want {
+		t.Errorf("Unexpected daily summaries %+v", daily)
+	}
+}
+
+func TestHistoryExpire(t *testing.T) {
+	dir := t.TempDir()
+	cfg := HistoryConfig{basePath: dir, Path: "history", RawRetention: 48 * time.Hour}
+	h, err := cfg.Create()
+	if err != nil {
+		t.Fatal("Create failed: ", err)
+	}
+
+	day := time.Date(2022, 6, 1, 12, 0, 0, 0, time.Local)
+	for i := 0; i < 5; i++ {
+		h.SendMessage(historyMessage(day.AddDate(0, 0, i), 100, 0))
+	}
+	h.Close()
+
+	entries, err := os.ReadDir(filepath.Join(dir, "history", "1", HistoryRaw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if len(names) != 3 || names[0] != "2022-06-03.jsonl" {
+		t.Errorf("Unexpected raw files %v", names)
+	}
+
+	// 5 minute summaries are kept for longer
+	windows, _ := OpenHistoryStore(filepath.Join(dir, "history")).
+		Query("1", History5Min, day, day.AddDate(0, 0, 5))
+	if len(windows) != 5 {
+		t.Errorf("Got %d windows; want 5", len(windows))
+	}
+}
@@ -0,0 +1,238 @@
+/*
+ * SPDX-FileCopyrightText: Copyright 2022 Andreas Sandberg <andreas@sandberg.uk>
+ *
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package hermes
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Home Assistant sensor description
+type haSensor struct {
+	// Dot-separated path to the value in the message. "#" is
+	// replaced with the index of each DC input.
+	path        string
+	name        string
+	deviceClass string
+	unit        string
+	stateClass  string
+	category    string
+	// Optional Jinja expression applied to the value
+	scale string
+}
+
+// Sensors in the gosolis daemon payload. Sensors are only announced
+// if their value is present in the message.
+var haSensors = []haSensor{
+	{"grid.voltage", "Grid voltage", "voltage", "V", "measurement", "", ""},
+	{"grid.current", "Grid current", "current", "A", "measurement", "", ""},
+	{"grid.frequency", "Grid frequency", "frequency", "Hz", "measurement", "", ""},
+	{"power.ac", "AC power", "power", "W", "measurement", "", ""},
+	{"power.dc", "DC power", "power", "W", "measurement", "", ""},
+	{"power.efficiency", "Efficiency", "", "%", "measurement", "diagnostic", " * 100"},
+	{"power.power_factor", "Power factor", "power_factor", "", "measurement", "diagnostic", ""},
+	{"inputs.#.voltage", "DC input # voltage", "voltage", "V", "measurement", "", ""},
+	{"inputs.#.current", "DC input # current", "current", "A", "measurement", "", ""},
+	{"inputs.#.power", "DC input # power", "power", "W", "measurement", "", ""},
+	{"temperature", "Temperature", "temperature", "°C", "measurement", "diagnostic", ""},
+	{"production.total", "Lifetime production", "energy", "kWh", "total_increasing", "", ""},
+	{"production.today", "Production today", "energy", "kWh", "total_increasing", "", ""},
+	{"production.month", "Production this month", "energy", "kWh", "total_increasing", "", ""},
+	{"energy.total_wh", "Lifetime energy", "energy", "Wh", "total_increasing", "", ""},
+	{"energy.today_wh", "Energy today", "energy", "Wh", "total_increasing", "", ""},
+	{"status", "Status", "", "", "", "diagnostic", ""},
+	{"error", "Error code", "", "", "", "diagnostic", ""},
+}
+
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model,omitempty"`
+	SWVersion    string   `json:"sw_version,omitempty"`
+	SerialNumber string   `json:"serial_number,omitempty"`
+}
+
+type haAvailability struct {
+	Topic string `json:"topic"`
+}
+
+type haDiscovery struct {
+	Name              string           `json:"name"`
+	UniqueID          string           `json:"unique_id"`
+	ObjectID          string           `json:"object_id"`
+	StateTopic        string           `json:"state_topic"`
+	ValueTemplate     string           `json:"value_template"`
+	DeviceClass       string           `json:"device_class,omitempty"`
+	UnitOfMeasurement string           `json:"unit_of_measurement,omitempty"`
+	StateClass        string           `json:"state_class,omitempty"`
+	EntityCategory    string           `json:"entity_category,omitempty"`
+	Availability      []haAvailability `json:"availability,omitempty"`
+	Device            haDevice         `json:"device"`
+}
+
+func haObjectID(s string) string {
+	var sb strings.Builder
+	for _, c := range strings.ToLower(s) {
+		if c >= 'a' && c <= 'z' || c >= '0' && c <= '9' {
+			sb.WriteRune(c)
+		} else {
+			sb.WriteRune('_')
+		}
+	}
+
+	return sb.String()
+}
+
+// Expand sensors with an input placeholder into one sensor per input
+// present in the message.
+func haExpandSensors(m *Message) []haSensor {
+	var sensors []haSensor
+	for _, s := range haSensors {
+		if !strings.Contains(s.path, "#") {
+			if _, ok := Lookup(m.Message, s.path); ok {
+				sensors = append(sensors, s)
+			}
+			continue
+		}
+
+		for i := 0; ; i++ {
+			path := strings.Replace(s.path, "#", fmt.Sprint(i), 1)
+			if _, ok := Lookup(m.Message, path); !ok {
+				break
+			}
+
+			e := s
+			e.path = path
+			e.name = strings.Replace(s.name, "#", fmt.Sprint(i+1), 1)
+			sensors = append(sensors, e)
+		}
+	}
+
+	return sensors
+}
+
+// Convert a dot-separated path to a Jinja expression accessing the
+// value in the JSON payload.
+func haValueTemplate(prefix, path, scale string) string {
+	var sb strings.Builder
+	sb.WriteString("{{ value_json")
+	for _, key := range strings.Split(prefix+path, ".") {
+		if key == "" {
+			continue
+		}
+		if _, err := strconv.Atoi(key); err == nil {
+			fmt.Fprintf(&sb, "[%s]", key)
+		} else {
+			fmt.Fprintf(&sb, "['%s']", key)
+		}
+	}
+	sb.WriteString(scale)
+	sb.WriteString(" }}")
+
+	return sb.String()
+}
+
+// Create Home Assistant discovery messages for all sensors in a
+// message published on a topic. Returns a map from discovery topic
+// to payload.
+func (mc *Mqtt) haDiscovery(t *MqttTopic, m *Message) (map[string][]byte, error) {
+	jf, ok := t.Format.(*JSONFormatter)
+	if !ok {
+		return nil, fmt.Errorf("Home Assistant discovery requires the JSON formatter")
+	}
+
+	prefix := ""
+	if jf.Envelope {
+		prefix = "data."
+	}
+
+	serial := m.Labels["serial"]
+	id := serial
+	if id == "" {
+		id = m.Source
+	}
+	node := haObjectID("gosolis_" + id)
+
+	device := haDevice{
+		Identifiers:  []string{node},
+		Name:         "Solis inverter " + m.Source,
+		Manufacturer: "Ginlong",
+		Model:        m.Labels["model"],
+		SWVersion:    m.Labels["sw_version"],
+		SerialNumber: serial,
+	}
+
+	var availability []haAvailability
+	if mc.config.AvailabilityTopic != "" {
+		availability = append(availability,
+			haAvailability{Topic: mc.config.AvailabilityTopic})
+	}
+
+	discoveryPrefix := t.DiscoveryPrefix
+	if discoveryPrefix == "" {
+		discoveryPrefix = "homeassistant"
+	}
+
+	stateTopic := t.getTopic(m, &FormattedMessage{})
+	out := map[string][]byte{}
+	for _, s := range haExpandSensors(m) {
+		object := haObjectID(s.path)
+		d := haDiscovery{
+			Name:              s.name,
+			UniqueID:          node + "_" + object,
+			ObjectID:          node + "_" + object,
+			StateTopic:        stateTopic,
+			ValueTemplate:     haValueTemplate(prefix, s.path, s.scale),
+			DeviceClass:       s.deviceClass,
+			UnitOfMeasurement: s.unit,
+			StateClass:        s.stateClass,
+			EntityCategory:    s.category,
+			Availability:      availability,
+			Device:            device,
+		}
+
+		payload, err := json.Marshal(&d)
+		if err != nil {
+			return nil, err
+		}
+
+		topic := fmt.Sprintf("%s/sensor/%s/%s/config", discoveryPrefix, node, object)
+		out[topic] = payload
+	}
+
+	return out, nil
+}
+
+// Publish discovery messages the first time a source is seen on a
+// topic.
+func (mc *Mqtt) haAnnounce(t *MqttTopic, m *Message) {
+	if t.discovered == nil {
+		t.discovered = map[string]bool{}
+	}
+
+	if t.discovered[m.Source] {
+		return
+	}
+
+	msgs, err := mc.haDiscovery(t, m)
+	if err != nil {
+		Log.Printf("Topic '%s' discovery failed: %s\n", t.Topic, err)
+		return
+	}
+
+	for topic, payload := range msgs {
+		if err := mc.syncPublish(topic, 1, true, payload); err != nil {
+			Log.Printf("Failed to publish '%s': %s\n", topic, err)
+			return
+		}
+	}
+
+	t.discovered[m.Source] = true
+}
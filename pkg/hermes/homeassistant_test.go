@@ -0,0 +1,73 @@
+/*
+ * SPDX-FileCopyrightText: Copyright 2022 Andreas Sandberg <andreas@sandberg.uk>
+ *
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package hermes
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestHomeAssistantDiscovery(t *testing.T) {
+	mc := &Mqtt{config: &MqttConfig{AvailabilityTopic: "gosolis/status"}}
+	topic := &MqttTopic{
+		Topic:     "gosolis/{device}",
+		Format:    &JSONFormatter{Envelope: true},
+		Discovery: true,
+	}
+
+	m := testMessage
+	m.Message = map[string]interface{}{
+		"temperature": 47.6,
+		"inputs": []interface{}{
+			map[string]interface{}{"voltage": 200.0},
+			map[string]interface{}{"voltage": 210.0},
+		},
+		"production": map[string]interface{}{"total": 100.0},
+	}
+
+	msgs, err := mc.haDiscovery(topic, &m)
+	if err != nil {
+		t.Fatal("Discovery failed: ", err)
+	}
+
+	if len(msgs) != 4 {
+		t.Errorf("Unexpected number of discovery messages: %d", len(msgs))
+	}
+
+	raw, ok := msgs["homeassistant/sensor/gosolis_0807060504030201/inputs_1_voltage/config"]
+	if !ok {
+		t.Fatalf("Missing discovery message for input 1, got %v", msgs)
+	}
+
+	var d haDiscovery
+	if err := json.Unmarshal(raw, &d); err != nil {
+		t.Fatal("Invalid JSON: ", err)
+	}
+
+	if d.Name != "DC input 2 voltage" ||
+		d.StateTopic != "gosolis/1" ||
+		d.ValueTemplate != "{{ value_json['data']['inputs'][1]['voltage'] }}" ||
+		d.DeviceClass != "voltage" || d.UnitOfMeasurement != "V" ||
+		len(d.Availability) != 1 || d.Availability[0].Topic != "gosolis/status" ||
+		d.Device.SerialNumber != "0807060504030201" || d.Device.Model != "Test" {
+
+		t.Errorf("Unexpected discovery message %+v", d)
+	}
+
+	raw = msgs["homeassistant/sensor/gosolis_0807060504030201/production_total/config"]
+	if err := json.Unmarshal(raw, &d); err != nil {
+		t.Fatal("Invalid JSON: ", err)
+	}
+	if d.StateClass != "total_increasing" || d.UnitOfMeasurement != "kWh" {
+		t.Errorf("Unexpected production sensor %+v", d)
+	}
+
+	topic.Format = &ValueFormatter{}
+	if _, err := mc.haDiscovery(topic, &m); err == nil {
+		t.Error("Discovery accepted a non-JSON formatter")
+	}
+}
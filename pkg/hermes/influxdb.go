@@ -0,0 +1,332 @@
+/*
+ * SPDX-FileCopyrightText: Copyright 2022 Andreas Sandberg <andreas@sandberg.uk>
+ *
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package hermes
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+type InfluxDBConfig struct {
+	basePath string
+
+	// Server URL, e.g., "http://localhost:8086"
+	URL string
+	// API version (1 or 2)
+	Version int
+
+	// InfluxDB 2.x organization, bucket and API token
+	Org    string
+	Bucket string
+	Token  string
+
+	// InfluxDB 1.x database, retention policy and credentials
+	Database        string
+	RetentionPolicy string `mapstructure:"retention_policy"`
+	Username        string
+	Password        string
+
+	// Measurement name
+	Measurement string
+	// Static tags added to all points
+	Tags map[string]string
+
+	// Number of points written in a single request
+	BatchSize int `mapstructure:"batch_size"`
+	// Maximum time a point is buffered before it is written
+	FlushInterval time.Duration `mapstructure:"flush_interval"`
+	// Number of attempts for each write
+	Retries int
+	// Delay before the first retry, doubles after each attempt
+	RetryDelay time.Duration `mapstructure:"retry_delay"`
+	// HTTP request timeout
+	Timeout time.Duration
+
+	TLSConfig `mapstructure:",squash"`
+}
+
+// InfluxDB backend writing points using the line protocol over
+// HTTP. Points are batched and written when the batch is full or
+// when the flush interval expires.
+type InfluxDB struct {
+	config   *InfluxDBConfig
+	client   *http.Client
+	writeURL string
+
+	batch *batcher
+}
+
+func influxCreateViper(subv *viper.Viper, basePath string) (Backend, error) {
+	cfg := InfluxDBConfig{
+		basePath: basePath,
+	}
+
+	if err := subv.Unmarshal(&cfg, decodeHooks(basePath)); err != nil {
+		return nil, err
+	}
+
+	return cfg.Create()
+}
+
+func init() {
+	Backends["influxdb"] = BackendFactory{
+		CreateViper: influxCreateViper,
+	}
+}
+
+func (ic *InfluxDBConfig) Create() (*InfluxDB, error) {
+	if bp, err := defaultBasePath(ic.basePath); err == nil {
+		ic.basePath = bp
+	} else {
+		return nil, err
+	}
+
+	if ic.Version == 0 {
+		ic.Version = 2
+	}
+	if ic.Measurement == "" {
+		ic.Measurement = "gosolis"
+	}
+	if ic.BatchSize <= 0 {
+		ic.BatchSize = 1
+	}
+	if ic.FlushInterval <= 0 {
+		ic.FlushInterval = 10 * time.Second
+	}
+	if ic.Retries <= 0 {
+		ic.Retries = 3
+	}
+	if ic.RetryDelay <= 0 {
+		ic.RetryDelay = time.Second
+	}
+	if ic.Timeout <= 0 {
+		ic.Timeout = 10 * time.Second
+	}
+
+	base, err := url.Parse(ic.URL)
+	if err != nil {
+		return nil, fmt.Errorf("Illegal InfluxDB URL: %s", err)
+	}
+
+	query := url.Values{}
+	query.Set("precision", "ms")
+	switch ic.Version {
+	case 1:
+		if ic.Database == "" {
+			return nil, fmt.Errorf("InfluxDB 1.x requires a database")
+		}
+		base.Path = strings.TrimSuffix(base.Path, "/") + "/write"
+		query.Set("db", ic.Database)
+		if ic.RetentionPolicy != "" {
+			query.Set("rp", ic.RetentionPolicy)
+		}
+
+	case 2:
+		if ic.Org == "" || ic.Bucket == "" {
+			return nil, fmt.Errorf("InfluxDB 2.x requires an organization and a bucket")
+		}
+		base.Path = strings.TrimSuffix(base.Path, "/") + "/api/v2/write"
+		query.Set("org", ic.Org)
+		query.Set("bucket", ic.Bucket)
+
+	default:
+		return nil, fmt.Errorf("Unsupported InfluxDB API version %d", ic.Version)
+	}
+	base.RawQuery = query.Encode()
+
+	tlsConfig, err := ic.TLSConfig.Config(ic.basePath)
+	if err != nil {
+		return nil, err
+	}
+
+	db := &InfluxDB{
+		config:   ic,
+		writeURL: base.String(),
+		client: &http.Client{
+			Timeout: ic.Timeout,
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: tlsConfig,
+			},
+		},
+	}
+	db.batch = newBatcher("InfluxDB", ic.BatchSize, ic.FlushInterval, db.writeBatch)
+
+	return db, nil
+}
+
+func (db *InfluxDB) Connect() error {
+	db.batch.start()
+
+	return nil
+}
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxKeyEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+	influxStringEscaper      = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+)
+
+func influxFieldValue(v interface{}) (string, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Bool:
+		return strconv.FormatBool(rv.Bool()), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(rv.Int(), 10) + "i", true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(rv.Uint(), 10) + "i", true
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(rv.Float(), 'f', -1, 64), true
+	default:
+		return `"` + influxStringEscaper.Replace(fmt.Sprint(v)) + `"`, true
+	}
+}
+
+// Convert a message to a point in the line protocol. Nested fields
+// are flattened using underscore as a separator.
+func (db *InfluxDB) linePoint(m *Message) (string, bool) {
+	tags := make(map[string]string, len(db.config.Tags)+len(m.Labels)+1)
+	for k, v := range m.Labels {
+		tags[k] = v
+	}
+	if m.Source != "" {
+		tags["device"] = m.Source
+	}
+	for k, v := range db.config.Tags {
+		tags[k] = v
+	}
+
+	keys := make([]string, 0, len(tags))
+	for k, v := range tags {
+		// Empty tag values aren't allowed
+		if v != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	sb.WriteString(influxMeasurementEscaper.Replace(db.config.Measurement))
+	for _, k := range keys {
+		sb.WriteString(",")
+		sb.WriteString(influxKeyEscaper.Replace(k))
+		sb.WriteString("=")
+		sb.WriteString(influxKeyEscaper.Replace(tags[k]))
+	}
+
+	fields := 0
+	walkLeaves(m.Message, &walkOptions{}, func(path []string, v interface{}) {
+		value, ok := influxFieldValue(v)
+		if !ok {
+			return
+		}
+
+		if fields == 0 {
+			sb.WriteString(" ")
+		} else {
+			sb.WriteString(",")
+		}
+		fields++
+
+		sb.WriteString(influxKeyEscaper.Replace(strings.Join(path, "_")))
+		sb.WriteString("=")
+		sb.WriteString(value)
+	})
+
+	if fields == 0 {
+		return "", false
+	}
+
+	sb.WriteString(" ")
+	sb.WriteString(strconv.FormatInt(m.When.UnixNano()/int64(time.Millisecond), 10))
+
+	return sb.String(), true
+}
+
+func (db *InfluxDB) SendMessage(m *Message) error {
+	point, ok := db.linePoint(m)
+	if !ok {
+		return nil
+	}
+
+	return db.batch.add(&batchItem{data: []byte(point)})
+}
+
+func (db *InfluxDB) write(body []byte) error {
+	req, err := http.NewRequest("POST", db.writeURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	switch db.config.Version {
+	case 1:
+		if db.config.Username != "" {
+			req.SetBasicAuth(db.config.Username, db.config.Password)
+		}
+	case 2:
+		if db.config.Token != "" {
+			req.Header.Set("Authorization", "Token "+db.config.Token)
+		}
+	}
+
+	resp, err := db.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+
+	raw, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	msg := strings.TrimSpace(string(raw))
+
+	// Client errors (e.g., malformed points or authentication
+	// failures) won't go away by retrying. Rate limiting is the
+	// exception.
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusTooManyRequests {
+
+		return &permanentError{"InfluxDB", resp.StatusCode, msg}
+	}
+
+	return fmt.Errorf("InfluxDB write failed with status %d: %s",
+		resp.StatusCode, msg)
+}
+
+// Write a batch of points, retrying with an exponential back-off
+func (db *InfluxDB) writeBatch(key string, points [][]byte) error {
+	body := append(bytes.Join(points, []byte("\n")), '\n')
+
+	return retryRequest(db.config.Retries, db.config.RetryDelay, func() error {
+		return db.write(body)
+	})
+}
+
+// Write all buffered points
+func (db *InfluxDB) Flush() error {
+	return db.batch.Flush()
+}
+
+// Stop the background flusher and write any buffered points.
+func (db *InfluxDB) Close() error {
+	return db.batch.Close()
+}
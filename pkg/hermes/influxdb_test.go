@@ -0,0 +1,260 @@
+/*
+ * SPDX-FileCopyrightText: Copyright 2022 Andreas Sandberg <andreas@sandberg.uk>
+ *
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package hermes
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type influxRequest struct {
+	path  string
+	query map[string]string
+	auth  string
+	body  string
+}
+
+type influxServer struct {
+	*httptest.Server
+
+	lock     sync.Mutex
+	requests []influxRequest
+	// Status codes returned for the first requests. Later
+	// requests succeed.
+	failures []int
+}
+
+func newInfluxServer(failures ...int) *influxServer {
+	s := &influxServer{failures: failures}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		s.lock.Lock()
+		defer s.lock.Unlock()
+
+		query := map[string]string{}
+		for k, v := range r.URL.Query() {
+			query[k] = v[0]
+		}
+		s.requests = append(s.requests, influxRequest{
+			path:  r.URL.Path,
+			query: query,
+			auth:  r.Header.Get("Authorization"),
+			body:  string(body),
+		})
+
+		if len(s.failures) > 0 {
+			status := s.failures[0]
+			s.failures = s.failures[1:]
+			http.Error(w, "failure", status)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	return s
+}
+
+func influxTestMessage(when time.Time) *Message {
+	return &Message{
+		When:   when,
+		Source: "1",
+		Labels: map[string]string{"serial": "0807060504030201"},
+		Message: map[string]interface{}{
+			"grid":   map[string]interface{}{"voltage": 242.5},
+			"status": uint(1),
+			"model":  "Test \"1\"",
+		},
+	}
+}
+
+const influxTestPoint = `gosolis,device=1,serial=0807060504030201,site=my\ home ` +
+	`grid_voltage=242.5,model="Test \"1\"",status=1i 1654084800000`
+
+func TestInfluxDBv2(t *testing.T) {
+	s := newInfluxServer()
+	defer s.Close()
+
+	cfg := InfluxDBConfig{
+		URL:    s.URL,
+		Org:    "org",
+		Bucket: "solar",
+		Token:  "secret",
+		Tags:   map[string]string{"site": "my home"},
+	}
+	db, err := cfg.Create()
+	if err != nil {
+		t.Fatal("Create failed: ", err)
+	}
+
+	if err := db.SendMessage(influxTestMessage(testMessage.When)); err != nil {
+		t.Fatal("SendMessage failed: ", err)
+	}
+
+	if len(s.requests) != 1 {
+		t.Fatalf("Got %d requests; want 1", len(s.requests))
+	}
+
+	r := s.requests[0]
+	if r.path != "/api/v2/write" || r.query["org"] != "org" ||
+		r.query["bucket"] != "solar" || r.query["precision"] != "ms" {
+
+		t.Errorf("Unexpected request %s %v", r.path, r.query)
+	}
+
+	if r.auth != "Token secret" {
+		t.Errorf("Unexpected authorization '%s'", r.auth)
+	}
+
+	if r.body != influxTestPoint+"\n" {
+		t.Errorf("Unexpected body:\n%s\nwant:\n%s", r.body, influxTestPoint)
+	}
+}
+
+func TestInfluxDBv1Batch(t *testing.T) {
+	s := newInfluxServer()
+	defer s.Close()
+
+	cfg := InfluxDBConfig{
+		URL:       s.URL + "/",
+		Version:   1,
+		Database:  "solar",
+		Username:  "user",
+		Password:  "pass",
+		BatchSize: 2,
+	}
+	db, err := cfg.Create()
+	if err != nil {
+		t.Fatal("Create failed: ", err)
+	}
+
+	db.SendMessage(influxTestMessage(testMessage.When))
+	if len(s.requests) != 0 {
+		t.Fatalf("Partial batch written")
+	}
+
+	db.SendMessage(influxTestMessage(testMessage.When.Add(time.Second)))
+	if len(s.requests) != 1 {
+		t.Fatalf("Got %d requests; want 1", len(s.requests))
+	}
+
+	r := s.requests[0]
+	if r.path != "/write" || r.query["db"] != "solar" {
+		t.Errorf("Unexpected request %s %v", r.path, r.query)
+	}
+
+	if !strings.HasPrefix(r.auth, "Basic ") {
+		t.Errorf("Unexpected authorization '%s'", r.auth)
+	}
+
+	if lines := strings.Split(strings.TrimSpace(r.body), "\n"); len(lines) != 2 {
+		t.Errorf("Got %d points; want 2", len(lines))
+	}
+}
+
+func TestInfluxDBRetry(t *testing.T) {
+	s := newInfluxServer(http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	defer s.Close()
+
+	cfg := InfluxDBConfig{
+		URL:        s.URL,
+		Org:        "org",
+		Bucket:     "solar",
+		BatchSize:  2,
+		Retries:    2,
+		RetryDelay: time.Millisecond,
+	}
+	db, err := cfg.Create()
+	if err != nil {
+		t.Fatal("Create failed: ", err)
+	}
+
+	if err := db.SendMessage(influxTestMessage(testMessage.When)); err != nil {
+		t.Error("Buffered point failed: ", err)
+	}
+
+	// Both attempts fail. The point completing the batch is
+	// returned to the caller, the identical point accepted earlier
+	// stays in the buffer.
+	if err := db.SendMessage(influxTestMessage(testMessage.When)); err == nil {
+		t.Error("Failed write didn't return an error")
+	}
+
+	if len(s.requests) != 2 || len(db.batch.pending) != 1 {
+		t.Fatalf("Got %d requests and %d pending points; want 2 and 1",
+			len(s.requests), len(db.batch.pending))
+	}
+
+	if err := db.Flush(); err != nil {
+		t.Error("Flush failed: ", err)
+	}
+
+	if len(s.requests) != 3 || len(db.batch.pending) != 0 {
+		t.Errorf("Got %d requests and %d pending points; want 3 and 0",
+			len(s.requests), len(db.batch.pending))
+	}
+
+	if lines := strings.Count(s.requests[2].body, "\n"); lines != 1 {
+		t.Errorf("Got %d points; want 1", lines)
+	}
+}
+
+func TestInfluxDBPermanentError(t *testing.T) {
+	s := newInfluxServer(http.StatusBadRequest)
+	defer s.Close()
+
+	cfg := InfluxDBConfig{URL: s.URL, Org: "org", Bucket: "solar"}
+	db, err := cfg.Create()
+	if err != nil {
+		t.Fatal("Create failed: ", err)
+	}
+
+	// The point is dropped instead of being retried forever
+	if err := db.SendMessage(influxTestMessage(testMessage.When)); err != nil {
+		t.Error("Rejected point returned an error: ", err)
+	}
+
+	if len(s.requests) != 1 || len(db.batch.pending) != 0 {
+		t.Errorf("Got %d requests and %d pending points; want 1 and 0",
+			len(s.requests), len(db.batch.pending))
+	}
+}
+
+func TestInfluxDBClose(t *testing.T) {
+	s := newInfluxServer()
+	defer s.Close()
+
+	cfg := InfluxDBConfig{
+		URL:           s.URL,
+		Org:           "org",
+		Bucket:        "solar",
+		BatchSize:     10,
+		FlushInterval: time.Millisecond,
+	}
+	db, err := cfg.Create()
+	if err != nil {
+		t.Fatal("Create failed: ", err)
+	}
+
+	if err := db.Connect(); err != nil {
+		t.Fatal("Connect failed: ", err)
+	}
+	db.SendMessage(influxTestMessage(testMessage.When))
+	time.Sleep(5 * time.Millisecond)
+	if err := db.Close(); err != nil {
+		t.Fatal("Close failed: ", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal("Second close failed: ", err)
+	}
+}
@@ -7,18 +7,15 @@
 package hermes
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
-	"reflect"
+	"net/url"
 	"strings"
-
-	"crypto/tls"
-	"crypto/x509"
-
-	"path/filepath"
+	"sync"
+	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
-	"github.com/mitchellh/mapstructure"
 	"github.com/spf13/viper"
 )
 
@@ -27,15 +24,100 @@ type MqttTopic struct {
 	QOS      byte
 	Retained bool
 	Format   MessageFormatter
+
+	// Publish Home Assistant discovery messages for devices
+	// published on this topic
+	Discovery bool
+	// Topic prefix used for discovery messages
+	DiscoveryPrefix string `mapstructure:"discovery_prefix"`
+
+	// Only publish messages when values change
+	Change *ChangeFilter
+	// Publish aggregates over time windows instead of every
+	// message
+	Aggregate *AggregateConfig
+
+	// Sources that have been announced using discovery
+	discovered map[string]bool
+
+	aggregator *Aggregator
+	// Aggregates waiting to be published
+	pending []*Message
+
+	// Time of the last message from each source handled by this
+	// topic. A failed message is retried on every topic, so this
+	// prevents topics that already got it from publishing it
+	// again.
+	delivered map[string]time.Time
+}
+
+// Check if a message has already been handled by the topic
+func (t *MqttTopic) isDelivered(m *Message) bool {
+	last, ok := t.delivered[m.Source]
+	return ok && last.Equal(m.When)
+}
+
+func (t *MqttTopic) setDelivered(m *Message) {
+	if t.delivered == nil {
+		t.delivered = map[string]time.Time{}
+	}
+	t.delivered[m.Source] = m.When
 }
 
 type MqttConfig struct {
 	basePath string
-	URL      string
-	ClientID string   `mapstructure:"client_id"`
-	AuthCert string   `mapstructure:"auth_cert"`
-	AuthKey  string   `mapstructure:"auth_key"`
-	CaCerts  []string `mapstructure:"ca_certs"`
+	// Broker URL. Supported schemes are tcp, ssl, tls, ws and wss.
+	URL       string
+	ClientID  string `mapstructure:"client_id"`
+	TLSConfig `mapstructure:",squash"`
+
+	// Password authentication. The password can be read from a
+	// file or an environment variable to keep it out of the
+	// configuration.
+	Username     string
+	Password     string
+	PasswordFile string `mapstructure:"password_file"`
+	PasswordEnv  string `mapstructure:"password_env"`
+
+	// Interval between keepalive messages
+	KeepAlive time.Duration `mapstructure:"keepalive"`
+	// Discard the session state on the broker when connecting.
+	// Defaults to true.
+	CleanSession *bool `mapstructure:"clean_session"`
+	// Reconnect automatically if the connection is lost. Defaults
+	// to true.
+	AutoReconnect *bool `mapstructure:"auto_reconnect"`
+	// Maximum time between reconnection attempts
+	MaxReconnectInterval time.Duration `mapstructure:"max_reconnect_interval"`
+	// Keep retrying the initial connection instead of failing
+	ConnectRetry bool `mapstructure:"connect_retry"`
+	// Time between initial connection attempts
+	ConnectRetryInterval time.Duration `mapstructure:"connect_retry_interval"`
+	// Timeout when connecting to the broker
+	ConnectTimeout time.Duration `mapstructure:"connect_timeout"`
+	// Time to wait for the broker to acknowledge a message
+	PublishTimeout time.Duration `mapstructure:"publish_timeout"`
+
+	// Retained topic set to "online" when connected and to
+	// "offline" by the broker when the connection is lost
+	AvailabilityTopic string `mapstructure:"availability_topic"`
+	// Retained topic with the state of each device ("online",
+	// "offline" or "comm_error"). The placeholder "{device}" is
+	// replaced with the device identity.
+	StateTopic string `mapstructure:"state_topic"`
+	// Retained topic with a JSON document describing the status
+	// of the daemon
+	StatusTopic string `mapstructure:"status_topic"`
+
+	// Topic to receive commands on. The placeholder "{device}"
+	// matches any device and sets the device of unsigned
+	// commands. Signed commands are rejected if their device
+	// doesn't match the topic.
+	CommandTopic string `mapstructure:"command_topic"`
+	// Topic to publish command responses on. The placeholder
+	// "{device}" is replaced with the device in the command.
+	ResponseTopic string `mapstructure:"response_topic"`
+	CommandAuth   `mapstructure:",squash"`
 
 	Topic []MqttTopic
 }
@@ -44,18 +126,15 @@ type Mqtt struct {
 	client mqtt.Client
 	config *MqttConfig
 	topic  string
-}
 
-func stringToMessageFormatter(from reflect.Type, to reflect.Type,
-	data interface{}) (interface{}, error) {
-
-	fmtType := reflect.TypeOf((*MessageFormatter)(nil)).Elem()
-	if from.Kind() != reflect.String || !to.Implements(fmtType) {
-		return data, nil
-	}
+	verifier *commandVerifier
+	handler  func(c *Command)
 
-	raw := data.(string)
-	return createFormatter(raw)
+	// Protects the state of the topics, which is shared between
+	// the caller of SendMessage and the aggregate expiry
+	lock      sync.Mutex
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
 func mqttCreateViper(subv *viper.Viper, basePath string) (Backend, error) {
@@ -63,13 +142,7 @@ func mqttCreateViper(subv *viper.Viper, basePath string) (Backend, error) {
 		basePath: basePath,
 	}
 
-	hooks := viper.DecodeHook(
-		mapstructure.ComposeDecodeHookFunc(
-			mapstructure.StringToSliceHookFunc(","),
-			stringToMessageFormatter,
-		))
-
-	if err := subv.Unmarshal(&cfg, hooks); err != nil {
+	if err := subv.Unmarshal(&cfg, decodeHooks(basePath)); err != nil {
 		return nil, err
 	}
 
@@ -84,133 +157,420 @@ func init() {
 	Backends["mqtt"] = bf
 }
 
-func (mc *MqttConfig) certPath(name string) string {
-	if filepath.IsAbs(name) {
-		return name
+func (mc *MqttConfig) Create() (*Mqtt, error) {
+	cli := Mqtt{
+		config: mc,
+		done:   make(chan struct{}),
+	}
+
+	// Resolve files relative the the current working directory if
+	// basePath hasn't been set by mqttCreateViper
+	if bp, err := defaultBasePath(mc.basePath); err == nil {
+		mc.basePath = bp
 	} else {
-		return filepath.Join(mc.basePath, name)
+		return nil, err
 	}
-}
 
-func (mc *MqttConfig) tlsConfig() (*tls.Config, error) {
-	config := &tls.Config{}
+	u, err := url.Parse(mc.URL)
+	if err != nil {
+		return nil, fmt.Errorf("Illegal MQTT URL: %s", err)
+	}
+	switch u.Scheme {
+	case "tcp", "mqtt", "ssl", "tls", "tcps", "mqtts", "mqtt+ssl", "ws", "wss", "unix":
+	default:
+		return nil, fmt.Errorf("Unsupported MQTT URL scheme '%s'", u.Scheme)
+	}
+
+	if mc.PublishTimeout <= 0 {
+		mc.PublishTimeout = 30 * time.Second
+	}
 
-	/* Setup TLS authentication using client ceritficates */
-	if mc.AuthCert != "" || mc.AuthKey != "" {
-		if mc.AuthCert == "" || mc.AuthKey == "" {
-			return nil, fmt.Errorf("Public key authentication requires both a certificate and key")
+	for i := range mc.Topic {
+		t := &mc.Topic[i]
+		if t.Change != nil {
+			if err := t.Change.validate(); err != nil {
+				return nil, fmt.Errorf("Topic '%s': %s", t.Topic, err)
+			}
+		}
+		if t.Aggregate != nil {
+			if err := t.Aggregate.validate(); err != nil {
+				return nil, fmt.Errorf("Topic '%s': %s", t.Topic, err)
+			}
+			t.aggregator = newAggregator(t.Aggregate)
 		}
+	}
+
+	opts := mqtt.NewClientOptions()
+
+	opts.AddBroker(mc.URL)
+	opts.SetClientID(mc.ClientID)
 
-		cert, err := tls.LoadX509KeyPair(
-			mc.certPath(mc.AuthCert),
-			mc.certPath(mc.AuthKey))
+	if mc.Username != "" {
+		password, err := readSecret(mc.basePath,
+			mc.Password, mc.PasswordFile, mc.PasswordEnv)
 		if err != nil {
-			return nil, fmt.Errorf("Failed to load client certificate: %s", err)
+			return nil, fmt.Errorf("Failed to read MQTT password: %s", err)
 		}
 
-		config.Certificates = []tls.Certificate{cert}
+		opts.SetUsername(mc.Username)
+		opts.SetPassword(password)
 	}
 
-	/* Setup user-provided CA certificates. Use the system's CA
-	 * pool if no CA certificates provided.
-	 */
-	if mc.CaCerts == nil {
-		ca_pool, err := x509.SystemCertPool()
-		if err != nil {
-			return nil, fmt.Errorf("Failed to load system CA pool: %s", err)
+	if mc.KeepAlive > 0 {
+		opts.SetKeepAlive(mc.KeepAlive)
+	}
+	if mc.CleanSession != nil {
+		opts.SetCleanSession(*mc.CleanSession)
+	}
+	if mc.AutoReconnect != nil {
+		opts.SetAutoReconnect(*mc.AutoReconnect)
+	}
+	if mc.MaxReconnectInterval > 0 {
+		opts.SetMaxReconnectInterval(mc.MaxReconnectInterval)
+	}
+	opts.SetConnectRetry(mc.ConnectRetry)
+	if mc.ConnectRetryInterval > 0 {
+		opts.SetConnectRetryInterval(mc.ConnectRetryInterval)
+	}
+	if mc.ConnectTimeout > 0 {
+		opts.SetConnectTimeout(mc.ConnectTimeout)
+	}
+	opts.SetConnectionLostHandler(func(c mqtt.Client, err error) {
+		Log.Printf("MQTT connection to '%s' lost: %s", mc.URL, err)
+	})
+
+	if tls, err := mc.TLSConfig.Config(mc.basePath); err == nil {
+		opts.SetTLSConfig(tls)
+	} else {
+		return nil, err
+	}
+
+	if mc.AvailabilityTopic != "" {
+		opts.SetWill(mc.AvailabilityTopic, "offline", 1, true)
+	}
+	opts.SetOnConnectHandler(cli.onConnect)
+
+	if mc.CommandTopic != "" {
+		if v, err := mc.CommandAuth.verifier(mc.basePath); err == nil {
+			cli.verifier = v
+		} else {
+			return nil, err
 		}
-		config.RootCAs = ca_pool
+	}
+
+	cli.client = mqtt.NewClient(opts)
+
+	return &cli, nil
+}
+
+func waitToken(t mqtt.Token) error {
+	if !t.Wait() && t.Error() == nil {
+		return fmt.Errorf("MQTT failed with unexpected wait() return value")
 	} else {
-		config.RootCAs = x509.NewCertPool()
+		return t.Error()
 	}
+}
 
-	for _, value := range mc.CaCerts {
-		pem, err := os.ReadFile(mc.certPath(value))
-		if err != nil {
-			return nil, fmt.Errorf("Failed to load CA cert: %s", err)
+var (
+	MqttNotConnectedError = errors.New("Not connected to MQTT broker")
+	MqttTimeoutError      = errors.New("MQTT publish timed out")
+)
+
+func (mc *Mqtt) syncPublish(topic string, qos byte, retained bool, payload interface{}) error {
+	t := mc.client.Publish(topic, qos, retained, payload)
+	if !t.WaitTimeout(mc.config.PublishTimeout) {
+		return MqttTimeoutError
+	}
+
+	return t.Error()
+}
+
+func (mc *Mqtt) Connect() error {
+	if err := waitToken(mc.client.Connect()); err != nil {
+		return err
+	}
+
+	for i := range mc.config.Topic {
+		if mc.config.Topic[i].aggregator != nil {
+			go mc.expirer(mc.done)
+			break
 		}
+	}
+
+	return nil
+}
 
-		if !config.RootCAs.AppendCertsFromPEM(pem) {
-			return nil, fmt.Errorf("Failed to add CA '%s' to pool", value)
+// Publish aggregates of windows that ended a while ago without any
+// newer messages (e.g., when the inverter turned off at night).
+func (mc *Mqtt) expirer(done <-chan struct{}) {
+	ticker := time.NewTicker(AggregateDelay)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			mc.expire(now.Add(-AggregateDelay))
+		case <-done:
+			return
 		}
 	}
+}
+
+func (mc *Mqtt) expire(now time.Time) {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+
+	for i := range mc.config.Topic {
+		t := &mc.config.Topic[i]
+		if t.aggregator == nil {
+			continue
+		}
 
-	return config, nil
+		t.pending = append(t.pending, t.aggregator.Expire(now)...)
+		if len(t.pending) == 0 || !mc.client.IsConnectionOpen() {
+			continue
+		}
+		if err := mc.sendPending(t); err != nil {
+			Log.Printf("Topic '%s' failed to publish aggregates: %s", t.Topic, err)
+		}
+	}
 }
 
-func (mc *MqttConfig) Create() (*Mqtt, error) {
-	cli := Mqtt{
-		config: mc,
+// Publish the availability and restore subscriptions. Called by the
+// MQTT client every time it connects to the broker.
+func (mc *Mqtt) onConnect(c mqtt.Client) {
+	// Don't wait for tokens, this handler runs in the client's
+	// connection goroutine.
+	if mc.config.AvailabilityTopic != "" {
+		c.Publish(mc.config.AvailabilityTopic, 1, true, "online")
 	}
 
-	// Resolve files relative the the current working directory if
-	// basePath hasn't been set by mqttCreateViper
-	if mc.basePath == "" {
-		if pwd, err := os.Getwd(); err == nil {
-			mc.basePath = pwd
-		} else {
-			return nil, err
+	if mc.handler != nil {
+		c.Subscribe(mc.commandFilter(), 1, mc.receiveCommand)
+	}
+}
+
+// Get the subscription filter for the command topic
+func (mc *Mqtt) commandFilter() string {
+	return strings.ReplaceAll(mc.config.CommandTopic, "{device}", "+")
+}
+
+func (mc *Mqtt) Subscribe(handler func(c *Command)) error {
+	if mc.config.CommandTopic == "" {
+		return nil
+	}
+
+	mc.handler = handler
+	return waitToken(mc.client.Subscribe(mc.commandFilter(), 1, mc.receiveCommand))
+}
+
+// Extract the device from a topic matching the command topic
+func (mc *Mqtt) commandDevice(topic string) string {
+	pattern := strings.Split(mc.config.CommandTopic, "/")
+	levels := strings.Split(topic, "/")
+	for i, p := range pattern {
+		if p == "{device}" && i < len(levels) {
+			return levels[i]
 		}
 	}
 
-	opts := mqtt.NewClientOptions()
+	return ""
+}
 
-	opts.AddBroker(mc.URL)
-	opts.SetClientID(mc.ClientID)
+func (mc *Mqtt) receiveCommand(c mqtt.Client, msg mqtt.Message) {
+	// Retained commands could be stale, never execute them
+	if msg.Retained() {
+		Log.Printf("Ignoring retained command on '%s'", msg.Topic())
+		return
+	}
 
-	if tls, err := mc.tlsConfig(); err == nil {
-		opts.SetTLSConfig(tls)
-	} else {
-		return nil, err
+	cmd, err := mc.verifier.parse(msg.Payload(), time.Now())
+	if err != nil {
+		Log.Printf("Ignoring command on '%s': %s", msg.Topic(), err)
+		return
 	}
 
-	cli.client = mqtt.NewClient(opts)
+	// The topic isn't covered by the signature, so it must not
+	// redirect a command to another device
+	if dev := mc.commandDevice(msg.Topic()); dev != "" {
+		if cmd.Source == "" && mc.verifier.key == nil {
+			cmd.Source = dev
+		} else if cmd.Source != dev && cmd.Err == nil {
+			cmd.Err = CommandDeviceError
+		}
+	}
+	cmd.Origin = msg.Topic()
+	cmd.reply = mc.sendResponse
 
-	return &cli, nil
+	mc.handler(cmd)
 }
 
-func sync(t mqtt.Token) error {
-	if !t.Wait() && t.Error() == nil {
-		return fmt.Errorf("MQTT failed with unexpected wait() return value")
-	} else {
-		return t.Error()
+func (mc *Mqtt) sendResponse(r *CommandResponse) error {
+	if mc.config.ResponseTopic == "" {
+		return nil
 	}
+
+	payload, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	topic := strings.ReplaceAll(mc.config.ResponseTopic, "{device}", r.Device)
+	return mc.syncPublish(topic, 1, false, payload)
 }
 
-func (mc *Mqtt) syncPublish(topic string, qos byte, retained bool, payload interface{}) error {
-	return sync(mc.client.Publish(topic, qos, retained, payload))
+// Mark the process as offline and disconnect from the broker.
+func (mc *Mqtt) Close() error {
+	mc.closeOnce.Do(func() { close(mc.done) })
+
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+
+	// Publish partial windows of aggregated topics
+	for i := range mc.config.Topic {
+		t := &mc.config.Topic[i]
+		if t.aggregator == nil || !mc.client.IsConnectionOpen() {
+			continue
+		}
+
+		t.pending = append(t.pending, t.aggregator.Flush()...)
+		if err := mc.sendPending(t); err != nil {
+			Log.Printf("Topic '%s' failed to publish aggregates: %s", t.Topic, err)
+		}
+	}
+
+	var err error
+	if mc.config.AvailabilityTopic != "" {
+		err = mc.syncPublish(mc.config.AvailabilityTopic, 1, true, "offline")
+	}
+
+	mc.client.Disconnect(250)
+
+	return err
 }
 
-func (mc *Mqtt) Connect() error {
-	return sync(mc.client.Connect())
+func (mc *Mqtt) SendState(source string, state string) error {
+	if mc.config.StateTopic == "" {
+		return nil
+	}
+
+	topic := strings.ReplaceAll(mc.config.StateTopic, "{device}", source)
+	return mc.syncPublish(topic, 1, true, state)
 }
 
-func (mt *MqttTopic) getTopic(fm *FormattedMessage) string {
+func (mc *Mqtt) SendStatus(status map[string]interface{}) error {
+	if mc.config.StatusTopic == "" {
+		return nil
+	}
+
+	payload, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+
+	return mc.syncPublish(mc.config.StatusTopic, 1, true, payload)
+}
+
+// Expand the topic template for a message. The placeholder
+// "{device}" is replaced with the identity of the message source.
+func (mt *MqttTopic) getTopic(m *Message, fm *FormattedMessage) string {
+	topic := strings.ReplaceAll(mt.Topic, "{device}", m.Source)
 	if len(fm.Path) > 0 {
 		return fmt.Sprintf("%s/%s",
-			mt.Topic, strings.Join(fm.Path, "/"))
+			topic, strings.Join(fm.Path, "/"))
 	} else {
-		return mt.Topic
+		return topic
 	}
 }
 
-func (mc *Mqtt) sendMessages(topic *MqttTopic, msgs []FormattedMessage) {
-	for _, m := range msgs {
-		t := topic.getTopic(&m)
-		if err := mc.syncPublish(t, topic.QOS, topic.Retained, m.Message); err != nil {
-
-			Log.Printf("Failed to publish '%s': %s\n", t, err)
+func (mc *Mqtt) sendMessages(topic *MqttTopic, m *Message, msgs []FormattedMessage) error {
+	for _, fm := range msgs {
+		t := topic.getTopic(m, &fm)
+		if err := mc.syncPublish(t, topic.QOS, topic.Retained, fm.Message); err != nil {
+			return fmt.Errorf("Failed to publish '%s': %s", t, err)
 		}
 	}
+
+	return nil
 }
 
+// Publish a message on all topics. Fails if the message couldn't be
+// delivered to the broker. Messages that can't be formatted are
+// logged and dropped since retrying wouldn't help. Topics that
+// already published a message are skipped when it is retried.
 func (mc *Mqtt) SendMessage(m *Message) error {
-	for _, t := range mc.config.Topic {
-		if msgs, err := t.Format.FormatMessage(m); err == nil {
-			mc.sendMessages(&t, msgs)
-		} else {
-			Log.Printf("Topic '%s' failed: %s\n", t.Topic, err)
+	// The client silently drops QoS 0 messages while it is
+	// reconnecting, so fail early to let the caller retry.
+	if !mc.client.IsConnectionOpen() {
+		return MqttNotConnectedError
+	}
+
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+
+	for i := range mc.config.Topic {
+		t := &mc.config.Topic[i]
+		if t.aggregator == nil {
+			if t.isDelivered(m) {
+				continue
+			}
+			if err := mc.sendTopic(t, m); err != nil {
+				return err
+			}
+			t.setDelivered(m)
+			continue
+		}
+
+		// Aggregates that can't be published are kept in
+		// pending, so the message must only be added once
+		if !t.isDelivered(m) {
+			t.pending = append(t.pending, t.aggregator.Add(m)...)
+			t.setDelivered(m)
 		}
+		if err := mc.sendPending(t); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Publish a message on a topic
+func (mc *Mqtt) sendTopic(t *MqttTopic, m *Message) error {
+	if t.Discovery {
+		mc.haAnnounce(t, m)
+	}
+
+	msg, commit := m, func() {}
+	if t.Change != nil {
+		if msg, commit = t.Change.filter(m); msg == nil {
+			return nil
+		}
+	}
+
+	msgs, err := t.Format.FormatMessage(msg)
+	if err != nil {
+		Log.Printf("Topic '%s' failed: %s\n", t.Topic, err)
+		return nil
+	}
+
+	if err := mc.sendMessages(t, msg, msgs); err != nil {
+		return err
+	}
+	commit()
+
+	return nil
+}
+
+// Publish aggregates in order. Aggregates that couldn't be published
+// are kept until the next message or expiry.
+func (mc *Mqtt) sendPending(t *MqttTopic) error {
+	for len(t.pending) > 0 {
+		if err := mc.sendTopic(t, t.pending[0]); err != nil {
+			return err
+		}
+		t.pending = t.pending[1:]
 	}
+
 	return nil
 }
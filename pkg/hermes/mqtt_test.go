@@ -0,0 +1,378 @@
+/*
+ * SPDX-FileCopyrightText: Copyright 2022 Andreas Sandberg <andreas@sandberg.uk>
+ *
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package hermes
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// Minimal MQTT broker that records connections and publications
+type testBroker struct {
+	listener net.Listener
+
+	lock      sync.Mutex
+	connects  []*packets.ConnectPacket
+	publishes []*packets.PublishPacket
+	conns     []net.Conn
+	events    chan string
+	// Don't acknowledge publications on this topic
+	noAck string
+}
+
+func newTestBroker(t *testing.T) *testBroker {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Listen failed: ", err)
+	}
+
+	b := &testBroker{
+		listener: l,
+		events:   make(chan string, 100),
+	}
+	go b.serve()
+	t.Cleanup(b.close)
+
+	return b
+}
+
+func (b *testBroker) url() string {
+	return "tcp://" + b.listener.Addr().String()
+}
+
+func (b *testBroker) serve() {
+	for {
+		c, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		b.lock.Lock()
+		b.conns = append(b.conns, c)
+		b.lock.Unlock()
+
+		go b.handle(c)
+	}
+}
+
+func (b *testBroker) handle(c net.Conn) {
+	defer c.Close()
+
+	for {
+		cp, err := packets.ReadPacket(c)
+		if err != nil {
+			return
+		}
+
+		var resp packets.ControlPacket
+		switch p := cp.(type) {
+		case *packets.ConnectPacket:
+			b.lock.Lock()
+			b.connects = append(b.connects, p)
+			b.lock.Unlock()
+			resp = packets.NewControlPacket(packets.Connack)
+			b.events <- "connect"
+
+		case *packets.PublishPacket:
+			b.lock.Lock()
+			b.publishes = append(b.publishes, p)
+			noAck := p.TopicName == b.noAck
+			b.lock.Unlock()
+			if p.Qos > 0 && !noAck {
+				ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				ack.MessageID = p.MessageID
+				resp = ack
+			}
+			b.events <- "publish " + p.TopicName
+
+		case *packets.SubscribePacket:
+			ack := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			ack.MessageID = p.MessageID
+			ack.ReturnCodes = p.Qoss
+			resp = ack
+
+		case *packets.PingreqPacket:
+			resp = packets.NewControlPacket(packets.Pingresp)
+
+		case *packets.DisconnectPacket:
+			return
+		}
+
+		if resp != nil {
+			if err := resp.Write(c); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Drop all client connections without a clean disconnect
+func (b *testBroker) drop() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for _, c := range b.conns {
+		c.Close()
+	}
+	b.conns = nil
+}
+
+func (b *testBroker) close() {
+	b.listener.Close()
+	b.drop()
+}
+
+func (b *testBroker) waitFor(t *testing.T, event string) {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-b.events:
+			if e == event {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("Timeout waiting for '%s'", event)
+		}
+	}
+}
+
+func TestMqttConnectOptions(t *testing.T) {
+	b := newTestBroker(t)
+
+	pwFile := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(pwFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	clean := false
+	cfg := MqttConfig{
+		URL:               b.url(),
+		ClientID:          "test",
+		Username:          "user",
+		PasswordFile:      pwFile,
+		KeepAlive:         17 * time.Second,
+		CleanSession:      &clean,
+		AvailabilityTopic: "test/availability",
+	}
+
+	mc, err := cfg.Create()
+	if err != nil {
+		t.Fatal("Create failed: ", err)
+	}
+
+	if err := mc.Connect(); err != nil {
+		t.Fatal("Connect failed: ", err)
+	}
+	defer mc.Close()
+
+	b.waitFor(t, "publish test/availability")
+
+	b.lock.Lock()
+	p := b.connects[0]
+	b.lock.Unlock()
+
+	if p.Username != "user" || string(p.Password) != "secret" ||
+		p.Keepalive != 17 || p.CleanSession ||
+		!p.WillFlag || p.WillTopic != "test/availability" ||
+		string(p.WillMessage) != "offline" {
+
+		t.Errorf("Unexpected connect packet: %v", p)
+	}
+}
+
+func TestMqttReconnect(t *testing.T) {
+	b := newTestBroker(t)
+
+	cfg := MqttConfig{
+		URL:                  b.url(),
+		ClientID:             "test",
+		MaxReconnectInterval: 100 * time.Millisecond,
+		AvailabilityTopic:    "test/availability",
+	}
+
+	mc, err := cfg.Create()
+	if err != nil {
+		t.Fatal("Create failed: ", err)
+	}
+
+	if err := mc.Connect(); err != nil {
+		t.Fatal("Connect failed: ", err)
+	}
+	defer mc.Close()
+
+	b.waitFor(t, "publish test/availability")
+	b.drop()
+
+	// The client reconnects and announces that it is online again
+	b.waitFor(t, "connect")
+	b.waitFor(t, "publish test/availability")
+}
+
+func TestMqttRetry(t *testing.T) {
+	b := newTestBroker(t)
+	b.noAck = "test/b"
+
+	cfg := MqttConfig{
+		URL:            b.url(),
+		ClientID:       "test",
+		PublishTimeout: 100 * time.Millisecond,
+		Topic: []MqttTopic{
+			{Topic: "test/a", QOS: 1, Format: &JSONFormatter{}},
+			{Topic: "test/b", QOS: 1, Format: &JSONFormatter{}},
+		},
+	}
+
+	mc, err := cfg.Create()
+	if err != nil {
+		t.Fatal("Create failed: ", err)
+	}
+	if err := mc.Connect(); err != nil {
+		t.Fatal("Connect failed: ", err)
+	}
+	defer mc.Close()
+
+	m := &Message{
+		When:    time.Now(),
+		Source:  "1",
+		Message: map[string]interface{}{"power": 1500},
+	}
+	if err := mc.SendMessage(m); err == nil {
+		t.Fatal("Unacknowledged message delivered")
+	}
+
+	b.lock.Lock()
+	b.noAck = ""
+	b.lock.Unlock()
+
+	// Retrying only publishes on the topic that failed
+	if err := mc.SendMessage(m); err != nil {
+		t.Fatal("SendMessage failed: ", err)
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	count := 0
+	for _, p := range b.publishes {
+		if p.TopicName == "test/a" {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Errorf("Message published %d times on test/a; want 1", count)
+	}
+}
+
+func TestMqttAggregateExpire(t *testing.T) {
+	defer func(delay time.Duration) { AggregateDelay = delay }(AggregateDelay)
+	AggregateDelay = 10 * time.Millisecond
+
+	b := newTestBroker(t)
+	cfg := MqttConfig{
+		URL:      b.url(),
+		ClientID: "test",
+		Topic: []MqttTopic{{
+			Topic:     "test/agg",
+			QOS:       1,
+			Format:    &JSONFormatter{},
+			Aggregate: &AggregateConfig{Window: 10 * time.Millisecond},
+		}},
+	}
+
+	mc, err := cfg.Create()
+	if err != nil {
+		t.Fatal("Create failed: ", err)
+	}
+	if err := mc.Connect(); err != nil {
+		t.Fatal("Connect failed: ", err)
+	}
+	defer mc.Close()
+
+	m := &Message{
+		When:    time.Now(),
+		Source:  "1",
+		Message: map[string]interface{}{"power": 1500},
+	}
+	if err := mc.SendMessage(m); err != nil {
+		t.Fatal("SendMessage failed: ", err)
+	}
+
+	// The window is published without a newer message
+	b.waitFor(t, "publish test/agg")
+}
+
+func TestMqttConfigErrors(t *testing.T) {
+	for _, cfg := range []MqttConfig{
+		{URL: "http://localhost"},
+		{URL: "tcp://localhost", Username: "user", PasswordEnv: "GOSOLIS_TEST_UNSET"},
+		{URL: "tcp://localhost", TLSConfig: TLSConfig{MinVersion: "0.9"}},
+	} {
+		if _, err := cfg.Create(); err == nil {
+			t.Errorf("Illegal configuration %+v accepted", cfg)
+		}
+	}
+}
+
+type testMqttMessage struct {
+	topic   string
+	payload []byte
+}
+
+func (m *testMqttMessage) Duplicate() bool   { return false }
+func (m *testMqttMessage) Qos() byte         { return 1 }
+func (m *testMqttMessage) Retained() bool    { return false }
+func (m *testMqttMessage) Topic() string     { return m.topic }
+func (m *testMqttMessage) MessageID() uint16 { return 0 }
+func (m *testMqttMessage) Payload() []byte   { return m.payload }
+func (m *testMqttMessage) Ack()              {}
+
+func TestMqttCommandDevice(t *testing.T) {
+	key := []byte("secret")
+	cv, err := (&CommandAuth{Key: "secret"}).verifier("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var received *Command
+	mc := &Mqtt{
+		config:   &MqttConfig{CommandTopic: "gosolis/{device}/command"},
+		verifier: cv,
+		handler:  func(c *Command) { received = c },
+	}
+
+	tests := []struct {
+		device string
+		topic  string
+		err    error
+	}{
+		{"1", "gosolis/1/command", nil},
+		// The topic must not redirect a signed command
+		{"1", "gosolis/2/command", CommandDeviceError},
+		{"", "gosolis/2/command", CommandDeviceError},
+	}
+
+	for i, test := range tests {
+		request := fmt.Sprintf(`{"device":"%s","command":"grid_off","timestamp":%d}`,
+			test.device, time.Now().Unix()-int64(i))
+		payload, _ := SignCommand(key, []byte(request))
+
+		received = nil
+		mc.receiveCommand(nil, &testMqttMessage{topic: test.topic, payload: payload})
+		if received == nil {
+			t.Fatalf("%d: Command not delivered", i)
+		}
+		if received.Err != test.err || received.Source != test.device {
+			t.Errorf("%d: Unexpected command %+v", i, received)
+		}
+	}
+}
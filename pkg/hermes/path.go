@@ -0,0 +1,180 @@
+/*
+ * SPDX-FileCopyrightText: Copyright 2022 Andreas Sandberg <andreas@sandberg.uk>
+ *
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package hermes
+
+import (
+	"encoding"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Lookup a value in a nested message. The path is a dot-separated
+// list of map keys and slice indices, e.g., "inputs.0.voltage".
+func Lookup(message map[string]interface{}, path string) (interface{}, bool) {
+	var v interface{} = message
+	for _, key := range strings.Split(path, ".") {
+		switch c := v.(type) {
+		case map[string]interface{}:
+			value, ok := c[key]
+			if !ok {
+				return nil, false
+			}
+			v = value
+
+		case []interface{}:
+			idx, err := strconv.Atoi(key)
+			if err != nil || idx < 0 || idx >= len(c) {
+				return nil, false
+			}
+			v = c[idx]
+
+		default:
+			return nil, false
+		}
+	}
+
+	return v, true
+}
+
+// Create a new message by selecting values from a nested
+// message. The mapping maps keys in the new message to paths in the
+// original message. Paths that don't exist in the original message
+// are ignored.
+func Select(message map[string]interface{}, mapping map[string]string) map[string]interface{} {
+	out := make(map[string]interface{}, len(mapping))
+	for key, path := range mapping {
+		if v, ok := Lookup(message, path); ok {
+			out[key] = v
+		}
+	}
+
+	return out
+}
+
+// Options controlling how nested values are walked
+type walkOptions struct {
+	// Index of the first element in slices and arrays
+	IndexBase int
+	// Format used to name slice elements. Defaults to "%d".
+	IndexFormat string
+}
+
+func (o *walkOptions) indexName(idx int) string {
+	format := o.IndexFormat
+	if format == "" {
+		format = "%d"
+	}
+
+	return fmt.Sprintf(format, idx+o.IndexBase)
+}
+
+// Check if a value is a leaf. Arrays and structs that know how to
+// format themselves (e.g., serial numbers and time stamps) are
+// treated as leaves.
+func isLeafValue(v reflect.Value) bool {
+	if !v.IsValid() {
+		return true
+	}
+
+	switch v.Kind() {
+	case reflect.Array, reflect.Struct:
+		if v.CanInterface() {
+			switch v.Interface().(type) {
+			case encoding.TextMarshaler, fmt.Stringer:
+				return true
+			}
+		}
+	}
+
+	switch v.Kind() {
+	case reflect.Map, reflect.Slice, reflect.Array, reflect.Struct:
+		return false
+	default:
+		return true
+	}
+}
+
+// Get the name of a struct field using the same rules as
+// encoding/json. Returns an empty string for ignored fields.
+func structFieldName(f reflect.StructField) string {
+	if f.PkgPath != "" {
+		// Unexported field
+		return ""
+	}
+
+	if tag := f.Tag.Get("json"); tag != "" {
+		name := strings.Split(tag, ",")[0]
+		if name == "-" {
+			return ""
+		} else if name != "" {
+			return name
+		}
+	}
+
+	return f.Name
+}
+
+func walkValue(v reflect.Value, path []string, opts *walkOptions,
+	fn func(path []string, v interface{})) {
+
+	for v.IsValid() && (v.Kind() == reflect.Interface || v.Kind() == reflect.Ptr) {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+
+	if isLeafValue(v) {
+		if v.IsValid() && v.CanInterface() {
+			fn(path, v.Interface())
+		}
+		return
+	}
+
+	switch v.Kind() {
+	case reflect.Map:
+		keys := make([]string, 0, v.Len())
+		values := make(map[string]reflect.Value, v.Len())
+		for _, k := range v.MapKeys() {
+			name := fmt.Sprint(k.Interface())
+			keys = append(keys, name)
+			values[name] = v.MapIndex(k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			walkValue(values[k], append(path[:len(path):len(path)], k), opts, fn)
+		}
+
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			walkValue(v.Index(i),
+				append(path[:len(path):len(path)], opts.indexName(i)), opts, fn)
+		}
+
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			if name := structFieldName(t.Field(i)); name != "" {
+				walkValue(v.Field(i),
+					append(path[:len(path):len(path)], name), opts, fn)
+			}
+		}
+	}
+}
+
+// Walk all leaf values in a nested message in a deterministic
+// order. Maps, slices, arrays and structs are traversed. The
+// callback receives the path to the leaf as a list of keys.
+func walkLeaves(message map[string]interface{}, opts *walkOptions,
+	fn func(path []string, v interface{})) {
+
+	walkValue(reflect.ValueOf(message), nil, opts, fn)
+}
@@ -0,0 +1,61 @@
+/*
+ * SPDX-FileCopyrightText: Copyright 2022 Andreas Sandberg <andreas@sandberg.uk>
+ *
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package hermes
+
+import (
+	"reflect"
+	"testing"
+)
+
+var testNestedMessage = map[string]interface{}{
+	"inputs": []interface{}{
+		map[string]interface{}{"voltage": 45.0, "current": 51.5},
+		map[string]interface{}{"voltage": 102.9, "current": 179.8},
+	},
+	"grid": map[string]interface{}{
+		"voltage": 242.0,
+	},
+	"temperature": 47.6,
+}
+
+func TestLookup(t *testing.T) {
+	tests := map[string]interface{}{
+		"temperature":      47.6,
+		"grid.voltage":     242.0,
+		"inputs.1.current": 179.8,
+	}
+
+	for path, expected := range tests {
+		if v, ok := Lookup(testNestedMessage, path); !ok || v != expected {
+			t.Errorf("Lookup(%s) = %v, %v; want %v", path, v, ok, expected)
+		}
+	}
+
+	for _, path := range []string{"missing", "grid.missing", "inputs.2.voltage",
+		"inputs.x", "temperature.value"} {
+
+		if v, ok := Lookup(testNestedMessage, path); ok {
+			t.Errorf("Lookup(%s) = %v; want failure", path, v)
+		}
+	}
+}
+
+func TestSelect(t *testing.T) {
+	msg := Select(testNestedMessage, map[string]string{
+		"v_in":   "inputs.0.voltage",
+		"v_grid": "grid.voltage",
+		"v3_in":  "inputs.2.voltage",
+	})
+
+	expected := map[string]interface{}{
+		"v_in":   45.0,
+		"v_grid": 242.0,
+	}
+	if !reflect.DeepEqual(msg, expected) {
+		t.Errorf("Select() = %v; want %v", msg, expected)
+	}
+}
@@ -0,0 +1,422 @@
+/*
+ * SPDX-FileCopyrightText: Copyright 2022 Andreas Sandberg <andreas@sandberg.uk>
+ *
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package hermes
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+type PrometheusConfig struct {
+	// Address to listen on, e.g., ":9101"
+	Listen string
+	// HTTP path serving metrics
+	Path string
+	// Prefix for all metric names
+	Namespace string
+	// Fields exported as counters instead of gauges. Fields are
+	// dot-separated paths and may contain shell patterns (e.g.,
+	// "production.*").
+	Counters []string
+	// Fields exported as info metrics with the value as a label
+	Info []string
+	// Fields that aren't exported
+	Ignore []string
+}
+
+// Counters and info fields in the gosolis daemon payload
+var (
+	defaultPromCounters = []string{
+		"production.total", "energy.total_wh",
+	}
+
+	defaultPromInfo = []string{
+		"status", "error", "grid.status",
+	}
+)
+
+// Counters in the bus health report of the daemon status
+var promBusCounters = []string{
+	"frames_*", "acks_*", "*_errors", "illegal_frames", "timeouts",
+	"skipped_bytes",
+}
+
+// Counters in the daemon status
+var promStatusCounters = []string{"polls", "reports", "timeouts", "errors"}
+
+// Message labels that describe the device rather than identify it.
+// They are exported by the info metric instead of labelling every
+// series, which would start new series on firmware upgrades.
+var promInfoLabels = []string{"model", "sw_version"}
+
+type promSeries struct {
+	labels string
+	value  float64
+}
+
+type promFamily struct {
+	kind   string
+	series map[string]*promSeries
+}
+
+// Prometheus backend that serves the latest message from each
+// source on an HTTP endpoint using the Prometheus text format.
+type Prometheus struct {
+	config *PrometheusConfig
+
+	lock     sync.Mutex
+	families map[string]*promFamily
+
+	listener net.Listener
+	server   *http.Server
+}
+
+func prometheusCreateViper(subv *viper.Viper, basePath string) (Backend, error) {
+	cfg := PrometheusConfig{}
+
+	if err := subv.Unmarshal(&cfg, decodeHooks(basePath)); err != nil {
+		return nil, err
+	}
+
+	return cfg.Create()
+}
+
+func init() {
+	Backends["prometheus"] = BackendFactory{
+		CreateViper: prometheusCreateViper,
+	}
+}
+
+func (pc *PrometheusConfig) Create() (*Prometheus, error) {
+	if pc.Listen == "" {
+		pc.Listen = ":9101"
+	}
+
+	if pc.Path == "" {
+		pc.Path = "/metrics"
+	}
+
+	if pc.Namespace == "" {
+		pc.Namespace = "gosolis"
+	}
+
+	if pc.Counters == nil {
+		pc.Counters = defaultPromCounters
+	}
+
+	if pc.Info == nil {
+		pc.Info = defaultPromInfo
+	}
+
+	for _, patterns := range [][]string{pc.Counters, pc.Info, pc.Ignore} {
+		for _, p := range patterns {
+			if _, err := path.Match(p, ""); err != nil {
+				return nil, fmt.Errorf("Illegal field pattern '%s'", p)
+			}
+		}
+	}
+
+	return &Prometheus{
+		config:   pc,
+		families: map[string]*promFamily{},
+	}, nil
+}
+
+func (p *Prometheus) Connect() error {
+	l, err := net.Listen("tcp", p.config.Listen)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(p.config.Path, p)
+
+	p.listener = l
+	p.server = &http.Server{Handler: mux}
+	go func() {
+		if err := p.server.Serve(l); err != http.ErrServerClosed {
+			Log.Print("Prometheus server failed: ", err)
+		}
+	}()
+
+	return nil
+}
+
+// Get the address the metrics server is listening on.
+func (p *Prometheus) Addr() net.Addr {
+	return p.listener.Addr()
+}
+
+func matchField(patterns []string, field string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, field); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Convert a string to a legal metric or label name
+func promName(s string) string {
+	var sb strings.Builder
+	for i, c := range s {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' ||
+			c >= '0' && c <= '9' && i > 0 {
+
+			sb.WriteRune(c)
+		} else {
+			sb.WriteRune('_')
+		}
+	}
+
+	return sb.String()
+}
+
+func promEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func promLabels(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf(`%s="%s"`, promName(k), promEscape(labels[k]))
+	}
+
+	return strings.Join(parts, ",")
+}
+
+func promValue(v interface{}) (float64, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Bool:
+		if rv.Bool() {
+			return 1, true
+		}
+		return 0, true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	default:
+		return 0, false
+	}
+}
+
+// Update a series. Series are identified by key, which is normally
+// the same as the label set. Info metrics use the label set without
+// the value label as the key to replace old values.
+func (p *Prometheus) set(name, kind, key string, labels map[string]string, value float64) {
+	f, ok := p.families[name]
+	if !ok {
+		f = &promFamily{kind: kind, series: map[string]*promSeries{}}
+		p.families[name] = f
+	}
+
+	f.series[key] = &promSeries{labels: promLabels(labels), value: value}
+}
+
+func (p *Prometheus) SendMessage(m *Message) error {
+	base := map[string]string{}
+	info := map[string]string{}
+	for k, v := range m.Labels {
+		if matchField(promInfoLabels, k) {
+			info[k] = v
+		} else {
+			base[k] = v
+		}
+	}
+	base["device"] = m.Source
+	for k, v := range base {
+		info[k] = v
+	}
+
+	ns := p.config.Namespace
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	walkLeaves(m.Message, &walkOptions{}, func(fieldPath []string, v interface{}) {
+		field := strings.Join(fieldPath, ".")
+		if matchField(p.config.Ignore, field) {
+			return
+		}
+
+		// Slice indices become labels named after the slice
+		// to keep metric names stable.
+		labels := make(map[string]string, len(base)+1)
+		for k, v := range base {
+			labels[k] = v
+		}
+		var nameParts []string
+		for i, seg := range fieldPath {
+			if _, err := strconv.Atoi(seg); err == nil && i > 0 {
+				labels[strings.TrimSuffix(fieldPath[i-1], "s")] = seg
+			} else {
+				nameParts = append(nameParts, seg)
+			}
+		}
+		name := promName(ns + "_" + strings.Join(nameParts, "_"))
+
+		key := promLabels(labels)
+		if matchField(p.config.Info, field) {
+			labels["value"] = fmt.Sprint(v)
+			p.set(name+"_info", "gauge", key, labels, 1)
+			return
+		}
+
+		value, ok := promValue(v)
+		if !ok {
+			return
+		}
+
+		if matchField(p.config.Counters, field) {
+			if !strings.HasSuffix(name, "_total") {
+				name += "_total"
+			}
+			p.set(name, "counter", key, labels, value)
+		} else {
+			p.set(name, "gauge", key, labels, value)
+		}
+	})
+
+	p.set(ns+"_last_sample_timestamp_seconds", "gauge", promLabels(base), base,
+		float64(m.When.UnixNano())/float64(time.Second))
+	p.set(ns+"_info", "gauge", promLabels(base), info, 1)
+
+	return nil
+}
+
+func (p *Prometheus) SendState(source string, state string) error {
+	labels := map[string]string{"device": source}
+	key := promLabels(labels)
+	labels["value"] = state
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.set(p.config.Namespace+"_state_info", "gauge", key, labels, 1)
+
+	return nil
+}
+
+// Export a flat map of values with a common prefix. Fields matching
+// counters are exported as counters.
+func (p *Prometheus) setAll(prefix string, labels map[string]string,
+	values map[string]interface{}, counters []string) {
+
+	key := promLabels(labels)
+	for k, v := range values {
+		value, ok := promValue(v)
+		if !ok {
+			continue
+		}
+
+		name := promName(prefix + k)
+		if matchField(counters, k) {
+			p.set(name+"_total", "counter", key, labels, value)
+		} else {
+			p.set(name, "gauge", key, labels, value)
+		}
+	}
+}
+
+// Export the bus health and backend statistics in the daemon status
+// report. Backends are identified by a label to keep metric names
+// independent of the configuration. The daemon and bus series are
+// labelled with the device once it has been identified.
+func (p *Prometheus) SendStatus(status map[string]interface{}) error {
+	ns := p.config.Namespace
+	labels := map[string]string{}
+	if id, ok := status["device"].(string); ok {
+		labels["device"] = id
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.setAll(ns+"_daemon_", labels, map[string]interface{}{
+		"polls":          status["polls"],
+		"reports":        status["reports"],
+		"timeouts":       status["timeouts"],
+		"errors":         status["errors"],
+		"uptime_seconds": status["uptime_seconds"],
+	}, promStatusCounters)
+
+	if bus, ok := status["bus"].(map[string]interface{}); ok {
+		p.setAll(ns+"_bus_", labels, bus, promBusCounters)
+	}
+
+	stats, _ := status["hermes"].(map[string]BackendStats)
+	for name, st := range stats {
+		labels := map[string]string{"backend": name}
+		key := promLabels(labels)
+		p.set(ns+"_hermes_delivered_total", "counter", key, labels, float64(st.Delivered))
+		p.set(ns+"_hermes_dropped_total", "counter", key, labels, float64(st.Dropped))
+		p.set(ns+"_hermes_failed_total", "counter", key, labels, float64(st.Failed))
+		p.set(ns+"_hermes_queued", "gauge", key, labels, float64(st.Queued))
+		p.set(ns+"_hermes_queued_bytes", "gauge", key, labels, float64(st.QueuedBytes))
+	}
+
+	return nil
+}
+
+func (p *Prometheus) writeMetrics(w io.Writer) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	names := make([]string, 0, len(p.families))
+	for n := range p.families {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	for _, n := range names {
+		f := p.families[n]
+		fmt.Fprintf(w, "# TYPE %s %s\n", n, f.kind)
+
+		keys := make([]string, 0, len(f.series))
+		for k := range f.series {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			s := f.series[k]
+			labels := ""
+			if s.labels != "" {
+				labels = "{" + s.labels + "}"
+			}
+			fmt.Fprintf(w, "%s%s %s\n", n, labels,
+				strconv.FormatFloat(s.value, 'g', -1, 64))
+		}
+	}
+}
+
+func (p *Prometheus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	p.writeMetrics(w)
+}
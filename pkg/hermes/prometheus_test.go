@@ -0,0 +1,113 @@
+/*
+ * SPDX-FileCopyrightText: Copyright 2022 Andreas Sandberg <andreas@sandberg.uk>
+ *
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package hermes
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPrometheus(t *testing.T) {
+	cfg := PrometheusConfig{Listen: "127.0.0.1:0"}
+	p, err := cfg.Create()
+	if err != nil {
+		t.Fatal("Create failed: ", err)
+	}
+
+	if err := p.Connect(); err != nil {
+		t.Fatal("Connect failed: ", err)
+	}
+
+	m := Message{
+		When:   testMessage.When,
+		Source: "1",
+		Labels: map[string]string{
+			"serial":     "0807060504030201",
+			"model":      "Test",
+			"sw_version": "1.2",
+		},
+		Message: map[string]interface{}{
+			"inputs": []interface{}{
+				map[string]interface{}{"voltage": 45.0},
+			},
+			"production": map[string]interface{}{"total": 1234.0},
+			"status":     uint(1),
+			"model":      "Test",
+		},
+	}
+	p.SendMessage(&m)
+	m.Message["status"] = uint(2)
+	p.SendMessage(&m)
+
+	resp, err := http.Get("http://" + p.Addr().String() + "/metrics")
+	if err != nil {
+		t.Fatal("GET failed: ", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	expected := `# TYPE gosolis_info gauge
+gosolis_info{device="1",model="Test",serial="0807060504030201",sw_version="1.2"} 1
+# TYPE gosolis_inputs_voltage gauge
+gosolis_inputs_voltage{device="1",input="0",serial="0807060504030201"} 45
+# TYPE gosolis_last_sample_timestamp_seconds gauge
+gosolis_last_sample_timestamp_seconds{device="1",serial="0807060504030201"} 1.6540848e+09
+# TYPE gosolis_production_total counter
+gosolis_production_total{device="1",serial="0807060504030201"} 1234
+# TYPE gosolis_status_info gauge
+gosolis_status_info{device="1",serial="0807060504030201",value="2"} 1
+`
+	if string(body) != expected {
+		t.Errorf("Unexpected metrics:\n%s\nwant:\n%s", body, expected)
+	}
+
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Unexpected content type %s", ct)
+	}
+}
+
+func TestPrometheusStatus(t *testing.T) {
+	cfg := PrometheusConfig{}
+	p, err := cfg.Create()
+	if err != nil {
+		t.Fatal("Create failed: ", err)
+	}
+
+	p.SendState("1", StateOnline)
+	p.SendStatus(map[string]interface{}{
+		"polls":          uint64(10),
+		"uptime_seconds": int64(60),
+		"device":         "1",
+		"bus": map[string]interface{}{
+			"frames_sent":         uint64(5),
+			"checksum_errors":     uint64(1),
+			"latency_avg_seconds": 0.05,
+		},
+		"hermes": map[string]BackendStats{
+			"broker0": {Delivered: 3, Queued: 1},
+		},
+	})
+
+	var sb strings.Builder
+	p.writeMetrics(&sb)
+	for _, want := range []string{
+		"gosolis_state_info{device=\"1\",value=\"online\"} 1\n",
+		"# TYPE gosolis_daemon_polls_total counter\ngosolis_daemon_polls_total{device=\"1\"} 10\n",
+		"gosolis_daemon_uptime_seconds{device=\"1\"} 60\n",
+		"# TYPE gosolis_bus_frames_sent_total counter\n",
+		"gosolis_bus_checksum_errors_total{device=\"1\"} 1\n",
+		"# TYPE gosolis_bus_latency_avg_seconds gauge\n",
+		"gosolis_hermes_delivered_total{backend=\"broker0\"} 3\n",
+		"gosolis_hermes_queued{backend=\"broker0\"} 1\n",
+	} {
+		if !strings.Contains(sb.String(), want) {
+			t.Errorf("Missing metric %q in:\n%s", want, sb.String())
+		}
+	}
+}
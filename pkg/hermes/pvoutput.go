@@ -0,0 +1,541 @@
+/*
+ * SPDX-FileCopyrightText: Copyright 2022 Andreas Sandberg <andreas@sandberg.uk>
+ *
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package hermes
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	pvoutputStatusPath      = "/service/r2/addstatus.jsp"
+	pvoutputBatchStatusPath = "/service/r2/addbatchstatus.jsp"
+
+	// Number of status values (v1-v6)
+	pvoutputValues = 6
+)
+
+type PVOutputConfig struct {
+	basePath string
+
+	// Service URL, defaults to "https://pvoutput.org"
+	URL string
+	// API key and system id
+	APIKey     string `mapstructure:"api_key"`
+	APIKeyFile string `mapstructure:"api_key_file"`
+	APIKeyEnv  string `mapstructure:"api_key_env"`
+	SystemID   string `mapstructure:"system_id"`
+
+	// Only upload messages from this device. Messages from all
+	// devices are uploaded if empty.
+	Device string
+
+	// Message fields used for the status values v1-v6 (e.g.,
+	// v2 = "power.ac"). Empty paths aren't uploaded.
+	Fields map[string]string
+	// Time zone of the PVOutput system, defaults to the local time
+	// zone
+	Timezone string
+
+	// Status interval of the PVOutput system
+	Interval time.Duration
+	// Maximum number of requests per hour
+	RateLimit int `mapstructure:"rate_limit"`
+	// Maximum number of statuses per batch request
+	BatchSize int `mapstructure:"batch_size"`
+	// Statuses older than this aren't uploaded. PVOutput accepts
+	// statuses up to 14 days old (90 days for donors).
+	MaxAge time.Duration `mapstructure:"max_age"`
+	// HTTP request timeout
+	Timeout time.Duration
+
+	TLSConfig `mapstructure:",squash"`
+}
+
+// Default mapping from status values to message fields
+var defaultPVOutputFields = map[string]string{
+	// Energy generation (Wh)
+	"v1": "energy.today_wh",
+	// Power generation (W)
+	"v2": "power.ac",
+	// Temperature (C)
+	"v5": "temperature",
+	// Voltage (V)
+	"v6": "inputs.0.voltage",
+}
+
+// Status of a PVOutput system at the end of an interval
+type pvoutputStatus struct {
+	when time.Time
+	// Time of the message the status is based on
+	sample time.Time
+	values [pvoutputValues]*float64
+}
+
+// Backend uploading status information to PVOutput or a compatible
+// service. Messages are collected into statuses at the end of each
+// status interval. Statuses are buffered until they have been
+// uploaded, which makes it possible to backfill intervals missed
+// while the service was unreachable or rate limited.
+type PVOutput struct {
+	config   *PVOutputConfig
+	client   *http.Client
+	apiKey   string
+	location *time.Location
+	fields   [pvoutputValues]string
+	now      func() time.Time
+
+	lock sync.Mutex
+	// Status of the current interval
+	current *pvoutputStatus
+	pending []*pvoutputStatus
+
+	flushLock sync.Mutex
+	// Time of requests within the last hour
+	requests []time.Time
+	// Don't send requests before this time
+	blocked time.Time
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func pvoutputCreateViper(subv *viper.Viper, basePath string) (Backend, error) {
+	cfg := PVOutputConfig{
+		basePath: basePath,
+		Fields:   map[string]string{},
+	}
+	for k, v := range defaultPVOutputFields {
+		cfg.Fields[k] = v
+	}
+
+	if err := subv.Unmarshal(&cfg, decodeHooks(basePath)); err != nil {
+		return nil, err
+	}
+
+	return cfg.Create()
+}
+
+func init() {
+	Backends["pvoutput"] = BackendFactory{
+		CreateViper: pvoutputCreateViper,
+	}
+}
+
+func (pc *PVOutputConfig) Create() (*PVOutput, error) {
+	if bp, err := defaultBasePath(pc.basePath); err == nil {
+		pc.basePath = bp
+	} else {
+		return nil, err
+	}
+
+	if pc.URL == "" {
+		pc.URL = "https://pvoutput.org"
+	}
+	if pc.Fields == nil {
+		pc.Fields = defaultPVOutputFields
+	}
+	if pc.Interval <= 0 {
+		pc.Interval = 5 * time.Minute
+	}
+	if pc.RateLimit <= 0 {
+		pc.RateLimit = 60
+	}
+	if pc.BatchSize <= 0 {
+		pc.BatchSize = 30
+	}
+	if pc.MaxAge <= 0 {
+		pc.MaxAge = 14 * 24 * time.Hour
+	}
+	if pc.Timeout <= 0 {
+		pc.Timeout = 10 * time.Second
+	}
+
+	if _, err := url.Parse(pc.URL); err != nil {
+		return nil, fmt.Errorf("Illegal PVOutput URL: %s", err)
+	}
+	if pc.SystemID == "" {
+		return nil, fmt.Errorf("PVOutput system id not specified")
+	}
+
+	p := &PVOutput{
+		config:   pc,
+		location: time.Local,
+		now:      time.Now,
+		done:     make(chan struct{}),
+	}
+
+	key, err := readSecret(pc.basePath, pc.APIKey, pc.APIKeyFile, pc.APIKeyEnv)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read PVOutput API key: %s", err)
+	} else if key == "" {
+		return nil, fmt.Errorf("PVOutput API key not specified")
+	}
+	p.apiKey = key
+
+	if pc.Timezone != "" {
+		loc, err := time.LoadLocation(pc.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("Illegal time zone: %s", err)
+		}
+		p.location = loc
+	}
+
+	for k, v := range pc.Fields {
+		idx, err := strconv.Atoi(strings.TrimPrefix(k, "v"))
+		if !strings.HasPrefix(k, "v") || err != nil || idx < 1 || idx > pvoutputValues {
+			return nil, fmt.Errorf("Illegal PVOutput field '%s'", k)
+		}
+		p.fields[idx-1] = v
+	}
+
+	tlsConfig, err := pc.TLSConfig.Config(pc.basePath)
+	if err != nil {
+		return nil, err
+	}
+
+	p.client = &http.Client{
+		Timeout: pc.Timeout,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+	}
+
+	return p, nil
+}
+
+func (p *PVOutput) Connect() error {
+	go p.flusher(p.done)
+
+	return nil
+}
+
+// Complete the current status when its interval ends and retry
+// failed uploads.
+func (p *PVOutput) flusher(done <-chan struct{}) {
+	ticker := time.NewTicker(p.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.lock.Lock()
+			p.expire(p.now())
+			p.lock.Unlock()
+
+			if err := p.Flush(); err != nil {
+				Log.Print("PVOutput upload failed: ", err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// Get a numeric value from a message. Aggregated gauges use their
+// mean and aggregated counters their last value.
+func pvoutputValue(m map[string]interface{}, path string) (float64, bool) {
+	v, ok := Lookup(m, path)
+	if !ok {
+		return 0, false
+	}
+
+	if agg, ok := v.(map[string]interface{}); ok {
+		if mean, ok := agg[AggregateMean]; ok {
+			v = mean
+		} else {
+			v = agg[AggregateLast]
+		}
+	}
+
+	return changeNumber(v)
+}
+
+// Move the current status to the pending buffer if its interval
+// ended before a point in time
+func (p *PVOutput) expire(now time.Time) {
+	if p.current != nil && p.current.when.Before(now) {
+		p.pending = append(p.pending, p.current)
+		p.current = nil
+	}
+}
+
+func (p *PVOutput) SendMessage(m *Message) error {
+	if p.config.Device != "" && m.Source != p.config.Device {
+		return nil
+	}
+
+	// Statuses describe the system at the end of each
+	// interval. Aggregates are time stamped at the end of their
+	// window, so messages at the end of an interval belong to it.
+	when := m.When.Truncate(p.config.Interval)
+	if when.Before(m.When) {
+		when = when.Add(p.config.Interval)
+	}
+	s := &pvoutputStatus{when: when, sample: m.When}
+	for i, path := range p.fields {
+		if path == "" {
+			continue
+		}
+		if v, ok := pvoutputValue(m.Message, path); ok {
+			s.values[i] = &v
+		}
+	}
+
+	p.lock.Lock()
+	p.expire(m.When)
+	if p.current == nil || p.current.when.Equal(when) {
+		p.current = s
+	} else {
+		// Old message (e.g., from a spool) for an interval that
+		// has already been completed
+		p.addPending(s)
+	}
+	ready := len(p.pending) > 0
+	p.lock.Unlock()
+
+	// Failures are reported to let the worker spool the
+	// message. Replaying it replaces the status of its interval,
+	// so statuses that are still buffered aren't uploaded twice.
+	if ready {
+		return p.Flush()
+	}
+
+	return nil
+}
+
+// Add a status to the pending buffer, replacing any status for the
+// same interval
+func (p *PVOutput) addPending(s *pvoutputStatus) {
+	for i, o := range p.pending {
+		if o.when.Equal(s.when) {
+			p.pending[i] = s
+			return
+		}
+	}
+
+	p.pending = append(p.pending, s)
+	sort.Slice(p.pending, func(i, j int) bool {
+		return p.pending[i].when.Before(p.pending[j].when)
+	})
+}
+
+func pvoutputFormatValue(idx int, v *float64) string {
+	if v == nil {
+		return ""
+	}
+
+	// Energy and power values are integers
+	if idx < 4 {
+		return strconv.FormatFloat(math.Round(*v), 'f', 0, 64)
+	}
+
+	return strconv.FormatFloat(*v, 'f', -1, 64)
+}
+
+// Check if another request can be sent without exceeding the rate
+// limit
+func (p *PVOutput) allowed(now time.Time) bool {
+	if now.Before(p.blocked) {
+		return false
+	}
+
+	for len(p.requests) > 0 && now.Sub(p.requests[0]) >= time.Hour {
+		p.requests = p.requests[1:]
+	}
+
+	return len(p.requests) < p.config.RateLimit
+}
+
+// Block requests until the rate limit resets if the limit has been
+// reached
+func (p *PVOutput) rateLimit(resp *http.Response, body string, now time.Time) {
+	limited := resp.StatusCode == http.StatusForbidden &&
+		strings.Contains(body, "Exceeded")
+	remaining, err := strconv.Atoi(resp.Header.Get("X-Rate-Limit-Remaining"))
+	if err == nil && remaining <= 0 {
+		limited = true
+	}
+	if !limited {
+		return
+	}
+
+	reset, err := strconv.ParseInt(resp.Header.Get("X-Rate-Limit-Reset"), 10, 64)
+	if err == nil {
+		p.blocked = time.Unix(reset, 0)
+	} else {
+		p.blocked = now.Add(time.Hour)
+	}
+	Log.Printf("PVOutput rate limit reached, waiting until %s",
+		p.blocked.Format(time.RFC3339))
+}
+
+func (p *PVOutput) post(path string, form url.Values) (string, error) {
+	u := strings.TrimSuffix(p.config.URL, "/") + path
+	req, err := http.NewRequest("POST", u, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Pvoutput-Apikey", p.apiKey)
+	req.Header.Set("X-Pvoutput-SystemId", p.config.SystemID)
+
+	now := p.now()
+	p.requests = append(p.requests, now)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	raw, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	body := strings.TrimSpace(string(raw))
+	p.rateLimit(resp, body, now)
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return body, nil
+
+	case resp.StatusCode == http.StatusBadRequest:
+		// The status was rejected (e.g., invalid values or too
+		// old), retrying won't help.
+		return "", &permanentError{"PVOutput", resp.StatusCode, body}
+
+	default:
+		return "", fmt.Errorf("PVOutput request failed with status %d: %s",
+			resp.StatusCode, body)
+	}
+}
+
+// Upload a batch of statuses
+func (p *PVOutput) upload(batch []*pvoutputStatus) error {
+	form := url.Values{}
+	if len(batch) == 1 {
+		s := batch[0]
+		t := s.when.In(p.location)
+		form.Set("d", t.Format("20060102"))
+		form.Set("t", t.Format("15:04"))
+		for i, v := range s.values {
+			if v != nil {
+				form.Set(fmt.Sprintf("v%d", i+1), pvoutputFormatValue(i, v))
+			}
+		}
+
+		_, err := p.post(pvoutputStatusPath, form)
+		return err
+	}
+
+	statuses := make([]string, len(batch))
+	for i, s := range batch {
+		t := s.when.In(p.location)
+		fields := []string{t.Format("20060102"), t.Format("15:04")}
+		for j, v := range s.values {
+			fields = append(fields, pvoutputFormatValue(j, v))
+		}
+		statuses[i] = strings.Join(fields, ",")
+	}
+	form.Set("data", strings.Join(statuses, ";"))
+
+	// The response lists the statuses and whether they were
+	// added. Statuses that weren't added (e.g., duplicates) won't
+	// be accepted on a retry either.
+	_, err := p.post(pvoutputBatchStatusPath, form)
+	return err
+}
+
+// Upload all pending statuses, respecting the rate limit. Statuses
+// are kept in the buffer if the upload fails and are dropped if the
+// service refuses them.
+func (p *PVOutput) Flush() error {
+	p.flushLock.Lock()
+	defer p.flushLock.Unlock()
+
+	for {
+		now := p.now()
+
+		p.lock.Lock()
+		expired := 0
+		for len(p.pending) > 0 && now.Sub(p.pending[0].when) > p.config.MaxAge {
+			p.pending = p.pending[1:]
+			expired++
+		}
+		n := len(p.pending)
+		if n > p.config.BatchSize {
+			n = p.config.BatchSize
+		}
+		batch := append([]*pvoutputStatus(nil), p.pending[:n]...)
+		p.lock.Unlock()
+
+		if expired > 0 {
+			Log.Printf("PVOutput dropped %d statuses older than %s", expired, p.config.MaxAge)
+		}
+
+		if len(batch) == 0 {
+			return nil
+		}
+
+		if !p.allowed(now) {
+			// Try again once the rate limit allows it
+			return nil
+		}
+
+		err := p.upload(batch)
+		if _, ok := err.(*permanentError); err != nil && !ok {
+			return err
+		} else if ok {
+			Log.Printf("Dropping %d rejected statuses: %s", len(batch), err)
+		}
+
+		p.lock.Lock()
+		for _, s := range batch {
+			if len(p.pending) > 0 && p.pending[0] == s {
+				p.pending = p.pending[1:]
+			}
+		}
+		p.lock.Unlock()
+	}
+}
+
+// Stop the background flusher and upload the current and any
+// buffered statuses.
+func (p *PVOutput) Close() error {
+	p.closeOnce.Do(func() { close(p.done) })
+
+	p.lock.Lock()
+	if s := p.current; s != nil {
+		// The interval hasn't ended, use the time of the latest
+		// message instead to avoid a status in the future
+		if s.when.After(p.now()) {
+			s.when = s.sample.Truncate(time.Minute)
+		}
+		p.pending = append(p.pending, s)
+		p.current = nil
+	}
+	p.lock.Unlock()
+
+	err := p.Flush()
+
+	p.lock.Lock()
+	if n := len(p.pending); n > 0 {
+		Log.Printf("PVOutput dropping %d statuses that weren't uploaded", n)
+	}
+	p.lock.Unlock()
+
+	return err
+}
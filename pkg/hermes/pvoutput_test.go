@@ -0,0 +1,285 @@
+/*
+ * SPDX-FileCopyrightText: Copyright 2022 Andreas Sandberg <andreas@sandberg.uk>
+ *
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package hermes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type pvoutputRequest struct {
+	path   string
+	key    string
+	system string
+	form   url.Values
+}
+
+// Stand-in for the PVOutput status service
+type pvoutputServer struct {
+	*httptest.Server
+
+	lock     sync.Mutex
+	requests []pvoutputRequest
+	// Status codes returned for the first requests. Later
+	// requests succeed.
+	failures []int
+	// Time the rate limit resets, reported when a request fails
+	// with 403
+	reset time.Time
+}
+
+func newPVOutputServer(failures ...int) *pvoutputServer {
+	s := &pvoutputServer{failures: failures}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+
+		s.lock.Lock()
+		defer s.lock.Unlock()
+
+		s.requests = append(s.requests, pvoutputRequest{
+			path:   r.URL.Path,
+			key:    r.Header.Get("X-Pvoutput-Apikey"),
+			system: r.Header.Get("X-Pvoutput-SystemId"),
+			form:   r.PostForm,
+		})
+
+		if len(s.failures) > 0 {
+			status := s.failures[0]
+			s.failures = s.failures[1:]
+			if status == http.StatusForbidden {
+				w.Header().Set("X-Rate-Limit-Remaining", "0")
+				w.Header().Set("X-Rate-Limit-Reset",
+					strconv.FormatInt(s.reset.Unix(), 10))
+				http.Error(w, "Forbidden 403: Exceeded 60 requests per hour", status)
+				return
+			}
+			http.Error(w, "failure", status)
+			return
+		}
+
+		w.Header().Set("X-Rate-Limit-Remaining", "59")
+		if r.URL.Path == pvoutputBatchStatusPath {
+			var added []string
+			for _, st := range strings.Split(r.PostForm.Get("data"), ";") {
+				f := strings.Split(st, ",")
+				added = append(added, f[0]+","+f[1]+",1")
+			}
+			w.Write([]byte(strings.Join(added, ";")))
+		} else {
+			w.Write([]byte("OK 200: Added Status"))
+		}
+	}))
+
+	return s
+}
+
+func pvoutputMessage(when time.Time, energy, power float64) *Message {
+	return &Message{
+		When:   when,
+		Source: "1",
+		Message: map[string]interface{}{
+			"temperature": 41.5,
+			"energy":      map[string]interface{}{"today_wh": energy},
+			"power":       map[string]interface{}{"ac": power},
+			"inputs": []interface{}{
+				map[string]interface{}{"voltage": 312.0},
+			},
+		},
+	}
+}
+
+func newTestPVOutput(t *testing.T, s *pvoutputServer, cfg PVOutputConfig) *PVOutput {
+	cfg.URL = s.URL
+	cfg.APIKey = "key"
+	cfg.SystemID = "1234"
+	cfg.Timezone = "UTC"
+
+	p, err := cfg.Create()
+	if err != nil {
+		t.Fatal("Create failed: ", err)
+	}
+
+	return p
+}
+
+var pvoutputStart = time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+
+func TestPVOutput(t *testing.T) {
+	s := newPVOutputServer()
+	defer s.Close()
+
+	p := newTestPVOutput(t, s, PVOutputConfig{})
+	p.now = func() time.Time { return pvoutputStart.Add(6 * time.Minute) }
+
+	p.SendMessage(pvoutputMessage(pvoutputStart.Add(1*time.Minute), 1000, 1500))
+	p.SendMessage(pvoutputMessage(pvoutputStart.Add(3*time.Minute), 1100, 1600.4))
+	if len(s.requests) != 0 {
+		t.Fatal("Status uploaded before the end of the interval")
+	}
+
+	if err := p.SendMessage(pvoutputMessage(pvoutputStart.Add(6*time.Minute), 1200, 1700)); err != nil {
+		t.Fatal("SendMessage failed: ", err)
+	}
+	if len(s.requests) != 1 {
+		t.Fatalf("Got %d requests; want 1", len(s.requests))
+	}
+
+	r := s.requests[0]
+	if r.path != pvoutputStatusPath || r.key != "key" || r.system != "1234" {
+		t.Errorf("Unexpected request %s %s %s", r.path, r.key, r.system)
+	}
+
+	want := url.Values{
+		"d":  {"20220601"},
+		"t":  {"12:05"},
+		"v1": {"1100"},
+		"v2": {"1600"},
+		"v5": {"41.5"},
+		"v6": {"312"},
+	}
+	if r.form.Encode() != want.Encode() {
+		t.Errorf("Unexpected status %s; want %s", r.form.Encode(), want.Encode())
+	}
+
+	// The partial interval is uploaded on shutdown
+	if err := p.Close(); err != nil {
+		t.Fatal("Close failed: ", err)
+	}
+	if len(s.requests) != 2 || s.requests[1].form.Get("t") != "12:06" {
+		t.Errorf("Unexpected requests %v", s.requests)
+	}
+}
+
+func TestPVOutputBackfill(t *testing.T) {
+	s := newPVOutputServer(http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	defer s.Close()
+
+	p := newTestPVOutput(t, s, PVOutputConfig{
+		Fields: map[string]string{"v2": "power.ac"},
+	})
+	now := pvoutputStart
+	p.now = func() time.Time { return now }
+
+	// The first upload fails and the message is returned to the
+	// caller
+	now = pvoutputStart.Add(6 * time.Minute)
+	p.SendMessage(pvoutputMessage(pvoutputStart.Add(1*time.Minute), 0, 100))
+	if err := p.SendMessage(pvoutputMessage(now, 0, 200)); err == nil {
+		t.Error("Failed upload didn't return an error")
+	}
+	if len(s.requests) != 1 || len(p.pending) != 1 {
+		t.Fatalf("Got %d requests and %d pending statuses; want 1 and 1",
+			len(s.requests), len(p.pending))
+	}
+
+	// Replaying the message from the spool replaces the status of
+	// its interval instead of adding another one
+	if err := p.SendMessage(pvoutputMessage(now, 0, 200)); err == nil {
+		t.Error("Failed upload didn't return an error")
+	}
+	if len(s.requests) != 2 || len(p.pending) != 1 {
+		t.Fatalf("Got %d requests and %d pending statuses; want 2 and 1",
+			len(s.requests), len(p.pending))
+	}
+
+	// Missed statuses are uploaded in a single batch
+	now = pvoutputStart.Add(11 * time.Minute)
+	if err := p.SendMessage(pvoutputMessage(now, 0, 300)); err != nil {
+		t.Fatal("SendMessage failed: ", err)
+	}
+
+	if len(s.requests) != 3 || len(p.pending) != 0 {
+		t.Fatalf("Got %d requests and %d pending statuses; want 3 and 0",
+			len(s.requests), len(p.pending))
+	}
+
+	r := s.requests[2]
+	want := "20220601,12:05,,100,,,,;20220601,12:10,,200,,,,"
+	if r.path != pvoutputBatchStatusPath || r.form.Get("data") != want {
+		t.Errorf("Unexpected batch %s %s; want %s", r.path, r.form.Get("data"), want)
+	}
+}
+
+func TestPVOutputRateLimit(t *testing.T) {
+	s := newPVOutputServer(http.StatusForbidden)
+	s.reset = pvoutputStart.Add(time.Hour)
+	defer s.Close()
+
+	p := newTestPVOutput(t, s, PVOutputConfig{RateLimit: 2})
+	now := pvoutputStart.Add(6 * time.Minute)
+	p.now = func() time.Time { return now }
+
+	// The service reports that the rate limit has been exceeded
+	p.SendMessage(pvoutputMessage(pvoutputStart.Add(time.Minute), 0, 100))
+	p.SendMessage(pvoutputMessage(now, 0, 100))
+	if len(s.requests) != 1 || len(p.pending) != 1 {
+		t.Fatalf("Got %d requests and %d pending statuses; want 1 and 1",
+			len(s.requests), len(p.pending))
+	}
+
+	// No requests until the limit resets
+	now = pvoutputStart.Add(11 * time.Minute)
+	p.SendMessage(pvoutputMessage(now, 0, 100))
+	if len(s.requests) != 1 {
+		t.Fatalf("Request sent while rate limited")
+	}
+
+	now = pvoutputStart.Add(61 * time.Minute)
+	if err := p.Flush(); err != nil {
+		t.Fatal("Flush failed: ", err)
+	}
+	if len(s.requests) != 2 || len(p.pending) != 0 {
+		t.Fatalf("Got %d requests and %d pending statuses; want 2 and 0",
+			len(s.requests), len(p.pending))
+	}
+
+	// The local limit allows two requests per hour
+	for i := 0; i < 2; i++ {
+		now = now.Add(5 * time.Minute)
+		p.SendMessage(pvoutputMessage(now, 0, 100))
+	}
+	if len(s.requests) != 3 || len(p.pending) != 1 {
+		t.Errorf("Got %d requests and %d pending statuses; want 3 and 1",
+			len(s.requests), len(p.pending))
+	}
+}
+
+func TestPVOutputClose(t *testing.T) {
+	s := newPVOutputServer()
+	defer s.Close()
+
+	p := newTestPVOutput(t, s, PVOutputConfig{})
+	if err := p.Connect(); err != nil {
+		t.Fatal("Connect failed: ", err)
+	}
+	p.SendMessage(pvoutputMessage(time.Now(), 1000, 1500))
+	if err := p.Close(); err != nil {
+		t.Fatal("Close failed: ", err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal("Second close failed: ", err)
+	}
+}
+
+func TestPVOutputConfigErrors(t *testing.T) {
+	for _, cfg := range []PVOutputConfig{
+		{SystemID: "1"},
+		{APIKey: "key"},
+		{APIKey: "key", SystemID: "1", Fields: map[string]string{"v7": "power.ac"}},
+		{APIKey: "key", SystemID: "1", Timezone: "Nowhere/Unknown"},
+	} {
+		if _, err := cfg.Create(); err == nil {
+			t.Errorf("Configuration %+v accepted", cfg)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+/*
+ * SPDX-FileCopyrightText: Copyright 2022 Andreas Sandberg <andreas@sandberg.uk>
+ *
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package hermes
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const spoolSuffix = ".msg"
+
+// Serialized form of a spooled message
+type spoolRecord struct {
+	When    time.Time              `json:"when"`
+	Source  string                 `json:"source,omitempty"`
+	Labels  map[string]string      `json:"labels,omitempty"`
+	Message map[string]interface{} `json:"message"`
+}
+
+// Convert a value to a form that preserves the distinction between
+// integers and floats when spooled. Floats are always encoded with a
+// decimal point or an exponent.
+func spoolEncode(v interface{}) interface{} {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return v
+		}
+		m := make(map[string]interface{}, rv.Len())
+		for _, k := range rv.MapKeys() {
+			m[k.String()] = spoolEncode(rv.MapIndex(k).Interface())
+		}
+		return m
+	case reflect.Slice, reflect.Array:
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			return v
+		}
+		s := make([]interface{}, rv.Len())
+		for i := range s {
+			s[i] = spoolEncode(rv.Index(i).Interface())
+		}
+		return s
+	case reflect.Float32, reflect.Float64:
+		f := rv.Float()
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			// Not representable, let the encoder fail
+			return v
+		}
+		n := strconv.FormatFloat(f, 'g', -1, rv.Type().Bits())
+		if !strings.ContainsAny(n, ".eE") {
+			n += ".0"
+		}
+		return json.Number(n)
+	default:
+		return v
+	}
+}
+
+// Restore the numeric types of a value decoded using UseNumber.
+// Integers are restored as int64, or uint64 if they don't fit.
+func spoolDecode(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = spoolDecode(e)
+		}
+		return v
+	case []interface{}:
+		for i, e := range v {
+			v[i] = spoolDecode(e)
+		}
+		return v
+	case json.Number:
+		s := string(v)
+		if !strings.ContainsAny(s, ".eE") {
+			if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+				return i
+			}
+			if u, err := strconv.ParseUint(s, 10, 64); err == nil {
+				return u
+			}
+		}
+		f, _ := v.Float64()
+		return f
+	default:
+		return v
+	}
+}
+
+type spoolEntry struct {
+	seq  uint64
+	size int64
+}
+
+// Size-bounded on-disk queue of messages. Each message is stored in
+// a separate file named after its sequence number. The oldest
+// messages are dropped when the queue exceeds its maximum size.
+type Spool struct {
+	dir     string
+	maxSize int64
+
+	lock    sync.Mutex
+	entries []spoolEntry
+	size    int64
+	next    uint64
+	dropped uint64
+}
+
+// Open a spool directory, creating it if necessary. Messages left
+// in the directory are queued in their original order.
+func OpenSpool(dir string, maxSize int64) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Spool{
+		dir:     dir,
+		maxSize: maxSize,
+	}
+
+	for _, f := range files {
+		name := f.Name()
+		if strings.HasSuffix(name, ".tmp") {
+			// Incomplete write
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+
+		if !strings.HasSuffix(name, spoolSuffix) {
+			continue
+		}
+
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, spoolSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		info, err := f.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		s.entries = append(s.entries, spoolEntry{seq, info.Size()})
+		s.size += info.Size()
+	}
+
+	sort.Slice(s.entries, func(i, j int) bool {
+		return s.entries[i].seq < s.entries[j].seq
+	})
+	if n := len(s.entries); n > 0 {
+		s.next = s.entries[n-1].seq + 1
+	}
+
+	return s, nil
+}
+
+func (s *Spool) path(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, spoolSuffix))
+}
+
+// Add a message to the end of the queue
+func (s *Spool) Push(m *Message) error {
+	data, err := json.Marshal(&spoolRecord{
+		When:    m.When,
+		Source:  m.Source,
+		Labels:  m.Labels,
+		Message: spoolEncode(m.Message).(map[string]interface{}),
+	})
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	seq := s.next
+	path := s.path(seq)
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+
+	s.next++
+	s.entries = append(s.entries, spoolEntry{seq, int64(len(data))})
+	s.size += int64(len(data))
+
+	dropped := 0
+	for s.maxSize > 0 && s.size > s.maxSize && len(s.entries) > 1 {
+		s.removeHead()
+		dropped++
+	}
+	s.dropped += uint64(dropped)
+	if dropped > 0 {
+		Log.Printf("Spool '%s' full, dropped %d messages", s.dir, dropped)
+	}
+
+	return nil
+}
+
+func (s *Spool) removeHead() {
+	e := s.entries[0]
+	os.Remove(s.path(e.seq))
+	s.entries = s.entries[1:]
+	s.size -= e.size
+}
+
+// Get the oldest message in the queue without removing it. Returns
+// nil if the queue is empty. Corrupt messages are dropped.
+func (s *Spool) Peek() (*Message, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for len(s.entries) > 0 {
+		data, err := os.ReadFile(s.path(s.entries[0].seq))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		var r spoolRecord
+		if err == nil {
+			dec := json.NewDecoder(bytes.NewReader(data))
+			dec.UseNumber()
+			if err = dec.Decode(&r); err == nil {
+				spoolDecode(r.Message)
+				return &Message{
+					When:    r.When,
+					Source:  r.Source,
+					Labels:  r.Labels,
+					Message: r.Message,
+				}, nil
+			}
+		}
+
+		Log.Printf("Dropping unreadable message from spool '%s': %s", s.dir, err)
+		s.removeHead()
+	}
+
+	return nil, nil
+}
+
+// Remove the oldest message from the queue
+func (s *Spool) Pop() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.entries) > 0 {
+		s.removeHead()
+	}
+}
+
+// Get the number of queued messages
+func (s *Spool) Len() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return len(s.entries)
+}
+
+// Get the number of messages dropped because the spool was full
+func (s *Spool) Dropped() uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.dropped
+}
+
+// Get the size of all queued messages in bytes
+func (s *Spool) Size() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.size
+}
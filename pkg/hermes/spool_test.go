@@ -0,0 +1,165 @@
+/*
+ * SPDX-FileCopyrightText: Copyright 2022 Andreas Sandberg <andreas@sandberg.uk>
+ *
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package hermes
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func spoolMessage(i int) *Message {
+	return &Message{
+		When:    time.Date(2022, 6, 1, 12, i, 0, 0, time.UTC),
+		Source:  "1",
+		Labels:  map[string]string{"serial": "0807060504030201"},
+		Message: map[string]interface{}{"seq": float64(i)},
+	}
+}
+
+func TestSpool(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenSpool(dir, 0)
+	if err != nil {
+		t.Fatal("OpenSpool failed: ", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := s.Push(spoolMessage(i)); err != nil {
+			t.Fatal("Push failed: ", err)
+		}
+	}
+
+	// Messages survive reopening the spool
+	s, err = OpenSpool(dir, 0)
+	if err != nil {
+		t.Fatal("OpenSpool failed: ", err)
+	}
+	if s.Len() != 3 || s.Size() == 0 {
+		t.Errorf("Unexpected spool length %d, size %d", s.Len(), s.Size())
+	}
+
+	for i := 0; i < 3; i++ {
+		m, err := s.Peek()
+		if err != nil {
+			t.Fatal("Peek failed: ", err)
+		}
+
+		want := spoolMessage(i)
+		if m == nil || !m.When.Equal(want.When) || m.Source != want.Source ||
+			m.Labels["serial"] != want.Labels["serial"] ||
+			m.Message["seq"] != want.Message["seq"] {
+
+			t.Errorf("Unexpected message %+v; want %+v", m, want)
+		}
+		s.Pop()
+	}
+
+	if m, _ := s.Peek(); m != nil || s.Size() != 0 {
+		t.Errorf("Spool not empty, got %+v", m)
+	}
+}
+
+func TestSpoolLimit(t *testing.T) {
+	s, err := OpenSpool(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal("OpenSpool failed: ", err)
+	}
+
+	s.Push(spoolMessage(0))
+	s.maxSize = 3 * s.Size()
+
+	for i := 1; i < 10; i++ {
+		s.Push(spoolMessage(i))
+	}
+
+	// The oldest messages are dropped first
+	if s.Len() != 3 {
+		t.Errorf("Unexpected spool length %d", s.Len())
+	}
+	if m, _ := s.Peek(); m == nil || m.Message["seq"] != 7.0 {
+		t.Errorf("Unexpected head %+v", m)
+	}
+}
+
+type flakyBackend struct {
+	online bool
+	seen   []string
+}
+
+func (b *flakyBackend) Connect() error { return nil }
+
+func (b *flakyBackend) SendMessage(m *Message) error {
+	if !b.online {
+		return errors.New("offline")
+	}
+
+	b.seen = append(b.seen, fmt.Sprintf("%v@%s", m.Message["seq"], m.When.Format("15:04")))
+	return nil
+}
+
+func TestHermesSpool(t *testing.T) {
+	b := &flakyBackend{}
+	h := newHermes()
+	err := h.addBackend("test", b, &QueueConfig{Spool: t.TempDir()})
+	if err != nil {
+		t.Fatal("addBackend failed: ", err)
+	}
+	w := h.workers["test"]
+
+	w.deliver(spoolMessage(0))
+	w.deliver(spoolMessage(1))
+	if st := h.Stats()["test"]; st.Queued != 2 || st.Failed != 2 {
+		t.Errorf("Unexpected stats %+v", st)
+	}
+
+	// Spooled messages are delivered in order before new ones
+	b.online = true
+	w.deliver(spoolMessage(2))
+
+	want := "[0@12:00 1@12:01 2@12:02]"
+	if got := fmt.Sprint(b.seen); got != want {
+		t.Errorf("Delivered %s; want %s", got, want)
+	}
+	if st := h.Stats()["test"]; st.Queued != 0 || st.Delivered != 3 {
+		t.Errorf("Unexpected stats %+v", st)
+	}
+}
+
+func TestSpoolTypes(t *testing.T) {
+	s, err := OpenSpool(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal("OpenSpool failed: ", err)
+	}
+
+	s.Push(&Message{
+		When: time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC),
+		Message: map[string]interface{}{
+			"status": uint(1),
+			"total":  uint64(1 << 63),
+			"power":  float32(1500),
+			"grid": map[string]interface{}{
+				"voltage": 230.5,
+				"current": -2,
+			},
+			"energy": 1e21,
+		},
+	})
+
+	m, err := s.Peek()
+	if err != nil {
+		t.Fatal("Peek failed: ", err)
+	}
+	grid, _ := m.Message["grid"].(map[string]interface{})
+	if m.Message["status"] != int64(1) || m.Message["total"] != uint64(1<<63) ||
+		m.Message["power"] != float64(1500) || m.Message["energy"] != 1e21 ||
+		grid["voltage"] != 230.5 || grid["current"] != int64(-2) {
+
+		t.Errorf("Types not preserved: %#v", m.Message)
+	}
+}
@@ -0,0 +1,206 @@
+/*
+ * SPDX-FileCopyrightText: Copyright 2022 Andreas Sandberg <andreas@sandberg.uk>
+ *
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package hermes
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Formatter that renders messages using a Go text/template. The
+// output of the template is published on the topic itself. Templates
+// may publish additional messages on sub-topics using the emit
+// function.
+type TemplateFormatter struct {
+	// Inline template
+	Template string
+	// File containing the template, relative to the
+	// configuration file
+	File string
+
+	tmpl *template.Template
+}
+
+// Data available to templates
+type templateData struct {
+	When   time.Time
+	Device string
+	Labels map[string]string
+	Data   map[string]interface{}
+}
+
+// Convert a numeric value to a float
+func templateFloat(v interface{}) (float64, error) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), nil
+	case reflect.String:
+		return strconv.ParseFloat(rv.String(), 64)
+	default:
+		return 0, fmt.Errorf("Can't convert %v to a number", v)
+	}
+}
+
+// Multiply a value by a factor, e.g., {{ .Data.power.ac | scale 0.001 }}
+func templateScale(factor float64, v interface{}) (float64, error) {
+	f, err := templateFloat(v)
+	return f * factor, err
+}
+
+// Round a value to a number of decimal places, e.g.,
+// {{ .Data.grid.voltage | round 1 }}
+func templateRound(places int, v interface{}) (string, error) {
+	f, err := templateFloat(v)
+	if err != nil {
+		return "", err
+	}
+
+	// Round half away from zero rather than to even
+	p := math.Pow(10, float64(places))
+	f = math.Round(f*p) / p
+	if places < 0 {
+		places = 0
+	}
+
+	return strconv.FormatFloat(f, 'f', places, 64), nil
+}
+
+// Format a time stamp, e.g., {{ .When | time "2006-01-02" }}. The
+// layouts "unix", "unix_ms" and "rfc3339" are also supported.
+func templateTime(layout string, t time.Time) string {
+	switch layout {
+	case "unix":
+		return strconv.FormatInt(t.Unix(), 10)
+	case "unix_ms":
+		return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+	case "rfc3339":
+		return t.Format(time.RFC3339)
+	default:
+		return t.Format(layout)
+	}
+}
+
+// Encode a value as JSON, e.g., {{ .Device | json }}
+func templateJSON(v interface{}) (string, error) {
+	raw, err := json.Marshal(v)
+	return string(raw), err
+}
+
+// Lookup a dot-separated path in a message, e.g.,
+// {{ get "inputs.0.voltage" .Data }}. Returns nil for missing values.
+func templateGet(path string, data map[string]interface{}) interface{} {
+	v, _ := Lookup(data, path)
+	return v
+}
+
+func templateFuncs(emit func(path string, v interface{}) string) template.FuncMap {
+	return template.FuncMap{
+		"scale": templateScale,
+		"round": templateRound,
+		"time":  templateTime,
+		"json":  templateJSON,
+		"get":   templateGet,
+		"emit":  emit,
+	}
+}
+
+func (tf *TemplateFormatter) load(basePath string) error {
+	text := tf.Template
+	name := "template"
+	switch {
+	case tf.Template != "" && tf.File != "":
+		return fmt.Errorf("Specify either an inline template or a template file")
+
+	case tf.File != "":
+		path := resolvePath(basePath, tf.File)
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("Failed to read template: %s", err)
+		}
+		text = string(raw)
+		name = filepath.Base(path)
+
+	case tf.Template == "":
+		return fmt.Errorf("Template not specified")
+	}
+
+	tmpl, err := template.New(name).
+		Option("missingkey=error").
+		Funcs(templateFuncs(nil)).
+		Parse(text)
+	if err != nil {
+		return fmt.Errorf("Failed to parse template: %s", err)
+	}
+
+	tf.tmpl = tmpl
+	return nil
+}
+
+func (tf *TemplateFormatter) FormatMessage(msg *Message) ([]FormattedMessage, error) {
+	if tf.tmpl == nil {
+		return nil, fmt.Errorf("Template not loaded")
+	}
+
+	var fms []FormattedMessage
+	emit := func(path string, v interface{}) string {
+		var value string
+		switch v := v.(type) {
+		case string:
+			value = v
+		case []byte:
+			value = string(v)
+		default:
+			value = fmt.Sprint(v)
+		}
+
+		fms = append(fms, FormattedMessage{
+			Path:    strings.Split(path, "/"),
+			Message: []byte(value),
+		})
+		return ""
+	}
+
+	// Clone the template to bind emit to this message
+	tmpl, err := tf.tmpl.Clone()
+	if err != nil {
+		return nil, err
+	}
+	tmpl.Funcs(templateFuncs(emit))
+
+	var out bytes.Buffer
+	err = tmpl.Execute(&out, &templateData{
+		When:   msg.When,
+		Device: msg.Source,
+		Labels: msg.Labels,
+		Data:   msg.Message,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Templates that only emit sub-topics don't publish on the
+	// topic itself.
+	if strings.TrimSpace(out.String()) != "" {
+		fms = append([]FormattedMessage{{Message: out.Bytes()}}, fms...)
+	}
+
+	return fms, nil
+}
@@ -0,0 +1,109 @@
+/*
+ * SPDX-FileCopyrightText: Copyright 2022 Andreas Sandberg <andreas@sandberg.uk>
+ *
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package hermes
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var templateMessage = Message{
+	When:   testMessage.When,
+	Source: "1",
+	Labels: map[string]string{"serial": "0807060504030201"},
+	Message: map[string]interface{}{
+		"power":  map[string]interface{}{"ac": 1234.56},
+		"inputs": []interface{}{map[string]interface{}{"voltage": 201.25}},
+		"status": uint(1),
+	},
+}
+
+func formatTemplate(t *testing.T, cfg map[string]interface{}, basePath string) []FormattedMessage {
+	f, err := createFormatterMap(cfg, basePath)
+	if err != nil {
+		t.Fatal("createFormatterMap failed: ", err)
+	}
+
+	fms, err := f.FormatMessage(&templateMessage)
+	if err != nil {
+		t.Fatal("FormatMessage failed: ", err)
+	}
+
+	return fms
+}
+
+func TestTemplateFormatter(t *testing.T) {
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{`{{ .Data.power.ac | scale 0.001 | round 2 }}`, "1.23"},
+		{`{{ .Data.power.ac | round -2 }}`, "1200"},
+		{`{{ get "inputs.0.voltage" .Data | round 1 }}`, "201.3"},
+		{`{{ .When | time "unix" }} {{ .When | time "2006-01-02" }}`, "1654084800 2022-06-01"},
+		{`{"device":{{ .Device | json }},"status":{{ .Data.status }}}`, `{"device":"1","status":1}`},
+		{`{{ with get "missing" .Data }}x{{ else }}none{{ end }}`, "none"},
+	}
+
+	for _, test := range tests {
+		fms := formatTemplate(t, map[string]interface{}{
+			"type":     "template",
+			"template": test.template,
+		}, "")
+
+		if len(fms) != 1 || fms[0].Path != nil || string(fms[0].Message) != test.want {
+			t.Errorf("Template '%s' gave %q; want %q", test.template, fms, test.want)
+		}
+	}
+}
+
+func TestTemplateEmit(t *testing.T) {
+	dir := t.TempDir()
+	tmpl := `{{ emit "power" (.Data.power.ac | round 0) }}` +
+		`{{ emit "input/1/voltage" (index .Data.inputs 0).voltage }}`
+	if err := os.WriteFile(filepath.Join(dir, "emon.tmpl"), []byte(tmpl+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	fms := formatTemplate(t, map[string]interface{}{
+		"type": "template",
+		"file": "emon.tmpl",
+	}, dir)
+
+	if len(fms) != 2 ||
+		fms[0].Path[0] != "power" || string(fms[0].Message) != "1235" ||
+		len(fms[1].Path) != 3 || string(fms[1].Message) != "201.25" {
+
+		t.Errorf("Unexpected messages %q", fms)
+	}
+}
+
+func TestTemplateErrors(t *testing.T) {
+	for _, cfg := range []map[string]interface{}{
+		{"type": "template"},
+		{"type": "template", "template": "{{ .Data", "file": "x"},
+		{"type": "template", "template": "{{ .Data"},
+		{"type": "template", "template": "{{ unknown }}"},
+		{"type": "template", "file": "missing.tmpl"},
+	} {
+		if _, err := createFormatterMap(cfg, t.TempDir()); err == nil {
+			t.Errorf("createFormatterMap(%v) didn't fail", cfg)
+		}
+	}
+
+	f, err := createFormatterMap(map[string]interface{}{
+		"type":     "template",
+		"template": "{{ .Data.missing }}",
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.FormatMessage(&templateMessage); err == nil {
+		t.Error("Missing key didn't fail")
+	}
+}
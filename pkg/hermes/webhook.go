@@ -0,0 +1,303 @@
+/*
+ * SPDX-FileCopyrightText: Copyright 2022 Andreas Sandberg <andreas@sandberg.uk>
+ *
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package hermes
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+type WebhookConfig struct {
+	basePath string
+
+	// URL messages are sent to. The placeholder "{device}" is
+	// replaced with the identity of the message source. Messages
+	// the formatter publishes on a sub-path (e.g., the value
+	// formatter) are sent to the sub-path of the URL.
+	URL string
+	// HTTP method, defaults to POST
+	Method string
+	// Message format, defaults to json
+	Format MessageFormatter
+	// Content type of requests, defaults to application/json
+	ContentType string `mapstructure:"content_type"`
+	// Additional request headers
+	Headers map[string]string
+
+	// Bearer token authentication
+	Token     string
+	TokenFile string `mapstructure:"token_file"`
+	TokenEnv  string `mapstructure:"token_env"`
+
+	// Basic authentication
+	Username     string
+	Password     string
+	PasswordFile string `mapstructure:"password_file"`
+	PasswordEnv  string `mapstructure:"password_env"`
+
+	// Status codes indicating success. Defaults to any 2xx code.
+	Status []int
+
+	// Number of messages sent in a single request. Batches are
+	// sent as a JSON array and require a formatter producing JSON.
+	BatchSize int `mapstructure:"batch_size"`
+	// Maximum time a message is buffered before it is sent
+	FlushInterval time.Duration `mapstructure:"flush_interval"`
+	// Number of attempts for each request
+	Retries int
+	// Delay before the first retry, doubles after each attempt
+	RetryDelay time.Duration `mapstructure:"retry_delay"`
+	// HTTP request timeout
+	Timeout time.Duration
+
+	TLSConfig `mapstructure:",squash"`
+}
+
+// Backend sending messages to an HTTP endpoint
+type Webhook struct {
+	config *WebhookConfig
+	client *http.Client
+	// Value of the Authorization header
+	auth string
+
+	batch *batcher
+}
+
+func webhookCreateViper(subv *viper.Viper, basePath string) (Backend, error) {
+	cfg := WebhookConfig{
+		basePath: basePath,
+	}
+
+	if err := subv.Unmarshal(&cfg, decodeHooks(basePath)); err != nil {
+		return nil, err
+	}
+
+	return cfg.Create()
+}
+
+func init() {
+	Backends["webhook"] = BackendFactory{
+		CreateViper: webhookCreateViper,
+	}
+}
+
+func (wc *WebhookConfig) Create() (*Webhook, error) {
+	if bp, err := defaultBasePath(wc.basePath); err == nil {
+		wc.basePath = bp
+	} else {
+		return nil, err
+	}
+
+	if wc.Method == "" {
+		wc.Method = http.MethodPost
+	}
+	if wc.Format == nil {
+		wc.Format = &JSONFormatter{}
+	}
+	if wc.ContentType == "" {
+		wc.ContentType = "application/json"
+	}
+	if wc.BatchSize <= 0 {
+		wc.BatchSize = 1
+	}
+	if wc.FlushInterval <= 0 {
+		wc.FlushInterval = 10 * time.Second
+	}
+	if wc.Retries <= 0 {
+		wc.Retries = 3
+	}
+	if wc.RetryDelay <= 0 {
+		wc.RetryDelay = time.Second
+	}
+	if wc.Timeout <= 0 {
+		wc.Timeout = 10 * time.Second
+	}
+
+	u, err := url.Parse(strings.ReplaceAll(wc.URL, "{device}", "device"))
+	if err != nil {
+		return nil, fmt.Errorf("Illegal webhook URL: %s", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("Unsupported webhook URL scheme '%s'", u.Scheme)
+	}
+
+	wh := &Webhook{
+		config: wc,
+	}
+	wh.batch = newBatcher("Webhook", wc.BatchSize, wc.FlushInterval, wh.sendBatch)
+
+	token, err := readSecret(wc.basePath, wc.Token, wc.TokenFile, wc.TokenEnv)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read webhook token: %s", err)
+	}
+	password, err := readSecret(wc.basePath,
+		wc.Password, wc.PasswordFile, wc.PasswordEnv)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read webhook password: %s", err)
+	}
+
+	switch {
+	case token != "" && wc.Username != "":
+		return nil, fmt.Errorf("Specify either a token or a username")
+	case token != "":
+		wh.auth = "Bearer " + token
+	case wc.Username != "":
+		wh.auth = "Basic " + base64.StdEncoding.EncodeToString(
+			[]byte(wc.Username+":"+password))
+	}
+
+	tlsConfig, err := wc.TLSConfig.Config(wc.basePath)
+	if err != nil {
+		return nil, err
+	}
+
+	wh.client = &http.Client{
+		Timeout: wc.Timeout,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+	}
+
+	return wh, nil
+}
+
+func (wh *Webhook) Connect() error {
+	wh.batch.start()
+
+	return nil
+}
+
+// Get the URL of a formatted message
+func (wh *Webhook) messageURL(m *Message, fm *FormattedMessage) string {
+	u := strings.ReplaceAll(wh.config.URL, "{device}", url.PathEscape(m.Source))
+	if len(fm.Path) == 0 {
+		return u
+	}
+
+	path := make([]string, len(fm.Path))
+	for i, p := range fm.Path {
+		path[i] = url.PathEscape(p)
+	}
+
+	return strings.TrimSuffix(u, "/") + "/" + strings.Join(path, "/")
+}
+
+func (wh *Webhook) SendMessage(m *Message) error {
+	msgs, err := wh.config.Format.FormatMessage(m)
+	if err != nil {
+		Log.Print("Webhook failed to format message: ", err)
+		return nil
+	}
+
+	items := make([]*batchItem, 0, len(msgs))
+	for i := range msgs {
+		fm := &msgs[i]
+		if wh.config.BatchSize > 1 && !json.Valid(fm.Message) {
+			Log.Print("Webhook batches require JSON messages, dropping message")
+			continue
+		}
+
+		// Batches only contain messages sent to the same URL
+		items = append(items, &batchItem{
+			key:  wh.messageURL(m, fm),
+			data: fm.Message,
+		})
+	}
+
+	if len(items) == 0 {
+		return nil
+	}
+
+	return wh.batch.add(items...)
+}
+
+func (wh *Webhook) statusOK(status int) bool {
+	if len(wh.config.Status) == 0 {
+		return status >= 200 && status < 300
+	}
+
+	for _, s := range wh.config.Status {
+		if s == status {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (wh *Webhook) send(u string, body []byte) error {
+	req, err := http.NewRequest(wh.config.Method, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", wh.config.ContentType)
+	for k, v := range wh.config.Headers {
+		req.Header.Set(k, v)
+	}
+	if wh.auth != "" {
+		req.Header.Set("Authorization", wh.auth)
+	}
+
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if wh.statusOK(resp.StatusCode) {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+
+	raw, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	msg := strings.TrimSpace(string(raw))
+
+	// Client errors won't go away by retrying, except for rate
+	// limiting.
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusTooManyRequests {
+
+		return &permanentError{"Webhook", resp.StatusCode, msg}
+	}
+
+	return fmt.Errorf("Webhook request failed with status %d: %s",
+		resp.StatusCode, msg)
+}
+
+// Send a batch of messages to a URL, retrying with an exponential
+// back-off
+func (wh *Webhook) sendBatch(u string, msgs [][]byte) error {
+	body := msgs[0]
+	if wh.config.BatchSize > 1 {
+		body = append(append([]byte("["), bytes.Join(msgs, []byte(","))...), ']')
+	}
+
+	return retryRequest(wh.config.Retries, wh.config.RetryDelay, func() error {
+		return wh.send(u, body)
+	})
+}
+
+// Send all buffered messages
+func (wh *Webhook) Flush() error {
+	return wh.batch.Flush()
+}
+
+// Stop the background flusher and send any buffered messages.
+func (wh *Webhook) Close() error {
+	return wh.batch.Close()
+}
@@ -0,0 +1,254 @@
+/*
+ * SPDX-FileCopyrightText: Copyright 2022 Andreas Sandberg <andreas@sandberg.uk>
+ *
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package hermes
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type webhookTestRequest struct {
+	method string
+	path   string
+	header http.Header
+	body   string
+}
+
+type webhookServer struct {
+	*httptest.Server
+
+	lock     sync.Mutex
+	requests []webhookTestRequest
+	// Status codes returned for the first requests. Later
+	// requests succeed.
+	responses []int
+}
+
+func newWebhookServer(responses ...int) *webhookServer {
+	s := &webhookServer{responses: responses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		s.lock.Lock()
+		defer s.lock.Unlock()
+
+		s.requests = append(s.requests, webhookTestRequest{
+			method: r.Method,
+			path:   r.URL.Path,
+			header: r.Header,
+			body:   string(body),
+		})
+
+		if len(s.responses) > 0 {
+			status := s.responses[0]
+			s.responses = s.responses[1:]
+			http.Error(w, "failure", status)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	return s
+}
+
+func TestWebhook(t *testing.T) {
+	s := newWebhookServer()
+	defer s.Close()
+
+	cfg := WebhookConfig{
+		URL:     s.URL + "/ingest/{device}",
+		Headers: map[string]string{"x-api-key": "key"},
+		Token:   "secret",
+	}
+	wh, err := cfg.Create()
+	if err != nil {
+		t.Fatal("Create failed: ", err)
+	}
+
+	if err := wh.SendMessage(influxTestMessage(testMessage.When)); err != nil {
+		t.Fatal("SendMessage failed: ", err)
+	}
+
+	if len(s.requests) != 1 {
+		t.Fatalf("Got %d requests; want 1", len(s.requests))
+	}
+
+	r := s.requests[0]
+	if r.method != "POST" || r.path != "/ingest/1" {
+		t.Errorf("Unexpected request %s %s", r.method, r.path)
+	}
+	if r.header.Get("Authorization") != "Bearer secret" ||
+		r.header.Get("X-Api-Key") != "key" ||
+		r.header.Get("Content-Type") != "application/json" {
+
+		t.Errorf("Unexpected headers %v", r.header)
+	}
+
+	var body map[string]interface{}
+	if err := json.Unmarshal([]byte(r.body), &body); err != nil || body["model"] != "Test \"1\"" {
+		t.Errorf("Unexpected body '%s'", r.body)
+	}
+}
+
+func TestWebhookBatch(t *testing.T) {
+	s := newWebhookServer()
+	defer s.Close()
+
+	cfg := WebhookConfig{
+		URL:       s.URL,
+		Username:  "user",
+		Password:  "pass",
+		BatchSize: 2,
+	}
+	wh, err := cfg.Create()
+	if err != nil {
+		t.Fatal("Create failed: ", err)
+	}
+
+	wh.SendMessage(influxTestMessage(testMessage.When))
+	if len(s.requests) != 0 {
+		t.Fatalf("Partial batch sent")
+	}
+
+	wh.SendMessage(influxTestMessage(testMessage.When.Add(time.Second)))
+	if len(s.requests) != 1 {
+		t.Fatalf("Got %d requests; want 1", len(s.requests))
+	}
+
+	r := s.requests[0]
+	if user, pass, ok := (&http.Request{Header: r.header}).BasicAuth(); !ok ||
+		user != "user" || pass != "pass" {
+
+		t.Errorf("Unexpected authorization '%s'", r.header.Get("Authorization"))
+	}
+
+	var batch []map[string]interface{}
+	if err := json.Unmarshal([]byte(r.body), &batch); err != nil || len(batch) != 2 {
+		t.Errorf("Unexpected batch '%s'", r.body)
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	s := newWebhookServer(http.StatusServiceUnavailable, http.StatusServiceUnavailable,
+		http.StatusServiceUnavailable, http.StatusBadRequest)
+	defer s.Close()
+
+	cfg := WebhookConfig{
+		URL:        s.URL,
+		Retries:    2,
+		RetryDelay: time.Millisecond,
+	}
+	wh, err := cfg.Create()
+	if err != nil {
+		t.Fatal("Create failed: ", err)
+	}
+
+	// Both attempts fail, the caller keeps the message
+	if err := wh.SendMessage(influxTestMessage(testMessage.When)); err == nil {
+		t.Error("Failed request didn't return an error")
+	}
+	if len(wh.batch.pending) != 0 {
+		t.Fatalf("Got %d pending messages; want 0", len(wh.batch.pending))
+	}
+
+	// Client errors aren't retried and drop the message
+	if err := wh.SendMessage(influxTestMessage(testMessage.When)); err != nil {
+		t.Error("Rejected message returned an error: ", err)
+	}
+	if len(s.requests) != 4 || len(wh.batch.pending) != 0 {
+		t.Errorf("Got %d requests and %d pending messages; want 4 and 0",
+			len(s.requests), len(wh.batch.pending))
+	}
+}
+
+func TestWebhookStatus(t *testing.T) {
+	s := newWebhookServer(http.StatusAccepted)
+	defer s.Close()
+
+	cfg := WebhookConfig{
+		URL:        s.URL,
+		Format:     &ValueFormatter{Separator: "_"},
+		Method:     "PUT",
+		Status:     []int{http.StatusOK},
+		Retries:    1,
+		RetryDelay: time.Millisecond,
+	}
+	wh, err := cfg.Create()
+	if err != nil {
+		t.Fatal("Create failed: ", err)
+	}
+
+	// 202 isn't an accepted status code
+	m := influxTestMessage(testMessage.When)
+	m.Message = map[string]interface{}{"grid": map[string]interface{}{"voltage": 242.5}}
+	if err := wh.SendMessage(m); err == nil {
+		t.Fatal("Unexpected status accepted")
+	}
+
+	if err := wh.SendMessage(m); err != nil {
+		t.Fatal("SendMessage failed: ", err)
+	}
+
+	r := s.requests[len(s.requests)-1]
+	if r.method != "PUT" || r.path != "/grid_voltage" || r.body != "242.5" {
+		t.Errorf("Unexpected request %s %s '%s'", r.method, r.path, r.body)
+	}
+}
+
+func TestWebhookClose(t *testing.T) {
+	s := newWebhookServer()
+	defer s.Close()
+
+	cfg := WebhookConfig{
+		URL:           s.URL,
+		BatchSize:     10,
+		FlushInterval: time.Millisecond,
+	}
+	wh, err := cfg.Create()
+	if err != nil {
+		t.Fatal("Create failed: ", err)
+	}
+
+	// Close while the background flusher is running
+	if err := wh.Connect(); err != nil {
+		t.Fatal("Connect failed: ", err)
+	}
+	wh.SendMessage(influxTestMessage(testMessage.When))
+	time.Sleep(5 * time.Millisecond)
+	wh.SendMessage(influxTestMessage(testMessage.When.Add(time.Second)))
+	if err := wh.Close(); err != nil {
+		t.Fatal("Close failed: ", err)
+	}
+	if err := wh.Close(); err != nil {
+		t.Fatal("Second close failed: ", err)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.requests) == 0 || len(wh.batch.pending) != 0 {
+		t.Errorf("Got %d requests and %d pending messages",
+			len(s.requests), len(wh.batch.pending))
+	}
+}
+
+func TestWebhookConfigErrors(t *testing.T) {
+	for _, cfg := range []WebhookConfig{
+		{URL: "ftp://example.com"},
+		{URL: "http://example.com", Token: "t", Username: "u"},
+		{URL: "http://example.com", TokenEnv: "GOSOLIS_TEST_UNSET_TOKEN"},
+	} {
+		if _, err := cfg.Create(); err == nil {
+			t.Errorf("Configuration %+v accepted", cfg)
+		}
+	}
+}
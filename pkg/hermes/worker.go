@@ -0,0 +1,323 @@
+/*
+ * SPDX-FileCopyrightText: Copyright 2022 Andreas Sandberg <andreas@sandberg.uk>
+ *
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+
+package hermes
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Queue overflow policies
+const (
+	// Drop the oldest queued message to make room
+	OverflowDropOldest = "drop_oldest"
+	// Drop the new message
+	OverflowDropNewest = "drop_newest"
+	// Wait for room in the queue, drop the new message on timeout
+	OverflowBlock = "block"
+)
+
+// Delivery settings shared by all backends
+type QueueConfig struct {
+	basePath string
+
+	// Number of messages waiting for delivery
+	QueueSize int `mapstructure:"queue_size"`
+	// Policy applied when the queue is full
+	Overflow string
+	// Maximum time to wait for room in the queue when using the
+	// block policy
+	BlockTimeout time.Duration `mapstructure:"block_timeout"`
+
+	// Directory used to store undelivered messages
+	Spool string
+	// Maximum size of the spool in bytes
+	SpoolSize int64 `mapstructure:"spool_size"`
+
+	// Deliver aggregates over time windows instead of every
+	// message
+	Aggregate *AggregateConfig
+}
+
+// Statistics describing a backend
+type BackendStats struct {
+	// Messages delivered to the backend
+	Delivered uint64 `json:"delivered"`
+	// Messages dropped because a queue or the spool was full
+	Dropped uint64 `json:"dropped"`
+	// Failed delivery attempts
+	Failed uint64 `json:"failed"`
+	// Messages waiting in the spool
+	Queued int `json:"queued"`
+	// Size of the spool in bytes
+	QueuedBytes int64 `json:"queued_bytes"`
+}
+
+// Work item for a backend. Either a message or a state update.
+type backendItem struct {
+	message *Message
+	update  func() error
+}
+
+// Delivers messages to a backend from a separate goroutine to
+// prevent slow backends from delaying other backends.
+type backendWorker struct {
+	// Counters, accessed atomically
+	delivered uint64
+	dropped   uint64
+	failed    uint64
+
+	name    string
+	backend Backend
+	config  *QueueConfig
+	spool   *Spool
+
+	aggregator *Aggregator
+
+	queue chan *backendItem
+	done  chan struct{}
+}
+
+func newBackendWorker(name string, b Backend, qc *QueueConfig) (*backendWorker, error) {
+	if qc.QueueSize <= 0 {
+		qc.QueueSize = 100
+	}
+	if qc.Overflow == "" {
+		qc.Overflow = OverflowDropOldest
+	}
+	if qc.BlockTimeout <= 0 {
+		qc.BlockTimeout = 5 * time.Second
+	}
+	if qc.SpoolSize <= 0 {
+		qc.SpoolSize = DefaultSpoolSize
+	}
+
+	switch qc.Overflow {
+	case OverflowDropOldest, OverflowDropNewest, OverflowBlock:
+	default:
+		return nil, fmt.Errorf("Illegal overflow policy '%s'", qc.Overflow)
+	}
+
+	w := &backendWorker{
+		name:    name,
+		backend: b,
+		config:  qc,
+		queue:   make(chan *backendItem, qc.QueueSize),
+		done:    make(chan struct{}),
+	}
+
+	if qc.Aggregate != nil {
+		if err := qc.Aggregate.validate(); err != nil {
+			return nil, err
+		}
+		w.aggregator = newAggregator(qc.Aggregate)
+	}
+
+	if qc.Spool != "" {
+		bp, err := defaultBasePath(qc.basePath)
+		if err != nil {
+			return nil, err
+		}
+
+		s, err := OpenSpool(resolvePath(bp, qc.Spool), qc.SpoolSize)
+		if err != nil {
+			return nil, err
+		}
+		if n := s.Len(); n > 0 {
+			Log.Printf("Backend '%s' has %d spooled messages", name, n)
+		}
+		w.spool = s
+	}
+
+	return w, nil
+}
+
+// Add an item to the queue. Returns false if the item was dropped.
+func (w *backendWorker) enqueue(i *backendItem) bool {
+	select {
+	case w.queue <- i:
+		return true
+	default:
+	}
+
+	switch w.config.Overflow {
+	case OverflowDropOldest:
+		for {
+			select {
+			case old := <-w.queue:
+				w.drop(old)
+			default:
+			}
+
+			select {
+			case w.queue <- i:
+				return true
+			default:
+			}
+		}
+
+	case OverflowBlock:
+		timer := time.NewTimer(w.config.BlockTimeout)
+		defer timer.Stop()
+
+		select {
+		case w.queue <- i:
+			return true
+		case <-timer.C:
+		}
+	}
+
+	w.drop(i)
+	return false
+}
+
+func (w *backendWorker) drop(i *backendItem) {
+	if i.message != nil {
+		atomic.AddUint64(&w.dropped, 1)
+	}
+}
+
+func (w *backendWorker) stats() BackendStats {
+	st := BackendStats{
+		Delivered: atomic.LoadUint64(&w.delivered),
+		Dropped:   atomic.LoadUint64(&w.dropped),
+		Failed:    atomic.LoadUint64(&w.failed),
+	}
+
+	if w.spool != nil {
+		st.Dropped += w.spool.Dropped()
+		st.Queued = w.spool.Len()
+		st.QueuedBytes = w.spool.Size()
+	}
+
+	return st
+}
+
+// Deliver queued items until the queue is closed
+func (w *backendWorker) run() {
+	defer close(w.done)
+
+	var retry <-chan time.Time
+	if w.spool != nil {
+		t := time.NewTicker(SpoolRetryInterval)
+		defer t.Stop()
+		retry = t.C
+	}
+
+	var expire <-chan time.Time
+	if w.aggregator != nil {
+		t := time.NewTicker(AggregateDelay)
+		defer t.Stop()
+		expire = t.C
+	}
+
+	for {
+		select {
+		case i, ok := <-w.queue:
+			if !ok {
+				if w.aggregator != nil {
+					w.deliverAll(w.aggregator.Flush())
+				}
+				return
+			}
+
+			if i.message != nil && w.aggregator != nil {
+				w.deliverAll(w.aggregator.Add(i.message))
+			} else if i.message != nil {
+				w.deliver(i.message)
+			} else if err := i.update(); err != nil {
+				Log.Printf("Backend '%s' failed to send update: %s", w.name, err)
+			}
+
+		case <-retry:
+			if w.spool.Len() > 0 {
+				w.replay()
+			}
+
+		case now := <-expire:
+			w.deliverAll(w.aggregator.Expire(now.Add(-AggregateDelay)))
+		}
+	}
+}
+
+func (w *backendWorker) send(m *Message) error {
+	err := w.backend.SendMessage(m)
+	if err == nil {
+		atomic.AddUint64(&w.delivered, 1)
+	} else {
+		atomic.AddUint64(&w.failed, 1)
+	}
+
+	return err
+}
+
+// Deliver spooled messages in order. Stops at the first message the
+// backend fails to deliver.
+func (w *backendWorker) replay() {
+	replayed := 0
+	defer func() {
+		if replayed > 0 {
+			Log.Printf("Backend '%s' delivered %d spooled messages", w.name, replayed)
+		}
+	}()
+
+	for {
+		m, err := w.spool.Peek()
+		if err != nil {
+			Log.Printf("Backend '%s' failed to read spool: %s", w.name, err)
+			return
+		} else if m == nil {
+			return
+		}
+
+		if err := w.send(m); err != nil {
+			return
+		}
+
+		w.spool.Pop()
+		replayed++
+	}
+}
+
+// Deliver a message to the backend. Messages are spooled if the
+// backend fails and has a spool. Spooled messages are delivered
+// before new messages to preserve their order.
+func (w *backendWorker) deliver(m *Message) {
+	if w.spool == nil || w.spool.Len() == 0 {
+		err := w.send(m)
+		if err == nil {
+			return
+		}
+
+		Log.Printf("Backend '%s' failed to send message: %s", w.name, err)
+		if w.spool != nil {
+			w.push(m)
+		}
+		return
+	}
+
+	if w.push(m) {
+		w.replay()
+	}
+}
+
+func (w *backendWorker) deliverAll(ms []*Message) {
+	for _, m := range ms {
+		w.deliver(m)
+	}
+}
+
+func (w *backendWorker) push(m *Message) bool {
+	if err := w.spool.Push(m); err != nil {
+		Log.Printf("Backend '%s' failed to spool message: %s", w.name, err)
+		atomic.AddUint64(&w.dropped, 1)
+		return false
+	}
+
+	return true
+}